@@ -0,0 +1,300 @@
+package gisquick
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default time without changes after which modified files are uploaded in auto-sync mode
+const defaultAutoSyncDebounce = 30 * time.Second
+
+// Interval of retries when the upload is postponed (quiet hours, running operation, active WAL)
+const autoSyncRetryInterval = time.Minute
+
+// Daily time window in "HH:MM" format, the end can be before the start (over midnight)
+type quietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Parses time of the day in "HH:MM" format into minutes since midnight
+func parseDayTime(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of the day: %s", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *quietHours) validate() error {
+	if _, err := parseDayTime(q.Start); err != nil {
+		return err
+	}
+	_, err := parseDayTime(q.End)
+	return err
+}
+
+// Reports whether the time is within the window
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	start, _ := parseDayTime(q.Start)
+	end, _ := parseDayTime(q.End)
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// Parameters of AutoSync message
+type autoSyncParams struct {
+	Enabled bool   `json:"enabled"`
+	Project string `json:"project"`
+	// seconds without changes before modified files are uploaded
+	Debounce float64 `json:"debounce,omitempty"`
+	// no uploads are made within this time window
+	QuietHours *quietHours `json:"quiet_hours,omitempty"`
+}
+
+// Data of AutoSyncFinished message, sent after upload of modified files
+type autoSyncResult struct {
+	TransferSummary
+	Files []string `json:"files"`
+}
+
+// Errors of auto-sync upload which didn't finish, modified files stay pending
+var (
+	// another upload is running
+	errAutoSyncBusy = errors.New("another upload is running")
+	// cancelled by operation started by the user, upload is retried later
+	errAutoSyncPreempted = errors.New("auto-sync upload was interrupted by another operation")
+	// cancelled by AbortUpload message, upload is retried after the next change
+	errAutoSyncAborted = errors.New("auto-sync upload was aborted")
+)
+
+// Reports whether an operation started by the user (upload or fetch) is running
+func (c *Client) userOperationRunning() bool {
+	c.uploadMutex.Lock()
+	uploading := c.upload != nil && !c.upload.auto
+	c.uploadMutex.Unlock()
+	c.fetchOpsMutex.Lock()
+	fetching := len(c.fetchOps) > 0
+	c.fetchOpsMutex.Unlock()
+	return uploading || fetching
+}
+
+// Returns GeoPackage/SQLite files with non-empty write-ahead log, their content is not
+// consistent until the log is checkpointed
+func activeWALFiles(directory string, files []string) []string {
+	var active []string
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f))
+		if ext != ".gpkg" && ext != ".sqlite" && ext != ".db" {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(directory, filepath.FromSlash(f)) + "-wal")
+		if err == nil && info.Size() > 0 {
+			active = append(active, f)
+		}
+	}
+	return active
+}
+
+// Uploads modified files of the project after changes settle, until the context is cancelled
+func (c *Client) runAutoSync(ctx context.Context, directory string, params autoSyncParams) {
+	debounce := defaultAutoSyncDebounce
+	if params.Debounce > 0 {
+		debounce = time.Duration(params.Debounce * float64(time.Second))
+	}
+	changes := make(chan projectChanges)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.watchDir(ctx, filepath.FromSlash(directory), func(ch projectChanges) error {
+			select {
+			case changes <- ch:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			<-done
+			return
+		case err := <-done:
+			timer.Stop()
+			if err != nil {
+				log.Printf("Auto-sync: watching of project directory failed: %s\n", err)
+			}
+			return
+		case ch := <-changes:
+			for _, f := range append(ch.Added, ch.Modified...) {
+				pending[f] = true
+			}
+			// deletions are not propagated to the server
+			for _, f := range ch.Removed {
+				delete(pending, f)
+			}
+			if len(pending) > 0 {
+				timer.Stop()
+				timer.Reset(debounce)
+			}
+		case <-timer.C:
+			files := make([]string, 0, len(pending))
+			for f := range pending {
+				files = append(files, f)
+			}
+			sort.Strings(files)
+			switch {
+			case params.QuietHours.contains(time.Now()):
+				timer.Reset(autoSyncRetryInterval)
+				continue
+			case c.userOperationRunning():
+				if c.Debug {
+					log.Println("Auto-sync: postponed, another operation is running")
+				}
+				timer.Reset(autoSyncRetryInterval)
+				continue
+			}
+			if active := activeWALFiles(filepath.FromSlash(directory), files); len(active) > 0 {
+				if c.Debug {
+					log.Printf("Auto-sync: postponed, active WAL of %s\n", strings.Join(active, ", "))
+				}
+				timer.Reset(autoSyncRetryInterval)
+				continue
+			}
+			if err := c.autoSyncUpload(ctx, directory, params.Project, files); err != nil {
+				if ctx.Err() != nil || errors.Is(err, errAutoSyncAborted) {
+					continue
+				}
+				if errors.Is(err, errAutoSyncBusy) || errors.Is(err, errAutoSyncPreempted) {
+					if c.Debug {
+						log.Printf("Auto-sync: postponed, %s\n", err)
+					}
+					timer.Reset(autoSyncRetryInterval)
+					continue
+				}
+				// files stay pending and are uploaded after the next change
+				log.Printf("Auto-sync: upload failed: %s\n", err)
+				c.SendErrorMessage("AutoSyncError", err.Error())
+				continue
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// Uploads given files (slash separated relative paths) which still exist. The upload is
+// registered as running upload, so it can be aborted with AbortUpload message, and it's
+// cancelled when the user starts another upload or fetch.
+func (c *Client) autoSyncUpload(ctx context.Context, directory, project string, paths []string) error {
+	dir := filepath.FromSlash(directory)
+	files := make([]FileInfo, 0, len(paths))
+	uploaded := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p))); err == nil && info.Mode().IsRegular() {
+			files = append(files, FileInfo{Path: p})
+			uploaded = append(uploaded, p)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	result := autoSyncResult{TransferSummary: newTransferSummary(len(files)), Files: uploaded}
+	progress := func(p UploadProgress) {
+		result.Done, result.Bytes = p.FilesDone, p.Bytes
+		c.SendDataMessage("UploadProgress", p)
+	}
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	op := &uploadOperation{cancel: cancel, project: project, auto: true}
+	c.uploadMutex.Lock()
+	if c.upload != nil {
+		c.uploadMutex.Unlock()
+		return errAutoSyncBusy
+	}
+	c.upload = op
+	c.uploadMutex.Unlock()
+
+	err := c.uploadFiles(uploadCtx, dir, FilesParam{Project: project, Files: files}, nil, progress)
+	c.uploadMutex.Lock()
+	if c.upload == op {
+		c.upload = nil
+	}
+	preempted := op.preempted
+	c.uploadMutex.Unlock()
+	if err != nil && ctx.Err() == nil && uploadCtx.Err() != nil {
+		if preempted {
+			// AbortUpload notifies the server about aborted upload, pre-emption doesn't
+			c.SendDataMessage("UploadAborted", UploadAborted{Project: project})
+			return errAutoSyncPreempted
+		}
+		return errAutoSyncAborted
+	}
+	if err != nil {
+		return err
+	}
+	result.finish()
+	return c.SendDataMessage("AutoSyncFinished", result)
+}
+
+// Stops auto-sync mode, returns false when it wasn't enabled
+func (c *Client) stopAutoSync() bool {
+	c.watchMutex.Lock()
+	defer c.watchMutex.Unlock()
+	if c.stopAutoSyncFn == nil {
+		return false
+	}
+	c.stopAutoSyncFn()
+	c.stopAutoSyncFn = nil
+	return true
+}
+
+// Enables or disables automatic upload of locally modified files
+func (c *Client) handleAutoSync(msg message) error {
+	var params autoSyncParams
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	if !params.Enabled {
+		c.stopAutoSync()
+		return c.SendDataResponse(msg, map[string]bool{"enabled": false})
+	}
+	if params.Project == "" {
+		return c.SendErrorResponse(msg, "Project name is required")
+	}
+	if params.QuietHours != nil {
+		if err := params.QuietHours.validate(); err != nil {
+			return c.SendErrorResponse(msg, "Invalid quiet hours: "+err.Error())
+		}
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return c.SendErrorResponse(msg, "Failed to get project directory: "+err.Error())
+	}
+	ctx, cancel := context.WithCancel(c.connectionContext())
+	c.watchMutex.Lock()
+	if c.stopAutoSyncFn != nil {
+		c.stopAutoSyncFn()
+	}
+	c.stopAutoSyncFn = cancel
+	c.watchMutex.Unlock()
+	go c.runAutoSync(ctx, directory, params)
+	return c.SendDataResponse(msg, map[string]interface{}{"enabled": true, "directory": directory})
+}
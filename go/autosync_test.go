@@ -0,0 +1,67 @@
+package gisquick
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Auto-sync upload is registered as running upload and cancelled when the user starts
+// another operation
+func TestAutoSyncUploadPreempted(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// server doesn't respond until the request is cancelled or the test ends
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer srv.Close()
+	defer close(stop)
+	c := NewClient(srv.URL, "user", "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"data.csv": "data"})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.autoSyncUpload(context.Background(), dir, "user/project", []string{"data.csv"})
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.uploadMutex.Lock()
+		running := c.upload != nil
+		c.uploadMutex.Unlock()
+		if running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("auto-sync upload was not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.userOperationRunning() {
+		t.Error("auto-sync upload is reported as user operation")
+	}
+	if err := c.autoSyncUpload(context.Background(), dir, "user/project", []string{"data.csv"}); !errors.Is(err, errAutoSyncBusy) {
+		t.Errorf("expected concurrent auto-sync upload to be postponed, got %v", err)
+	}
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.startUserUpload(&uploadOperation{cancel: cancel, project: "user/project"})
+	select {
+	case err := <-done:
+		if !errors.Is(err, errAutoSyncPreempted) {
+			t.Errorf("expected pre-empted upload, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("auto-sync upload was not cancelled")
+	}
+	if !c.userOperationRunning() {
+		t.Error("user upload is not registered")
+	}
+}
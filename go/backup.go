@@ -0,0 +1,199 @@
+package gisquick
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Directories (relative to the project directory) storing backups of files overwritten
+// by fetch and files deleted into trash. Every backup/trash entry is stored in a
+// subdirectory named by its ID (timestamp) with preserved relative paths of files.
+var (
+	backupsDir = filepath.Join(".gisquick", "backup")
+	trashDir   = filepath.Join(".gisquick", "trash")
+)
+
+// IDs include microseconds, so operations started within the same second don't share
+// the entry. Timestamps of IDs are parsed with storeIDTimeFormat, which also accepts IDs
+// created without the fractional part.
+const (
+	storeIDFormat     = "20060102-150405.000000"
+	storeIDTimeFormat = "20060102-150405"
+)
+
+type storeEntry struct {
+	ID    string   `json:"id"`
+	Files []string `json:"files"`
+	Size  int64    `json:"size"`
+}
+
+type restoreParams struct {
+	ID    string   `json:"id"`
+	Files []string `json:"files,omitempty"`
+}
+
+var (
+	storeIDMutex sync.Mutex
+	lastStoreID  time.Time
+)
+
+// Returns new unique ID of the store entry
+func newStoreID() string {
+	storeIDMutex.Lock()
+	defer storeIDMutex.Unlock()
+	now := time.Now().Truncate(time.Microsecond)
+	if !now.After(lastStoreID) {
+		now = lastStoreID.Add(time.Microsecond)
+	}
+	lastStoreID = now
+	return now.Format(storeIDFormat)
+}
+
+// Moves existing project file (or directory) into the store directory under given ID
+func moveToStore(projectDir, storeDir, id, relPath string) error {
+	srcPath := filepath.Join(projectDir, filepath.FromSlash(relPath))
+	if _, err := os.Lstat(srcPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	destPath := filepath.Join(projectDir, storeDir, id, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(destPath), 0777); err != nil {
+		return err
+	}
+	return os.Rename(srcPath, destPath)
+}
+
+// Lists entries of the store directory, sorted from the newest one
+func listStore(projectDir, storeDir string) ([]storeEntry, error) {
+	root := filepath.Join(projectDir, storeDir)
+	dirEntries, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []storeEntry{}, nil
+		}
+		return nil, err
+	}
+	entries := []storeEntry{}
+	for _, e := range dirEntries {
+		if !e.IsDir() {
+			continue
+		}
+		entry := storeEntry{ID: e.Name(), Files: []string{}}
+		dir := filepath.Join(root, e.Name())
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				relPath, _ := filepath.Rel(dir, path)
+				entry.Files = append(entry.Files, filepath.ToSlash(relPath))
+				if info, err := d.Info(); err == nil {
+					entry.Size += info.Size()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+	return entries, nil
+}
+
+// Removes old entries of the store directory, keeps only given number of the newest ones
+func pruneStore(projectDir, storeDir string, keep int) error {
+	entries, err := listStore(projectDir, storeDir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(entries); i++ {
+		if err := os.RemoveAll(filepath.Join(projectDir, storeDir, entries[i].ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves files from the store entry back into the project directory (all files when no files
+// are specified). Returns paths of files which couldn't be restored.
+func (c *Client) restoreFromStore(projectDir, storeDir string, params restoreParams) ([]string, error) {
+	entryDir, err := resolveProjectPath(filepath.Join(projectDir, storeDir), params.ID)
+	if err != nil || params.ID == "" {
+		return nil, fmt.Errorf("invalid ID: %s", params.ID)
+	}
+	files := params.Files
+	if len(files) == 0 {
+		entries, err := listStore(projectDir, storeDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.ID == params.ID {
+				files = e.Files
+			}
+		}
+	}
+	var errPaths []string
+	for _, relPath := range files {
+		srcPath, err := resolveProjectPath(entryDir, relPath)
+		if err != nil {
+			errPaths = append(errPaths, relPath)
+			continue
+		}
+		destPath, err := resolveProjectPath(projectDir, relPath)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(destPath), 0777)
+		}
+		if err == nil {
+			err = replaceFile(srcPath, destPath)
+		}
+		if err != nil {
+			errPaths = append(errPaths, relPath)
+			continue
+		}
+		c.invalidateChecksums(destPath)
+	}
+	if len(errPaths) == 0 && len(params.Files) == 0 {
+		os.RemoveAll(entryDir)
+	}
+	return errPaths, nil
+}
+
+func (c *Client) handleListBackups(msg message) error {
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	backups, err := listStore(filepath.FromSlash(directory), backupsDir)
+	if err != nil {
+		return fmt.Errorf("listing backups: %w", err)
+	}
+	return c.SendDataResponse(msg, backups)
+}
+
+func (c *Client) handleRestoreBackup(msg message) error {
+	var params restoreParams
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	errPaths, err := c.restoreFromStore(filepath.FromSlash(directory), backupsDir, params)
+	if err != nil {
+		return fmt.Errorf("restoring backup: %w", err)
+	}
+	if len(errPaths) > 0 {
+		return c.SendErrorResponse(msg, errPaths)
+	}
+	return c.SendDataResponse(msg, nil)
+}
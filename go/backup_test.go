@@ -0,0 +1,46 @@
+package gisquick
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewStoreIDUnique(t *testing.T) {
+	ids := make(map[string]bool)
+	prev := ""
+	for i := 0; i < 1000; i++ {
+		id := newStoreID()
+		if ids[id] {
+			t.Fatalf("duplicate store ID %s", id)
+		}
+		if id <= prev {
+			t.Fatalf("store ID %s is not sorted after %s", id, prev)
+		}
+		ids[id] = true
+		prev = id
+	}
+}
+
+// Trash entries with IDs of both formats expire
+func TestCleanupTrashExpired(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	oldIDs := []string{old.Format(storeIDTimeFormat), old.Format(storeIDFormat)}
+	for _, id := range append(oldIDs, newStoreID()) {
+		writeFiles(t, dir, map[string]string{filepath.ToSlash(filepath.Join(trashDir, id, "a.csv")): "a"})
+	}
+	c := NewClient("http://localhost", "user", "")
+	c.TrashMaxAge = 24 * time.Hour
+	if err := c.cleanupTrash(dir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, trashDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the new trash entry, got %d entries", len(entries))
+	}
+}
@@ -1,12 +1,15 @@
 package gisquick
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
@@ -15,13 +18,15 @@ import (
 	"net/textproto"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -32,19 +37,168 @@ type Client struct {
 	User              string
 	Password          string
 	ClientInfo        string
-	httpClient        *http.Client
-	wsConn            *websocket.Conn
-	wsMutex           sync.Mutex
-	interrupt         chan int
-	checksumCache     map[string]FileInfo
 	OnMessageCallback func([]byte) string
-	messageHandlers   map[string]messageHandler
-	cancelUpload      context.CancelFunc
-	dbhashCmd         string
+	// API token, used for authentication instead of user credentials when set
+	Token string
+	// Client certificate and private key for mutual TLS, given as paths of PEM files
+	// or as PEM encoded data
+	ClientCertFile string
+	ClientKeyFile  string
+	ClientCertPEM  []byte
+	ClientKeyPEM   []byte
+	// SHA-256 fingerprint (hex) of the server's certificate. When set, only this certificate
+	// is accepted instead of verification against system trust store.
+	PinnedCertSHA256 string
+	// Server version and supported features, received in PluginStatus message
+	ServerCapabilities ServerCapabilities
+	// Download of a file is aborted when no data are received for this duration
+	FetchIdleTimeout time.Duration
+	// Maximal duration of a single file download (no limit when zero)
+	FetchTimeout time.Duration
+	// Permissions of directories created by fetch (before applying umask)
+	DirMode os.FileMode
+	// Number of kept backups of files overwritten by fetch
+	BackupRetention int
+	// Compression of WebSocket messages (permessage-deflate), can be disabled when some
+	// proxy mishandles compressed frames
+	EnableCompression bool
+	// Deleted files are moved into the project trash directory instead of permanent removal
+	SoftDelete bool
+	// Trash entries older than this duration are removed (no limit when zero)
+	TrashMaxAge time.Duration
+	// Maximal total size of trashed files in bytes (no limit when zero)
+	TrashMaxSize int64
+	// Maximal duration of waiting for response of the request sent to the server or plugin
+	RequestTimeout time.Duration
+	// Maximal number of message handlers running concurrently, reading of next messages is
+	// blocked when all of them are busy
+	MaxConcurrentHandlers int
+	// Maximal size of a received WebSocket message in bytes, connection is closed when
+	// it's exceeded
+	MaxMessageSize int64
+	// Size of the queue of outgoing messages
+	SendQueueSize int
+	// When enabled, sending of a message fails with ErrSendQueueFull instead of blocking
+	// when the queue of outgoing messages is full. Sending then doesn't wait for the write,
+	// so write errors are not reported to the caller.
+	SendNonBlocking bool
+	// Maximal size of a file written with WriteFileContent message
+	MaxWriteFileSize int64
+	// Limits of the project directory scan of ProjectFiles request (number of files and their
+	// total size in bytes), the scan is aborted when exceeded. Zero means no limit. Other
+	// listings (ListDir, sync, auto-sync) are not limited.
+	MaxScanFiles int
+	MaxScanSize  int64
+	// Sizes of worker pools of file operations
+	Concurrency Concurrency
+	// Deprecated: use Concurrency.Hash. When greater than zero, it overrides Concurrency.Hash.
+	ChecksumWorkers int
+	// Enables verbose logging
+	Debug bool
+	// Re-establishes the connection when it's lost
+	AutoReconnect bool
+	// Maximal number of consecutive reconnection attempts (unlimited when zero)
+	MaxReconnectAttempts int
+	// Delay before the first reconnection attempt, doubled with each next attempt
+	ReconnectBaseDelay time.Duration
+	// Upper limit of the delay between reconnection attempts
+	MaxReconnectDelay time.Duration
+	// Random variation of the reconnection delay as a fraction of it (e.g. 0.2 for ±20%)
+	ReconnectJitter float64
+	// Called when connection state changes (StateConnected, StateReconnecting or
+	// StateDisconnected)
+	OnStateChange func(state string)
+	// Hash algorithm of file checksums (HashSHA1 or HashSHA256), SHA-256 is used only
+	// when supported by server
+	HashAlgorithm string
+	// Handling of symbolic links in the project directory (SymlinkSkip, SymlinkFollow
+	// or SymlinkError)
+	SymlinkPolicy string
+	// Additional ignore rules (.gitignore syntax) applied together with .gisquickignore file
+	IgnorePatterns []string
+	// Patterns of temporary files (gitignore syntax, case-insensitive), which are listed
+	// separately from project files
+	TemporaryPatterns []string
+	// Regular expression of temporary files (matched against slash separated relative
+	// paths), replaces TemporaryPatterns when set
+	ExcludePattern *regexp.Regexp
+	// Path of the external dbhash tool, it's searched in PATH and current directory when empty.
+	// Use SetDbhashPath to change it while connected.
+	DbhashPath string
+	// Files larger than this size (in bytes) are listed without checksum and compared by size
+	// and modification time (no limit when zero). Use SetMaxHashSize to change it while
+	// connected.
+	MaxHashSize int64
+
+	httpClient      *http.Client
+	tlsConfig       *tls.Config
+	wsConn          *websocket.Conn
+	connCtx         context.Context
+	connected       bool
+	connChanged     chan struct{}
+	connMutex       sync.Mutex
+	state           string
+	connectedAt     time.Time
+	lastError       string
+	sendQueue       chan outgoingMessage
+	sendStop        chan struct{}
+	interrupt       chan int
+	checksumCache   map[string]FileInfo
+	cacheMutex      sync.Mutex
+	cacheHits       uint64
+	cacheMisses     uint64
+	messageHandlers map[string]messageHandler
+	upload          *uploadOperation
+	uploadMutex     sync.Mutex
+	fetchOps        map[string]*fetchOperation
+	scans           map[string]context.CancelFunc
+	fetchOpsMutex   sync.Mutex
+	sweptDirs       map[string]bool
+	loadedManifests map[string]bool
+	scanSnapshots   map[string]*scanSnapshot
+	etags           map[string]*etagStore
+	syncStates      map[string]*syncStateStore
+	pendingRequests map[string]chan message
+	pendingMutex    sync.Mutex
+	requestCounter  uint64
+	dbhashCmd       string
+	toolsMutex      sync.Mutex
+	stopWatch       context.CancelFunc
+	watchCtx        context.Context
+	watchedDir      string
+	watchMutex      sync.Mutex
+	stopAutoSyncFn  context.CancelFunc
+	projectLocks    map[*projectLock]struct{}
+	locksMutex      sync.Mutex
+	configMutex     sync.Mutex
+	// patterns of temporary files received in Configure message
+	serverTempPatterns []string
+	// last project directory announced by the plugin
+	projectDir string
+	// number of running plugin callbacks, including callbacks which timed out
+	pluginCalls int32
+	// data sources parsed from project files (guarded by cacheMutex)
+	projectSources map[string]cachedProjectSources
 }
 
 var (
 	ErrConnectionNotEstablished = errors.New("WS Connection is not established")
+	ErrPathOutsideProject       = errors.New("path is outside of the project directory")
+	ErrFetchConflict            = errors.New("local file was modified")
+	ErrDeleteConflict           = errors.New("file doesn't match expected checksum")
+	ErrFileLocked               = errors.New("file is locked by another application")
+	ErrDownloadStalled          = errors.New("download stalled")
+	ErrDownloadTimeout          = errors.New("download timed out")
+	ErrDownloadIncomplete       = errors.New("download is incomplete")
+	ErrNotModified              = errors.New("file was not modified on the server")
+	ErrServerResponse           = errors.New("server error")
+	ErrRequestTimeout           = errors.New("request timed out")
+	ErrSendQueueFull            = errors.New("queue of outgoing messages is full")
+	ErrFileTooLarge             = errors.New("file is too large")
+	ErrBinaryFile               = errors.New("file is not a text file")
+	ErrReconnectFailed          = errors.New("reconnection attempts exhausted")
+	ErrCaseConflict             = errors.New("file paths differ only in letter case")
+	ErrPluginBusy               = errors.New("plugin is not responding to previous requests")
 )
 
 type messageHandler func(msg message) error
@@ -70,40 +224,291 @@ type genericResponse struct {
 }
 
 type pluginStatusPayload struct {
-	Client        string `json:"client"`
-	DbhashSupport bool   `json:"dbhash"`
+	Client        string   `json:"client"`
+	DbhashSupport bool     `json:"dbhash"`
+	DbhashImpl    string   `json:"dbhash_impl"`
+	Capabilities  []string `json:"capabilities"`
+	HashAlgorithm string   `json:"hash_algorithm"`
+	MaxHashSize   int64    `json:"max_hash_size,omitempty"`
+}
+
+// Server version and optional features announced by server. Older servers don't send
+// any information, so no optional features are assumed in that case.
+type ServerCapabilities struct {
+	Version  string   `json:"version"`
+	Features []string `json:"capabilities"`
+}
+
+// Reports whether server supports given feature
+func (s ServerCapabilities) Supports(feature string) bool {
+	for _, f := range s.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether connected server supports given feature
+func (c *Client) serverSupports(feature string) bool {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	return c.ServerCapabilities.Supports(feature)
+}
+
+// Optional features supported by this client
+var pluginCapabilities = []string{
+	"abort_fetch",
+	"rename_files",
+	"move_files",
+	"atomic_fetch",
+	"archive_fetch",
+	"fetch_backup",
+	"sha256",
+	"trash",
+	"qgz_hash",
+	"project_diff",
+	"sync_project",
+	"auto_sync",
+	"project_lock",
+}
+
+// Number of workers of parallel file operations. Every worker reading or writing files uses
+// its own copy buffer (see SetCopyBufferSize), hashing of a GeoPackage/SQLite file also holds
+// its database pages in memory, so memory usage grows with the number of workers times the
+// buffer size. Values lower than 1 are treated as 1.
+type Concurrency struct {
+	// Number of files hashed in parallel when listing project files
+	Hash int
+	// Number of files hashed in parallel before upload (files are then sent in a single request)
+	Upload int
+	// Number of files downloaded in parallel, reserved for parallel downloads (FetchFiles
+	// currently downloads files one by one)
+	Fetch int
+	// Number of files deleted in parallel
+	Delete int
+}
+
+// Returns default pool sizes derived from the number of CPUs
+func DefaultConcurrency() Concurrency {
+	cpus := runtime.NumCPU()
+	if cpus > 4 {
+		cpus = 4
+	}
+	return Concurrency{Hash: cpus, Upload: cpus, Fetch: 4, Delete: 8}
+}
+
+func (n Concurrency) validate() error {
+	names := []string{"hash", "upload", "fetch", "delete"}
+	for i, value := range []int{n.Hash, n.Upload, n.Fetch, n.Delete} {
+		if value < 1 {
+			return fmt.Errorf("invalid %s concurrency: %d", names[i], value)
+		}
+	}
+	return nil
+}
+
+// Returns number of workers hashing project files
+func (c *Client) hashWorkers() int {
+	if c.ChecksumWorkers > 0 {
+		return c.ChecksumWorkers
+	}
+	return c.Concurrency.Hash
+}
+
+// Returns number of workers for given number of jobs
+func poolSize(workers, jobs int) int {
+	if workers > jobs {
+		workers = jobs
+	}
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
+
+// Returns context which is canceled when the websocket connection is closed
+func (c *Client) connectionContext() context.Context {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	if c.connCtx == nil {
+		return context.Background()
+	}
+	return c.connCtx
+}
+
+// Updates connection state and wakes up goroutines waiting for its change
+func (c *Client) setConnected(connected bool) {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	c.connected = connected
+	if connected {
+		c.connectedAt = time.Now()
+	}
+	if c.connChanged != nil {
+		close(c.connChanged)
+	}
+	c.connChanged = make(chan struct{})
+}
+
+// Reports whether the websocket connection is established
+func (c *Client) IsConnected() bool {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.connected
+}
+
+// Blocks until the websocket connection is established or the context is done
+func (c *Client) WaitConnected(ctx context.Context) error {
+	for {
+		c.connMutex.Lock()
+		if c.connected {
+			c.connMutex.Unlock()
+			return nil
+		}
+		if c.connChanged == nil {
+			c.connChanged = make(chan struct{})
+		}
+		changed := c.connChanged
+		c.connMutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
 }
 
 // Creates a new Gisquick plugin client
 func NewClient(url, user, password string) *Client {
 	cookieJar, _ := cookiejar.New(nil)
 	c := Client{
-		Server:        url,
-		User:          user,
-		Password:      password,
-		checksumCache: make(map[string]FileInfo),
-		httpClient:    &http.Client{Jar: cookieJar},
+		Server:                url,
+		User:                  user,
+		Password:              password,
+		FetchIdleTimeout:      30 * time.Second,
+		DirMode:               0777,
+		BackupRetention:       5,
+		EnableCompression:     true,
+		SoftDelete:            true,
+		TrashMaxAge:           30 * 24 * time.Hour,
+		TrashMaxSize:          1 << 30,
+		RequestTimeout:        30 * time.Second,
+		MaxConcurrentHandlers: 8,
+		SendQueueSize:         64,
+		MaxMessageSize:        16 << 20,
+		MaxWriteFileSize:      maxFileContentSize,
+		MaxHashSize:           1 << 30,
+		MaxScanFiles:          100000,
+		MaxScanSize:           100 << 30,
+		ReconnectBaseDelay:    time.Second,
+		MaxReconnectDelay:     30 * time.Second,
+		ReconnectJitter:       0.2,
+		Concurrency:           DefaultConcurrency(),
+		SymlinkPolicy:         SymlinkSkip,
+		TemporaryPatterns:     append([]string{}, DefaultTemporaryPatterns...),
+		HashAlgorithm:         HashSHA1,
+		checksumCache:         make(map[string]FileInfo),
+		projectSources:        make(map[string]cachedProjectSources),
+		fetchOps:              make(map[string]*fetchOperation),
+		scans:                 make(map[string]context.CancelFunc),
+		sweptDirs:             make(map[string]bool),
+		loadedManifests:       make(map[string]bool),
+		scanSnapshots:         make(map[string]*scanSnapshot),
+		etags:                 make(map[string]*etagStore),
+		syncStates:            make(map[string]*syncStateStore),
+		projectLocks:          make(map[*projectLock]struct{}),
+		pendingRequests:       make(map[string]chan message),
+		interrupt:             make(chan int, 1),
+		httpClient:            &http.Client{Jar: cookieJar},
 	}
+	c.httpClient.Transport = &authTransport{base: http.DefaultTransport, client: &c}
 	c.registerHandlers()
 	return &c
 }
 
+type outgoingMessage struct {
+	msgType int
+	data    []byte
+	// receives result of the write (buffered, the writer never blocks on it)
+	result chan error
+}
+
+// Starts goroutine writing queued messages into the websocket connection, returns function
+// which stops it. Messages still queued when the writer is stopped are not sent.
+func (c *Client) startWriter(wsConn *websocket.Conn) func() {
+	queue := make(chan outgoingMessage, c.SendQueueSize)
+	stop := make(chan struct{})
+	c.connMutex.Lock()
+	c.sendQueue = queue
+	c.sendStop = stop
+	c.connMutex.Unlock()
+	go func() {
+		for {
+			select {
+			case msg := <-queue:
+				err := wsConn.WriteMessage(msg.msgType, msg.data)
+				if err != nil {
+					log.Println("WS write error:", err)
+				}
+				msg.result <- err
+			case <-stop:
+				if n := len(queue); n > 0 {
+					log.Printf("Connection closed, %d queued messages were not sent\n", n)
+				}
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Sends message with the writer goroutine and waits until it's written, so write errors
+// are returned to the caller. In non-blocking mode (SendNonBlocking), the function returns
+// as soon as the message is queued and write errors are only logged.
 func (c *Client) SendRawMessage(msgType int, data []byte) error {
-	if c.wsConn == nil {
+	c.connMutex.Lock()
+	queue, stop := c.sendQueue, c.sendStop
+	c.connMutex.Unlock()
+	if queue == nil {
+		return ErrConnectionNotEstablished
+	}
+	msg := outgoingMessage{msgType: msgType, data: data, result: make(chan error, 1)}
+	if c.SendNonBlocking {
+		select {
+		case queue <- msg:
+			return nil
+		case <-stop:
+			return ErrConnectionNotEstablished
+		default:
+			return ErrSendQueueFull
+		}
+	}
+	select {
+	case queue <- msg:
+	case <-stop:
 		return ErrConnectionNotEstablished
 	}
-	c.wsMutex.Lock()
-	defer c.wsMutex.Unlock()
-	return c.wsConn.WriteMessage(msgType, data)
+	select {
+	case err := <-msg.result:
+		return err
+	case <-stop:
+		// the writer was stopped before it got to the message
+		select {
+		case err := <-msg.result:
+			return err
+		default:
+			return ErrConnectionNotEstablished
+		}
+	}
 }
 
 func (c *Client) SendJsonMessage(data interface{}) error {
-	if c.wsConn == nil {
-		return ErrConnectionNotEstablished
+	msg, err := json.Marshal(data)
+	if err != nil {
+		return err
 	}
-	c.wsMutex.Lock()
-	defer c.wsMutex.Unlock()
-	return c.wsConn.WriteJSON(data)
+	return c.SendRawMessage(websocket.TextMessage, msg)
 }
 
 // sends message with status code 200 ("ok")
@@ -124,13 +529,107 @@ func (c *Client) SendErrorResponse(req message, data interface{}) error {
 	return c.SendJsonMessage(genericResponse{Type: req.Type, ID: req.ID, Status: 500, Data: data})
 }
 
+// sends error response for the error returned from message handler
+func (c *Client) sendHandlerError(req message, err error) error {
+	status := 500
+	switch {
+	case errors.Is(err, ErrPathOutsideProject):
+		status = 403
+	case errors.Is(err, ErrFetchConflict):
+		status = 409
+	case errors.Is(err, ErrFileTooLarge):
+		status = 413
+	case errors.Is(err, ErrBinaryFile):
+		status = 415
+	}
+	return c.SendJsonMessage(genericResponse{Type: req.Type, ID: req.ID, Status: status, Data: err.Error()})
+}
+
+// Sends request message to the server and waits for the response with the same ID.
+// Fails when no response is received within RequestTimeout or the context is canceled.
+func (c *Client) SendRequest(ctx context.Context, msgType string, data interface{}) (*message, error) {
+	id := fmt.Sprintf("plugin-%d", atomic.AddUint64(&c.requestCounter, 1))
+	respChan := make(chan message, 1)
+	c.pendingMutex.Lock()
+	c.pendingRequests[id] = respChan
+	c.pendingMutex.Unlock()
+	defer func() {
+		c.pendingMutex.Lock()
+		delete(c.pendingRequests, id)
+		c.pendingMutex.Unlock()
+	}()
+
+	if err := c.SendJsonMessage(genericResponse{Type: msgType, ID: id, Data: data}); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-respChan:
+		if !ok {
+			return nil, ErrConnectionNotEstablished
+		}
+		return &msg, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s", ErrRequestTimeout, msgType)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Delivers message to the pending request with the same ID, returns false when there is
+// no such request
+func (c *Client) resolvePendingRequest(msg message) bool {
+	if msg.ID == "" {
+		return false
+	}
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	respChan, ok := c.pendingRequests[msg.ID]
+	if ok {
+		delete(c.pendingRequests, msg.ID)
+		respChan <- msg
+	}
+	return ok
+}
+
+// Fails all pending requests (used when connection is closed)
+func (c *Client) cancelPendingRequests() {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	for id, respChan := range c.pendingRequests {
+		delete(c.pendingRequests, id)
+		close(respChan)
+	}
+}
+
+// Maximal number of plugin callbacks running at once
+const maxPluginCalls = 4
+
 // send message to plugin handler and return response message
 func (c *Client) propagateMessage(msgType string, data interface{}) (*message, error) {
 	request, err := json.Marshal(genericMessage{Type: msgType, Data: data})
 	if err != nil {
 		return nil, err
 	}
-	resp := c.OnMessageCallback(request)
+	// plugin may respond asynchronously (e.g. when waiting for the main thread), don't block
+	// forever. The callback can't be interrupted, so the number of callbacks left running
+	// after timeout is limited.
+	if atomic.AddInt32(&c.pluginCalls, 1) > maxPluginCalls {
+		atomic.AddInt32(&c.pluginCalls, -1)
+		return nil, fmt.Errorf("%w: %s", ErrPluginBusy, msgType)
+	}
+	respChan := make(chan string, 1)
+	go func() {
+		defer atomic.AddInt32(&c.pluginCalls, -1)
+		respChan <- c.OnMessageCallback(request)
+	}()
+	var resp string
+	select {
+	case resp = <-respChan:
+	case <-time.After(c.RequestTimeout):
+		return nil, fmt.Errorf("%w: %s", ErrRequestTimeout, msgType)
+	}
 	if resp == "" {
 		return nil, errors.New("Empty response")
 	}
@@ -161,14 +660,70 @@ func (c *Client) registerHandlers() {
 	c.messageHandlers["ProjectFiles"] = c.handleProjectFiles
 	c.messageHandlers["AbortUpload"] = c.handleAbortUpload
 	c.messageHandlers["UploadFiles"] = c.handleUploadFiles
+	c.messageHandlers["EstimateUpload"] = c.handleEstimateUpload
 	c.messageHandlers["FetchFiles"] = c.handleFetchFiles
+	c.messageHandlers["AbortFetch"] = c.handleAbortFetch
 	c.messageHandlers["DeleteFiles"] = c.handleDeleteFiles
+	c.messageHandlers["RenameFiles"] = c.handleRenameFiles
+	c.messageHandlers["MoveFiles"] = c.handleMoveFiles
+	c.messageHandlers["FileMetadata"] = c.handleFileMetadata
+	c.messageHandlers["FileStat"] = c.handleFileMetadata
+	c.messageHandlers["DiskUsage"] = c.handleDiskUsage
+	c.messageHandlers["ListBackups"] = c.handleListBackups
+	c.messageHandlers["RestoreBackup"] = c.handleRestoreBackup
+	c.messageHandlers["ListTrash"] = c.handleListTrash
+	c.messageHandlers["EmptyTrash"] = c.handleEmptyTrash
+	c.messageHandlers["RestoreFromTrash"] = c.handleRestoreFromTrash
+	c.messageHandlers["RemoteFiles"] = c.handleRemoteFiles
+	c.messageHandlers["CreateDirectory"] = c.handleCreateDirectory
+	c.messageHandlers["GetFileContent"] = c.handleGetFileContent
+	c.messageHandlers["WriteFileContent"] = c.handleWriteFileContent
+	// "ProjectInfo" message is handled by the QGIS plugin
+	c.messageHandlers["ProjectMetadata"] = c.handleProjectMetadata
+	c.messageHandlers["ClearCache"] = c.handleClearCache
+	c.messageHandlers["AbortScan"] = c.handleAbortScan
+	c.messageHandlers["ProjectHash"] = c.handleProjectHash
+	c.messageHandlers["ProjectDiff"] = c.handleProjectDiff
+	c.messageHandlers["SyncProject"] = c.handleSyncProject
+	c.messageHandlers["AbortSync"] = c.handleAbortFetch
+	c.messageHandlers["RedetectTools"] = c.handleRedetectTools
+	c.messageHandlers["WatchProject"] = c.handleWatchProject
+	c.messageHandlers["UnwatchProject"] = c.handleUnwatchProject
+	c.messageHandlers["AutoSync"] = c.handleAutoSync
+	c.messageHandlers["Configure"] = c.handleConfigure
+}
+
+// Messages handled directly by the reader of the connection instead of a handler goroutine.
+// Their handlers only cancel running operations, so they must not wait for a free handler slot.
+var inlineMessages = map[string]bool{
+	"AbortUpload": true,
+	"AbortFetch":  true,
+	"AbortScan":   true,
+	"AbortSync":   true,
 }
 
 func (c *Client) handlePluginStatus(msg message) error {
+	var serverInfo ServerCapabilities
+	if len(msg.Data) > 0 && string(msg.Data) != "null" {
+		if err := json.Unmarshal(msg.Data, &serverInfo); err != nil {
+			log.Printf("Failed to parse server capabilities: %s\n", err)
+			serverInfo = ServerCapabilities{}
+		}
+	}
+	c.configMutex.Lock()
+	c.ServerCapabilities = serverInfo
+	c.configMutex.Unlock()
 	data := pluginStatusPayload{
 		Client:        c.ClientInfo,
-		DbhashSupport: c.dbhashCmd != "",
+		DbhashSupport: true,
+		DbhashImpl:    c.dbhashImpl(),
+		Capabilities:  pluginCapabilities,
+		HashAlgorithm: c.hashAlgorithm(),
+		MaxHashSize:   c.maxHashSize(),
+	}
+	if data.MaxHashSize > 0 {
+		// hashes of large files may be missing
+		data.Capabilities = append(append([]string{}, pluginCapabilities...), "hash_skip")
 	}
 	// data := map[string]interface{}{
 	// 	"client": c.ClientInfo,
@@ -178,6 +733,9 @@ func (c *Client) handlePluginStatus(msg message) error {
 }
 
 func (c *Client) getProjectDirectory() (string, error) {
+	if c.OnMessageCallback == nil {
+		return "", errors.New("plugin message callback is not set")
+	}
 	projDirMsg, err := c.propagateMessage("ProjectDirectory", nil)
 	if err != nil {
 		return "", fmt.Errorf("calling ProjectDirectory request: %w", err)
@@ -189,46 +747,352 @@ func (c *Client) getProjectDirectory() (string, error) {
 	if err := json.Unmarshal(projDirMsg.Data, &directory); err != nil {
 		return "", fmt.Errorf("parsing ProjectDirectory response: %w", err)
 	}
+	c.setProjectDirectory(directory)
+	return directory, nil
+}
+
+// Stores project directory confirmed by the plugin
+func (c *Client) setProjectDirectory(directory string) {
+	c.configMutex.Lock()
+	c.projectDir = directory
+	c.configMutex.Unlock()
+}
+
+func sameDirectory(a, b string) bool {
+	return filepath.Clean(filepath.FromSlash(a)) == filepath.Clean(filepath.FromSlash(b))
+}
+
+// Returns project directory for a request. Directory specified in the request is used
+// without asking the plugin when it matches the last directory announced by the plugin,
+// otherwise the project directory is requested from the plugin and it must match.
+func (c *Client) resolveProjectDirectory(requested string) (string, error) {
+	if requested != "" {
+		c.configMutex.Lock()
+		known := c.projectDir
+		c.configMutex.Unlock()
+		if known != "" && sameDirectory(known, requested) {
+			return known, nil
+		}
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return "", err
+	}
+	if requested != "" && !sameDirectory(directory, requested) {
+		return "", fmt.Errorf("requested directory is not the project directory: %s", requested)
+	}
 	return directory, nil
 }
 
+// Sends message from the plugin to the server. ProjectChanged message also updates
+// the known project directory (cleared when the message has no directory) and the watched
+// directory.
+func (c *Client) SendPluginMessage(data []byte) error {
+	var msg message
+	if err := json.Unmarshal(data, &msg); err == nil && msg.Type == "ProjectChanged" {
+		var params struct {
+			Directory string `json:"directory"`
+		}
+		if len(msg.Data) > 0 {
+			json.Unmarshal(msg.Data, &params)
+		}
+		c.setProjectDirectory(params.Directory)
+		c.projectDirectoryChanged(params.Directory)
+	}
+	return c.SendRawMessage(websocket.TextMessage, data)
+}
+
+// Error response of ProjectFiles request when the project directory exceeds scan limits
+type scanLimitResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	*ScanLimitError
+}
+
 func (c *Client) handleProjectFiles(msg message) error {
 	type filesMsg struct {
 		Directory      string     `json:"directory"`
 		Files          []FileInfo `json:"files"`
 		TemporaryFiles []FileInfo `json:"temporary,omitempty"`
+		EmptyDirs      []string   `json:"empty_dirs,omitempty"`
+		// data sources of the project layers located outside of the project directory
+		ExternalSources []string `json:"external_sources,omitempty"`
+		// data sources referenced by the project which don't exist on disk
+		MissingFiles []string `json:"missing_files,omitempty"`
+		// data sources stored with absolute paths or leading outside of the project directory
+		SourceWarnings []sourceWarning `json:"source_warnings,omitempty"`
+		// files which couldn't be read
+		Problems []fileProblem `json:"problems,omitempty"`
+		// groups of files whose paths differ only in letter case
+		CaseConflicts [][]string `json:"case_conflicts,omitempty"`
+		// parsed rules of .gisquickignore file and additional ignore patterns (gitignore
+		// semantics, the last matching rule decides, files in ignored directories can't
+		// be re-included)
+		IgnoreRules []ignoreRule `json:"ignore_rules,omitempty"`
+		// paths excluded by ignore rules (directories with trailing slash)
+		Ignored []string `json:"ignored"`
+		// files with recomputed checksum, checksums of other files were reused
+		Rehashed []string `json:"rehashed"`
+		Reused   int      `json:"reused"`
+		// token of this scan, can be used as since parameter of the next request
+		Token string `json:"token"`
+		// when true, files contain only added or modified files since the previous scan
+		Incremental bool     `json:"incremental,omitempty"`
+		Removed     []string `json:"removed,omitempty"`
+	}
+	var params struct {
+		EmptyDirs    bool `json:"empty_dirs"`
+		MissingFiles bool `json:"missing_files"`
+		// token of the previous scan
+		Since string `json:"since"`
+		// project directory announced by the plugin
+		Directory string `json:"directory"`
+		// overrides of scan limits for huge projects (zero disables the limit)
+		MaxFiles *int   `json:"max_files"`
+		MaxSize  *int64 `json:"max_size"`
+	}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &params); err != nil {
+			return err
+		}
 	}
 
-	directory, err := c.getProjectDirectory()
+	directory, err := c.resolveProjectDirectory(params.Directory)
 	if err != nil {
 		return c.SendErrorResponse(msg, "Failed to get project directory: "+err.Error())
 	}
-	files, tempFiles, err := c.ListDir(directory, true)
+	c.sweepTempFiles(filepath.FromSlash(directory))
+
+	// scan can be aborted with AbortScan message with ID of this request
+	ctx, cancel := context.WithCancel(c.connectionContext())
+	defer cancel()
+	c.fetchOpsMutex.Lock()
+	c.scans[msg.ID] = cancel
+	c.fetchOpsMutex.Unlock()
+	defer func() {
+		c.fetchOpsMutex.Lock()
+		delete(c.scans, msg.ID)
+		c.fetchOpsMutex.Unlock()
+	}()
+	progress := func(p scanProgress) {
+		p.File = filepath.ToSlash(p.File)
+		c.SendJsonMessage(genericResponse{Type: "ScanProgress", ID: msg.ID, Status: 200, Data: p})
+	}
+	if _, err := c.loadManifest(directory); err != nil {
+		log.Printf("Failed to load manifest: %s\n", err)
+	}
+	ignored := []string{}
+	collectIgnored := func(path string) {
+		ignored = append(ignored, normalizePath(filepath.ToSlash(path)))
+	}
+	limits := c.scanLimits()
+	if params.MaxFiles != nil {
+		limits.MaxFiles = *params.MaxFiles
+	}
+	if params.MaxSize != nil {
+		limits.MaxSize = *params.MaxSize
+	}
+	files, tempFiles, problems, err := c.listDir(ctx, directory, true, limits, progress, collectIgnored)
 
+	var limitErr *ScanLimitError
+	if errors.As(err, &limitErr) {
+		return c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: 413, Data: scanLimitResponse{
+			Error:          limitErr.Error(),
+			Reason:         "scan_limit",
+			ScanLimitError: limitErr,
+		}})
+	}
 	if err != nil {
 		return err
 	}
+	if err := c.saveManifest(directory, files); err != nil {
+		log.Printf("Failed to save manifest: %s\n", err)
+	}
+	rehashed := []string{}
 	for i, f := range files {
 		files[i].Path = filepath.ToSlash(f.Path)
+		if f.rehashed {
+			rehashed = append(rehashed, normalizePath(files[i].Path))
+		}
 	}
 	for i, f := range tempFiles {
 		tempFiles[i].Path = filepath.ToSlash(f.Path)
 	}
-	data := filesMsg{Directory: directory, Files: files, TemporaryFiles: tempFiles}
+	for i, p := range problems {
+		problems[i].Path = filepath.ToSlash(p.Path)
+	}
+	data := filesMsg{Directory: directory, Files: files, TemporaryFiles: tempFiles, Problems: problems}
+	data.Rehashed = rehashed
+	data.Ignored = ignored
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	if conflicts := findCaseCollisions(paths); len(conflicts) > 0 {
+		data.CaseConflicts = conflicts
+	}
+	if rules, err := loadIgnoreRules(filepath.FromSlash(directory), c.IgnorePatterns); err == nil {
+		data.IgnoreRules = rules.rules
+	}
+	data.Reused = len(files) - len(rehashed)
+	sourcesCheck := c.checkProjectSources(filepath.FromSlash(directory), files)
+	data.ExternalSources = sourcesCheck.External
+	data.SourceWarnings = sourcesCheck.Warnings
+	if params.MissingFiles {
+		data.MissingFiles = sourcesCheck.Missing
+	}
+	if params.EmptyDirs {
+		if data.EmptyDirs, err = ListEmptyDirs(directory, c.IgnorePatterns...); err != nil {
+			return err
+		}
+		for i, d := range data.EmptyDirs {
+			data.EmptyDirs[i] = filepath.ToSlash(d)
+		}
+	}
+	for i := range files {
+		files[i].Path = normalizePath(files[i].Path)
+	}
+	for i := range tempFiles {
+		tempFiles[i].Path = normalizePath(tempFiles[i].Path)
+	}
+	for i := range problems {
+		problems[i].Path = normalizePath(problems[i].Path)
+	}
+	// only changes are sent when the previous scan of the same directory is known,
+	// full listing otherwise
+	if diff, ok := c.diffSnapshot(directory, params.Since, files); ok {
+		data.Incremental = true
+		data.Files = diff.Changed
+		data.Removed = diff.Removed
+	}
+	data.Token = c.storeSnapshot(directory, files)
 	return c.SendDataResponse(msg, data)
 }
 
+type uploadOperation struct {
+	cancel  context.CancelFunc
+	project string
+	// upload started by auto-sync, cancelled when the user starts another operation
+	auto      bool
+	preempted bool
+}
+
+// Registers upload operation started by the user, running auto-sync upload is cancelled
+func (c *Client) startUserUpload(op *uploadOperation) {
+	c.uploadMutex.Lock()
+	defer c.uploadMutex.Unlock()
+	c.preemptAutoSyncLocked()
+	c.upload = op
+}
+
+// Cancels running auto-sync upload, so it doesn't run concurrently with an operation
+// started by the user
+func (c *Client) preemptAutoSync() {
+	c.uploadMutex.Lock()
+	defer c.uploadMutex.Unlock()
+	c.preemptAutoSyncLocked()
+}
+
+func (c *Client) preemptAutoSyncLocked() {
+	if c.upload != nil && c.upload.auto {
+		c.upload.preempted = true
+		c.upload.cancel()
+		c.upload = nil
+	}
+}
+
+func (c *Client) handleAbortScan(msg message) error {
+	var params struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	c.fetchOpsMutex.Lock()
+	cancel, ok := c.scans[params.ID]
+	c.fetchOpsMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("scan not found: %s", params.ID)
+	}
+	cancel()
+	return c.SendDataResponse(msg, nil)
+}
+
+func (c *Client) handleClearCache(msg message) error {
+	c.ClearCache()
+	return c.SendDataResponse(msg, nil)
+}
+
+// Runtime configuration options changeable with Configure message
+type runtimeConfig struct {
+	MaxHashSize *int64 `json:"max_hash_size,omitempty"`
+	// additional patterns of temporary files, replacing previously received patterns
+	TemporaryPatterns []string `json:"temporary_patterns,omitempty"`
+}
+
+func (c *Client) handleConfigure(msg message) error {
+	var params runtimeConfig
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	if params.MaxHashSize != nil {
+		if *params.MaxHashSize < 0 {
+			return c.SendErrorResponse(msg, "Invalid max_hash_size value")
+		}
+		c.SetMaxHashSize(*params.MaxHashSize)
+	}
+	if params.TemporaryPatterns != nil {
+		if _, err := compileTemporaryPatterns(params.TemporaryPatterns); err != nil {
+			return c.SendErrorResponse(msg, "Invalid temporary_patterns value: "+err.Error())
+		}
+		c.configMutex.Lock()
+		c.serverTempPatterns = params.TemporaryPatterns
+		c.configMutex.Unlock()
+	}
+	maxHashSize := c.maxHashSize()
+	c.configMutex.Lock()
+	tempPatterns := append([]string{}, c.serverTempPatterns...)
+	c.configMutex.Unlock()
+	return c.SendDataResponse(msg, runtimeConfig{MaxHashSize: &maxHashSize, TemporaryPatterns: tempPatterns})
+}
+
+// Cancels running upload and notifies the server with UploadAborted message, so it can
+// clean up partially received data
 func (c *Client) handleAbortUpload(msg message) error {
-	if c.cancelUpload != nil {
-		c.cancelUpload()
-		c.cancelUpload = nil
+	c.uploadMutex.Lock()
+	op := c.upload
+	c.upload = nil
+	c.uploadMutex.Unlock()
+	if op == nil {
+		return nil
 	}
-	return nil
+	op.cancel()
+	return c.SendDataMessage("UploadAborted", UploadAborted{Project: op.project})
 }
 
 type FilesParam struct {
 	Project string     `json:"project"`
 	Files   []FileInfo `json:"files"`
+	// project directory announced by the plugin, saves request for the directory
+	Directory string `json:"directory,omitempty"`
+	// version of the server project, recorded in the sync state after transfer
+	Version string `json:"version,omitempty"`
+	// upload option - take over (stale) lock of the project held by another client
+	ForceLock bool `json:"force_lock,omitempty"`
+	// fetch options
+	Force        bool `json:"force,omitempty"`
+	KeepOriginal bool `json:"keep_original,omitempty"`
+	Atomic       bool `json:"atomic,omitempty"`
+	// move overwritten files into the backup directory
+	Backup bool `json:"backup,omitempty"`
+	// download whole project as a single zip archive (when supported by server)
+	Archive bool `json:"archive,omitempty"`
+	// check that there is enough free disk space before downloading files
+	CheckSpace bool `json:"check_space,omitempty"`
+	// mirror mode - local files not listed in ServerFiles are removed after fetch
+	Prune       bool     `json:"prune,omitempty"`
+	PruneDryRun bool     `json:"prune_dry_run,omitempty"`
+	ServerFiles []string `json:"server_files,omitempty"`
 }
 
 func (c *Client) handleUploadFiles(msg message) error {
@@ -237,244 +1101,1630 @@ func (c *Client) handleUploadFiles(msg message) error {
 		return err
 	}
 
-	directory, err := c.getProjectDirectory()
+	directory, err := c.resolveProjectDirectory(params.Directory)
 	if err != nil {
 		return c.SendErrorResponse(msg, "Failed to get project directory: "+err.Error())
 	}
 
-	go func() {
-		readBody, writeBody := io.Pipe()
-		defer readBody.Close()
-
-		writer := multipart.NewWriter(writeBody)
-		errChan := make(chan error, 1)
-
-		go func() {
-			compressRegex := regexp.MustCompile("(?i).*\\.(qgs|xml|csv|svg|tif|shp|dbf|json|sqlite|gpkg|geojson)$")
-			defer writeBody.Close()
-
-			changesUpdated := false
-			for i, f := range params.Files {
-				if f.Mtime == 0 {
-					p := filepath.Join(directory, f.Path)
-					finfo, err := os.Stat(p)
-					if err != nil {
-						errChan <- err
-						return
-					}
-					params.Files[i].Mtime = finfo.ModTime().Unix()
-					params.Files[i].Size = finfo.Size()
-					if f.Hash == "" {
-						hash, err := c.Checksum(p)
-						if err != nil {
-							errChan <- err
-							return
-						}
-						params.Files[i].Hash = hash
-					}
-					changesUpdated = true
-				}
-			}
-			if changesUpdated {
-				data, err := json.Marshal(params)
-				if err != nil {
-					errChan <- err
-					return
-				}
-				writer.WriteField("changes", string(data))
-			} else {
-				writer.WriteField("changes", string(msg.Data))
-			}
-
-			for _, f := range params.Files {
-				// ext := filepath.Ext(f.Path)
-				fileOsPath := filepath.FromSlash(f.Path)
-				useCompression := compressRegex.Match([]byte(f.Path))
-				if useCompression {
-					mh := make(textproto.MIMEHeader)
-					mh.Set("Content-Type", "application/octet-stream")
-					mh.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s.gz"`, f.Path, f.Path))
-					part, _ := writer.CreatePart(mh)
-					gzpart := gzip.NewWriter(part)
-					err := CopyFile(gzpart, filepath.Join(directory, fileOsPath))
-					gzpart.Close()
-					if err != nil {
-						errChan <- err
-						return
-					}
-				} else {
-					part, err := writer.CreateFormFile(f.Path, f.Path)
-					if err != nil {
-						errChan <- err
-						return
-					}
-					if err = CopyFile(part, filepath.Join(directory, fileOsPath)); err != nil {
-						errChan <- err
-						return
-					}
-				}
-			}
-			errChan <- writer.Close()
-		}()
-
-		url := fmt.Sprintf("%s/api/project/upload/%s", c.Server, params.Project)
-		req, _ := http.NewRequest("POST", url, readBody)
-		req.Header.Set("Content-Type", writer.FormDataContentType())
-
-		ctx, cancel := context.WithCancel(context.Background())
-		req = req.WithContext(ctx)
-		c.cancelUpload = cancel
+	// register upload operation before starting, so it can be aborted immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &uploadOperation{cancel: cancel, project: params.Project}
+	c.startUserUpload(op)
 
-		resp, err := c.httpClient.Do(req)
-		if err != nil {
-			log.Printf("Failed to execute upload request: %s\n", err)
-			c.SendErrorMessage("UploadError", "Upload error")
+	go func() {
+		defer cancel()
+		summary := newTransferSummary(len(params.Files))
+		progress := func(p UploadProgress) {
+			summary.Done, summary.Bytes = p.FilesDone, p.Bytes
+			c.SendDataMessage("UploadProgress", p)
+		}
+		err := c.uploadFiles(ctx, directory, params, msg.Data, progress)
+		c.uploadMutex.Lock()
+		if c.upload == op {
+			c.upload = nil
+		}
+		c.uploadMutex.Unlock()
+		if err == nil {
+			summary.finish()
+			c.SendDataResponse(msg, summary)
 			return
 		}
-		defer resp.Body.Close()
-		c.cancelUpload = nil
-
-		log.Println("Upload response:", resp.StatusCode)
-
-		respData, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Failed to read upload response: %s\n", err)
+		if ctx.Err() != nil {
+			// aborted, server was notified with UploadAborted message
+			summary.Aborted = true
+			summary.finish()
+			c.SendDataResponse(msg, summary)
+			return
 		}
-		if resp.StatusCode >= 400 {
-			if err = c.SendErrorMessage("UploadError", string(respData)); err != nil {
-				log.Printf("Failed to send error message: %s\n", err)
-			}
+		var lockErr *ProjectLockedError
+		if errors.As(err, &lockErr) {
+			c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: 409, Data: lockErr})
+			return
 		}
-		err = <-errChan
-		if err != nil {
-			log.Println(err)
+		var uploadErr *UploadError
+		if errors.As(err, &uploadErr) {
+			if quotaErr := uploadErr.quotaError(); quotaErr != nil {
+				c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: uploadErr.StatusCode, Data: quotaErr})
+				return
+			}
+			errText := truncateText(uploadErr.Body, maxErrorBodyLength)
+			if err = c.SendErrorResponse(msg, errText); err != nil {
+				log.Printf("Failed to send error response: %s\n", err)
+			}
+			// web app versions which don't wait for the response of the request
+			c.SendErrorMessage("UploadError", errText)
+			return
 		}
+		log.Printf("Failed to upload files: %s\n", err)
+		c.SendErrorResponse(msg, "Failed to upload files: "+err.Error())
+		c.SendErrorMessage("UploadError", "Upload error")
 	}()
 	return nil
 }
 
-func (c *Client) fetchFile(project, projectDir string, finfo FileInfo) (err error) {
-	relPath := filepath.FromSlash(finfo.Path)
-	destPath := filepath.Join(projectDir, relPath)
-	destDir := filepath.Dir(destPath)
-	if err := os.MkdirAll(destDir, 0777); err != nil {
-		return fmt.Errorf("creating file directory: %w", err)
-	}
-	delete(c.checksumCache, destPath)
+// Error response of the upload request
+type UploadError struct {
+	StatusCode int
+	Body       string
+}
 
-	u := path.Join("/api/project/file/", project, finfo.Path)
-	resp, err := c.httpClient.Get(c.Server + u)
-	if err != nil {
-		return fmt.Errorf("requesting file: %w", err)
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("upload failed with status %d: %s", e.StatusCode, truncateText(e.Body, maxErrorBodyLength))
+}
+
+// Maximal length of server error response passed to the web app
+const maxErrorBodyLength = 1000
+
+// Shortens text to given number of bytes (on UTF-8 character boundary)
+func truncateText(text string, max int) string {
+	if len(text) <= max {
+		return text
 	}
-	defer resp.Body.Close()
-	f, err := os.CreateTemp(projectDir, "tmpfile-")
-	if err != nil {
-		return fmt.Errorf("creating temporary file: %w", err)
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
 	}
+	return text[:max] + "…"
+}
 
-	defer func() {
-		// Clean up in case we are returning with an error
-		if err != nil {
-			f.Close()
-			os.Remove(f.Name())
-		}
-	}()
+// Structured error of exceeded storage quota
+type quotaError struct {
+	Error  string `json:"error"`
+	Code   string `json:"code"`
+	Status int    `json:"status"`
+	// sizes in bytes, when provided by server
+	Limit  *int64 `json:"limit,omitempty"`
+	Used   *int64 `json:"used,omitempty"`
+	Needed *int64 `json:"needed,omitempty"`
+}
 
-	if err = f.Chmod(0644); err != nil {
-		return
-	}
-	/*
-		sha := sha1.New()
-		dest := io.MultiWriter(f, sha)
-		if _, err = io.Copy(dest, resp.Body); err != nil {
-			return fmt.Errorf("writing to file: %w", err)
-		}
-	*/
-	if _, err = io.Copy(f, resp.Body); err != nil {
-		return fmt.Errorf("writing to file: %w", err)
+// Returns structured error when the server rejected upload because of exceeded storage
+// quota (413 or 507 status with JSON body), otherwise nil
+func (e *UploadError) quotaError() *quotaError {
+	if e.StatusCode != http.StatusRequestEntityTooLarge && e.StatusCode != http.StatusInsufficientStorage {
+		return nil
 	}
-	if err = f.Close(); err != nil {
-		return
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(e.Body), &body); err != nil {
+		return nil
 	}
-	if finfo.Mtime > 0 {
-		lmtime := time.Unix(finfo.Mtime, 0)
-		if err := os.Chtimes(f.Name(), lmtime, lmtime); err != nil {
-			return fmt.Errorf("updating file's modification time: %w", err)
+	result := &quotaError{Error: "Storage quota exceeded", Code: "quota_exceeded", Status: e.StatusCode}
+	for _, key := range []string{"detail", "message", "error"} {
+		if text, ok := body[key].(string); ok && text != "" {
+			result.Error = truncateText(text, maxErrorBodyLength)
+			break
 		}
 	}
-	// fmt.Printf("%x - %s\n", sha.Sum(nil), finfo.Hash)
-	if err = os.Rename(f.Name(), destPath); err != nil {
-		return fmt.Errorf("renaming temporary file: %w", err)
+	number := func(keys ...string) *int64 {
+		for _, key := range keys {
+			if v, ok := body[key].(float64); ok {
+				n := int64(v)
+				return &n
+			}
+		}
+		return nil
 	}
-	return nil
+	result.Limit = number("limit", "quota")
+	result.Used = number("used", "usage")
+	result.Needed = number("needed", "required", "size")
+	return result
 }
 
-func (c *Client) handleFetchFiles(msg message) error {
+// Fills missing metadata (mtime, size, hash) of uploaded files, files are hashed in parallel.
+// Returns true when metadata of any file were updated.
+func (c *Client) completeUploadInfo(ctx context.Context, files []FileInfo, absPaths []string) (bool, error) {
+	var pending []int
+	for i, f := range files {
+		if f.Mtime == 0 {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return false, nil
+	}
+	errs := make([]error, len(files))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < poolSize(c.Concurrency.Upload, len(pending)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f := &files[i]
+				finfo, err := os.Stat(absPaths[i])
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				f.Mtime = finfo.ModTime().Unix()
+				f.Size = finfo.Size()
+				if c.skipHash(f.Size) {
+					f.HashSkipped = true
+				} else if f.Hash == "" {
+					f.Hash, errs[i] = c.cachedChecksum(ctx, absPaths[i], f.Size, f.Mtime)
+				}
+			}
+		}()
+	}
+	for _, i := range pending {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, i := range pending {
+		if errs[i] != nil {
+			return true, errs[i]
+		}
+	}
+	return true, nil
+}
+
+// Uploads project files to the server. Files metadata (changes) are sent along with files,
+// missing metadata (mtime, size, hash) are computed. When original changes data (JSON)
+// are given, they are sent as they are if no update was needed. Progress function is called
+// after each file when specified. The project is locked on the server during upload
+// (when supported).
+func (c *Client) uploadFiles(ctx context.Context, directory string, params FilesParam, changes json.RawMessage, progress func(UploadProgress)) (err error) {
+	absPaths := make([]string, len(params.Files))
+	for i, f := range params.Files {
+		absPath, err := resolveProjectPath(directory, f.Path)
+		if err != nil {
+			return err
+		}
+		if relPath, err := filepath.Rel(directory, absPath); err == nil && isInternalPath(relPath) {
+			return fmt.Errorf("internal file of the plugin can't be uploaded: %s", f.Path)
+		}
+		absPaths[i] = absPath
+	}
+	lock, err := c.lockProject(ctx, params.Project, params.ForceLock)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	defer func() {
+		if lostErr := lock.lost(); err != nil && lostErr != nil {
+			err = lostErr
+		}
+	}()
+	ctx = lock.context(ctx)
+
+	readBody, writeBody := io.Pipe()
+	defer readBody.Close()
+
+	writer := multipart.NewWriter(writeBody)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer writeBody.Close()
+
+		updated, err := c.completeUploadInfo(ctx, params.Files, absPaths)
+		if err != nil {
+			errChan <- err
+			writeBody.CloseWithError(err)
+			return
+		}
+		changesUpdated := changes == nil || updated
+		if changesUpdated {
+			data, err := json.Marshal(params)
+			if err != nil {
+				errChan <- err
+				writeBody.CloseWithError(err)
+				return
+			}
+			writer.WriteField("changes", string(data))
+		} else {
+			writer.WriteField("changes", string(changes))
+		}
+
+		status := UploadProgress{FilesTotal: len(params.Files)}
+		for _, f := range params.Files {
+			status.BytesTotal += f.Size
+		}
+		for i, f := range params.Files {
+			// ext := filepath.Ext(f.Path)
+			useCompression := compressedUpload(f.Path)
+			if useCompression {
+				mh := make(textproto.MIMEHeader)
+				mh.Set("Content-Type", "application/octet-stream")
+				mh.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s.gz"`, f.Path, f.Path))
+				part, err := writer.CreatePart(mh)
+				if err != nil {
+					errChan <- err
+					writeBody.CloseWithError(err)
+					return
+				}
+				gzpart := gzip.NewWriter(part)
+				err = CopyFile(gzpart, absPaths[i])
+				gzpart.Close()
+				if err != nil {
+					errChan <- err
+					writeBody.CloseWithError(err)
+					return
+				}
+			} else {
+				part, err := writer.CreateFormFile(f.Path, f.Path)
+				if err != nil {
+					errChan <- err
+					writeBody.CloseWithError(err)
+					return
+				}
+				if err = CopyFile(part, absPaths[i]); err != nil {
+					errChan <- err
+					writeBody.CloseWithError(err)
+					return
+				}
+			}
+			if progress != nil {
+				status.File = f.Path
+				status.FilesDone++
+				status.Bytes += f.Size
+				status.Percent = percent(status.Bytes, status.BytesTotal)
+				progress(status)
+			}
+		}
+		errChan <- writer.Close()
+	}()
+
+	url := c.apiURL("api/project/upload", params.Project)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, readBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("executing upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	log.Println("Upload response:", resp.StatusCode)
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Failed to read upload response: %s\n", err)
+	}
+	if resp.StatusCode >= 400 {
+		return &UploadError{StatusCode: resp.StatusCode, Body: string(respData)}
+	}
+	if err = <-errChan; err != nil {
+		return fmt.Errorf("writing upload data: %w", err)
+	}
+	state := c.syncState(directory)
+	state.record(params.Files, params.Version)
+	if err := state.save(); err != nil {
+		log.Printf("Failed to save sync state: %s\n", err)
+	}
+	return nil
+}
+
+// Running fetch operation, shared by all downloads started by a single FetchFiles request
+type fetchOperation struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// serializes cancellation with the final rename step of downloaded files
+	mutex sync.Mutex
+	// ID of the backup of overwritten files (when enabled)
+	backupID string
+}
+
+// Runs given function (final step of a file download) unless the operation was already cancelled
+func (op *fetchOperation) commit(fn func() error) error {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	if err := op.ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (op *fetchOperation) abort() {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	op.cancel()
+}
+
+func (c *Client) startFetchOperation(id string) *fetchOperation {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &fetchOperation{ctx: ctx, cancel: cancel, backupID: newStoreID()}
+	c.fetchOpsMutex.Lock()
+	defer c.fetchOpsMutex.Unlock()
+	c.fetchOps[id] = op
+	return op
+}
+
+func (c *Client) finishFetchOperation(id string) {
+	c.fetchOpsMutex.Lock()
+	defer c.fetchOpsMutex.Unlock()
+	if op, ok := c.fetchOps[id]; ok {
+		op.cancel()
+		delete(c.fetchOps, id)
+	}
+}
+
+// Checks whether the local file was modified since it was last listed (checksum cache)
+// and differs from the server version. Files without cached checksum (e.g. after restart)
+// are compared with the last synchronized version from the sync state, or with the server
+// version when the file was never synchronized.
+func (c *Client) checkFetchConflict(ctx context.Context, projectDir, destPath string, finfo FileInfo) error {
+	stat, err := os.Stat(destPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	c.cacheMutex.Lock()
+	cached, inCache := c.checksumCache[destPath]
+	c.cacheMutex.Unlock()
+	if !inCache {
+		base, ok := c.syncState(projectDir).entry(finfo.Path)
+		if ok {
+			cached = FileInfo{Hash: base.Hash, Size: base.Size, Mtime: base.Mtime}
+		} else {
+			cached = FileInfo{Size: -1}
+		}
+	}
+	if cached.Size == stat.Size() && cached.Mtime == stat.ModTime().Unix() {
+		return nil
+	}
+	if c.skipHash(stat.Size()) {
+		// large files are compared by size and modification time only
+		if stat.Size() == finfo.Size && stat.ModTime().Unix() == finfo.Mtime {
+			return nil
+		}
+		return ErrFetchConflict
+	}
+	hash, err := c.computeChecksum(ctx, destPath)
+	if err != nil {
+		return fmt.Errorf("computing checksum of local file: %w", err)
+	}
+	if cached.Hash != "" && hash == cached.Hash {
+		return nil
+	}
+	match, err := c.matchesHash(ctx, destPath, hash, finfo.Hash)
+	if err != nil {
+		return fmt.Errorf("computing checksum of local file: %w", err)
+	}
+	if !match {
+		return ErrFetchConflict
+	}
+	return nil
+}
+
+// Downloads a single file into the project directory, returns number of downloaded bytes
+func (c *Client) fetchFile(op *fetchOperation, params *FilesParam, projectDir string, finfo FileInfo) (int64, error) {
+	destPath, err := resolveProjectPath(projectDir, finfo.Path)
+	if err != nil {
+		return 0, err
+	}
+	destDir := filepath.Dir(destPath)
+	if !params.Force {
+		if err := c.checkFetchConflict(op.ctx, projectDir, destPath, finfo); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.MkdirAll(destDir, c.DirMode); err != nil {
+		return 0, fmt.Errorf("creating file directory: %w", err)
+	}
+	etags := c.etagStore(projectDir)
+	etag := etags.lookup(finfo.Path, destPath)
+
+	tmpPath, info, err := c.downloadFile(op, params.Project, projectDir, finfo, etag)
+	if err != nil {
+		return 0, err
+	}
+	if finfo.Mtime == 0 {
+		finfo.Mtime = info.Mtime
+	}
+	c.invalidateChecksums(destPath)
+	err = op.commit(func() error {
+		return c.installFetchedFile(op, params, projectDir, finfo.Path, tmpPath, destPath)
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	etags.set(finfo.Path, destPath, info.ETag)
+	c.recordLocalFile(op.ctx, projectDir, filepath.ToSlash(finfo.Path), params.Version)
+	return info.Size, nil
+}
+
+// Moves fetched temporary file into the project directory. Original file is moved into
+// the backup directory or kept next to the new one, according to the fetch options.
+func (c *Client) installFetchedFile(op *fetchOperation, params *FilesParam, projectDir, relPath, tmpPath, destPath string) error {
+	if params.Backup {
+		if err := moveToStore(projectDir, backupsDir, op.backupID, relPath); err != nil {
+			return fmt.Errorf("creating backup of original file: %w", err)
+		}
+	}
+	if params.KeepOriginal {
+		origPath := fmt.Sprintf("%s.orig-%s", destPath, time.Now().Format("20060102150405"))
+		if err := os.Rename(destPath, origPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("saving original file: %w", err)
+		}
+	}
+	if err := replaceFile(tmpPath, destPath); err != nil {
+		return fmt.Errorf("renaming temporary file: %w", err)
+	}
+	return nil
+}
+
+// Downloads project file into a new temporary file in given directory and returns its path
+// and download metadata. When ETag of the local file is given, ErrNotModified is returned if
+// the file wasn't changed on the server. Modification time of the file is set from the file
+// info, or from Last-Modified header of the response when not known.
+func (c *Client) downloadFile(op *fetchOperation, project, tmpDir string, finfo FileInfo, etag string) (tmpPath string, info downloadInfo, err error) {
+	f, err := os.CreateTemp(tmpDir, "tmpfile-")
+	if err != nil {
+		return "", info, fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	defer func() {
+		// Clean up in case we are returning with an error (including cancellation)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = f.Chmod(fetchedFileMode(os.FileMode(finfo.Mode))); err != nil {
+		return
+	}
+	/*
+		sha := sha1.New()
+		dest := io.MultiWriter(f, sha)
+	*/
+	if info, err = c.download(op.ctx, c.apiURL("api/project/file", project, finfo.Path), f, etag); err != nil {
+		return "", info, err
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	switch {
+	case finfo.Mtime > 0:
+		info.Mtime = finfo.Mtime
+	case !info.LastModified.IsZero():
+		info.Mtime = info.LastModified.Unix()
+	case c.Debug:
+		log.Printf("Modification time of fetched file is unknown: %s\n", finfo.Path)
+	}
+	if info.Mtime > 0 {
+		lmtime := time.Unix(info.Mtime, 0)
+		if err = os.Chtimes(f.Name(), lmtime, lmtime); err != nil {
+			return "", info, fmt.Errorf("updating file's modification time: %w", err)
+		}
+	}
+	// fmt.Printf("%x - %s\n", sha.Sum(nil), finfo.Hash)
+	return f.Name(), info, nil
+}
+
+type fetchFailure struct {
+	Path   string `json:"path"`
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Summary of the fetch operation, sent in the final response
+type fetchResult struct {
+	TransferSummary
+	Completed []string       `json:"completed"`
+	Failed    []fetchFailure `json:"failed"`
+	Conflicts []string       `json:"conflicts"`
+	Skipped   []string       `json:"skipped"`
+	Pruned    []string       `json:"pruned,omitempty"`
+}
+
+func newFetchResult(total int) *fetchResult {
+	return &fetchResult{
+		TransferSummary: newTransferSummary(total),
+		Completed:       []string{},
+		Failed:          []fetchFailure{},
+		Conflicts:       []string{},
+		Skipped:         []string{},
+	}
+}
+
+// Returns FetchStatus message data of the file with current progress
+func (r *fetchResult) status(path, status string) FetchStatus {
+	return FetchStatus{
+		File:       path,
+		Status:     status,
+		FilesDone:  r.Done,
+		FilesTotal: r.Total,
+		Percent:    percent(int64(r.Done), int64(r.Total)),
+	}
+}
+
+// Records result of a single file fetch and returns corresponding FetchStatus message data
+func (r *fetchResult) add(path string, size int64, err error) FetchStatus {
+	r.Done++
+	info := r.status(path, "")
+	switch {
+	case err == nil:
+		info.Status = "finished"
+		info.Bytes = size
+		r.Completed = append(r.Completed, path)
+		r.Bytes += size
+	case errors.Is(err, context.Canceled):
+		info.Status = "aborted"
+	case errors.Is(err, ErrFetchConflict):
+		info.Status = "conflict"
+		r.Conflicts = append(r.Conflicts, path)
+	case errors.Is(err, ErrFileLocked):
+		info.Status = "locked"
+		info.Detail = err.Error()
+		r.Skipped = append(r.Skipped, path)
+	case errors.Is(err, ErrNotModified):
+		info.Status = "skipped"
+		r.Skipped = append(r.Skipped, path)
+	default:
+		info.Status = "error"
+		info.Detail = err.Error()
+		info.Reason = fetchErrorReason(err)
+		r.Failed = append(r.Failed, fetchFailure{Path: path, Error: err.Error(), Reason: info.Reason})
+	}
+	return info
+}
+
+// Reports whether local files can be pruned, which is only when the fetch was neither
+// aborted nor any file failed, so the local copy matches the server file list
+func (r *fetchResult) canPrune() bool {
+	return !r.Aborted && len(r.Failed) == 0
+}
+
+func (r *fetchResult) finish() *fetchResult {
+	r.TransferSummary.finish()
+	return r
+}
+
+// Removes local project files (except ignored and temporary files) which are not
+// present in the list of server files. Returns paths of removed files, or only paths
+// which would be removed in dry run mode.
+func (c *Client) pruneFiles(directory string, serverFiles []string, dryRun bool) ([]string, error) {
+	files, _, err := c.ListDir(directory, false)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool, len(serverFiles))
+	for _, p := range serverFiles {
+		keep[normalizePath(p)] = true
+	}
+	pruned := []string{}
+	for _, f := range files {
+		relPath := filepath.ToSlash(f.Path)
+		if keep[relPath] {
+			continue
+		}
+		if !dryRun {
+			absPath := matchNormalizedPath(filepath.Clean(directory), filepath.Join(directory, f.Path))
+			c.invalidateChecksums(absPath)
+			if err := os.Remove(absPath); err != nil {
+				log.Printf("Failed to remove file %s: %s\n", relPath, err)
+				continue
+			}
+		}
+		pruned = append(pruned, relPath)
+	}
+	return pruned, nil
+}
+
+// Error response of FetchFiles request with files which would overwrite each other
+type caseConflictError struct {
+	Error     string     `json:"error"`
+	Reason    string     `json:"reason"`
+	Conflicts [][]string `json:"conflicts"`
+}
+
+func (c *Client) handleFetchFiles(msg message) error {
 	var params FilesParam
 	if err := json.Unmarshal(msg.Data, &params); err != nil {
 		return err
 	}
+	directory, err := c.resolveProjectDirectory(params.Directory)
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	directory = filepath.FromSlash(directory)
+	if isCaseInsensitiveDir(directory) {
+		paths := make([]string, 0, len(params.Files)+len(params.ServerFiles))
+		for _, f := range params.Files {
+			paths = append(paths, f.Path)
+		}
+		paths = append(paths, params.ServerFiles...)
+		if conflicts := findCaseCollisions(paths); len(conflicts) > 0 {
+			return c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: 409, Data: caseConflictError{
+				Error:     ErrCaseConflict.Error(),
+				Reason:    "case_conflict",
+				Conflicts: conflicts,
+			}})
+		}
+	}
+	c.sweepTempFiles(directory)
+	if params.CheckSpace {
+		var required uint64
+		for _, f := range params.Files {
+			required += uint64(f.Size)
+		}
+		free, _, err := DiskUsage(directory)
+		if err != nil {
+			return fmt.Errorf("checking free disk space: %w", err)
+		}
+		if required > free {
+			return fmt.Errorf("not enough free disk space (required: %d B, available: %d B)", required, free)
+		}
+	}
+	if (params.Prune || params.PruneDryRun) && params.ServerFiles == nil {
+		return errors.New("list of server files is required in prune mode")
+	}
+	c.preemptAutoSync()
+	op := c.startFetchOperation(msg.ID)
+	if params.Archive && c.serverSupports("project_archive") {
+		go c.fetchProjectArchive(op, msg, &params, directory)
+		return nil
+	}
+	if params.Atomic {
+		go c.fetchFilesAtomic(op, msg, &params, directory)
+		return nil
+	}
+	go c.fetchFiles(op, msg, &params, directory)
+	return nil
+}
+
+// Downloads files one by one, files which were fetched successfully are kept when
+// other files fail
+func (c *Client) fetchFiles(op *fetchOperation, msg message, params *FilesParam, projectDir string) {
+	defer c.finishFetchOperation(msg.ID)
+	result := newFetchResult(len(params.Files))
+	for _, f := range params.Files {
+		if op.ctx.Err() != nil {
+			break
+		}
+		size, err := c.fetchFile(op, params, projectDir, f)
+		if err != nil && op.ctx.Err() != nil {
+			err = context.Canceled
+		}
+		if errors.Is(err, ErrFileLocked) {
+			c.SendDataMessage("FileLocked", FileLocked{File: f.Path, Pending: f.Path + ".new"})
+		}
+		c.SendDataMessage("FetchStatus", result.add(f.Path, size, err))
+	}
+	c.saveTransferState(projectDir)
+	result.Aborted = op.ctx.Err() != nil && len(result.Completed) < len(params.Files)
+	if result.canPrune() && (params.Prune || params.PruneDryRun) {
+		pruned, err := c.pruneFiles(projectDir, params.ServerFiles, params.PruneDryRun)
+		if err != nil {
+			c.SendErrorResponse(msg, "Failed to prune local files: "+err.Error())
+			return
+		}
+		result.Pruned = pruned
+	}
+	if params.Backup {
+		if err := pruneStore(projectDir, backupsDir, c.BackupRetention); err != nil {
+			log.Printf("Failed to remove old backups: %s\n", err)
+		}
+	}
+	c.SendDataResponse(msg, result.finish())
+}
+
+type abortParams struct {
+	ID string `json:"id"`
+}
+
+// Cancels running fetch operation identified by the ID of the original FetchFiles request
+func (c *Client) handleAbortFetch(msg message) error {
+	var params abortParams
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &params); err != nil {
+			return err
+		}
+	}
+	if params.ID == "" {
+		c.CancelFetch()
+		return nil
+	}
+	c.fetchOpsMutex.Lock()
+	op, ok := c.fetchOps[params.ID]
+	c.fetchOpsMutex.Unlock()
+	if ok {
+		op.abort()
+	}
+	return nil
+}
+
+// Cancels all running fetch operations
+func (c *Client) CancelFetch() {
+	c.fetchOpsMutex.Lock()
+	defer c.fetchOpsMutex.Unlock()
+	for _, op := range c.fetchOps {
+		op.abort()
+	}
+}
+
+type DeleteFilesRequest struct {
+	Project string   `json:"project"`
+	Files   []string `json:"files"`
+	// project directory announced by the plugin, saves request for the directory
+	Directory string `json:"directory,omitempty"`
+	// version of the server project, recorded in the sync state after transfer
+	Version string `json:"version,omitempty"`
+	// Moves files into the project trash instead of permanent removal (overrides
+	// Client.SoftDelete when specified)
+	Recycle *bool `json:"recycle,omitempty"`
+	// All-or-nothing deletion - files are moved into a staging directory first and when
+	// any of them cannot be deleted, already deleted files are restored (best effort)
+	Atomic bool `json:"atomic,omitempty"`
+	// Removes parent directories which became empty after deletion
+	PruneEmptyDirs bool `json:"prune_empty_dirs,omitempty"`
+	// Expected checksums of files (by path), a file whose current checksum is different
+	// is not deleted and reported as a conflict
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+// Prefix of staging directories (inside of .gisquick directory) for files deleted within
+// atomic delete operations, every operation uses its own directory
+const deleteStagingPrefix = "staging-delete-"
+
+type deletedEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"` // "file" or "dir"
+	// number of removed files and directories within deleted directory
+	Children int `json:"children,omitempty"`
+	// empty directory removed after deletion of its content
+	Pruned bool `json:"pruned,omitempty"`
+	// cleaned path relative to the project directory
+	relPath string
+}
+
+// Deletes file or whole directory, returns information about deleted entry. When storeID
+// is not empty, the entry is moved into the store directory (e.g. trash) instead of
+// permanent removal. When expected hash is specified, the file is deleted only if its
+// checksum matches, otherwise ErrDeleteConflict is returned.
+func (c *Client) deletePath(directory, relPath, storeDir, storeID, expectedHash string) (*deletedEntry, error) {
+	absPath, err := resolveProjectPath(directory, relPath)
+	if err != nil {
+		return nil, err
+	}
+	if absPath == filepath.Clean(directory) {
+		return nil, errors.New("cannot delete project directory")
+	}
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if expectedHash != "" {
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%w: not a file", ErrDeleteConflict)
+		}
+		hash, err := c.cachedChecksum(c.connectionContext(), absPath, info.Size(), info.ModTime().Unix())
+		if err != nil {
+			return nil, fmt.Errorf("computing checksum: %w", err)
+		}
+		match, err := c.matchesHash(c.connectionContext(), absPath, hash, expectedHash)
+		if err != nil {
+			return nil, fmt.Errorf("computing checksum: %w", err)
+		}
+		if !match {
+			return nil, ErrDeleteConflict
+		}
+	}
+	cleanPath, _ := filepath.Rel(directory, absPath)
+	entry := &deletedEntry{Path: relPath, Type: "file", relPath: filepath.ToSlash(cleanPath)}
+	if !info.IsDir() {
+		c.invalidateChecksums(absPath)
+	} else {
+		entry.Type = "dir"
+		filepath.WalkDir(absPath, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && path != absPath {
+				entry.Children++
+				c.invalidateChecksums(path)
+			}
+			return nil
+		})
+	}
+	if storeID != "" {
+		return entry, moveToStore(directory, storeDir, storeID, entry.relPath)
+	}
+	if info.IsDir() {
+		return entry, os.RemoveAll(absPath)
+	}
+	return entry, os.Remove(absPath)
+}
+
+// Removes parent directories of deleted entries which became empty, stops at the project
+// root. Directories containing any other files (including hidden or ignored files) are kept.
+// Non-empty directories are checked again for other entries, as they may become empty
+// after their subdirectories are removed.
+func pruneEmptyParents(directory string, deleted []deletedEntry) []deletedEntry {
+	pruned := []deletedEntry{}
+	removed := make(map[string]bool)
+	for _, entry := range deleted {
+		dir := filepath.Dir(filepath.FromSlash(entry.relPath))
+		for dir != "." && !removed[dir] {
+			absPath := filepath.Join(directory, dir)
+			entries, err := os.ReadDir(absPath)
+			if err != nil || len(entries) > 0 {
+				break
+			}
+			if err := os.Remove(absPath); err != nil {
+				break
+			}
+			removed[dir] = true
+			pruned = append(pruned, deletedEntry{Path: filepath.ToSlash(dir), Type: "dir", Pruned: true})
+			dir = filepath.Dir(dir)
+		}
+	}
+	return pruned
+}
+
+// Returns paths without duplicates and paths nested in other paths of the list, which are
+// deleted together with their parent directory (and would be deleted concurrently otherwise)
+func dropNestedPaths(paths []string) []string {
+	cleaned := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		cleaned[path.Clean(normalizePath(p))] = true
+	}
+	kept := make(map[string]bool, len(paths))
+	result := make([]string, 0, len(paths))
+	for _, p := range paths {
+		cleanPath := path.Clean(normalizePath(p))
+		if kept[cleanPath] {
+			continue
+		}
+		nested := false
+		for dir := path.Dir(cleanPath); dir != "." && dir != "/" && !nested; dir = path.Dir(dir) {
+			nested = cleaned[dir]
+		}
+		if !nested {
+			result = append(result, p)
+			kept[cleanPath] = true
+		}
+	}
+	return result
+}
+
+// Returns category of the error of a single entry in responses of file operations:
+// "forbidden" (path outside of the project directory, 403 status of whole requests),
+// "not-found", "permission", "locked", "conflict" or "other"
+func errorCategory(err error) string {
+	switch {
+	case errors.Is(err, ErrPathOutsideProject):
+		return "forbidden"
+	case isFileLocked(err):
+		return "locked"
+	case errors.Is(err, ErrDeleteConflict):
+		return "conflict"
+	case errors.Is(err, os.ErrNotExist):
+		return "not-found"
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	}
+	return "other"
+}
+
+type deleteError struct {
+	Path string `json:"path"`
+	// see errorCategory
+	Category string `json:"category"`
+	Error    string `json:"error"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+func newDeleteError(path string, err error) deleteError {
+	e := deleteError{Path: path, Category: errorCategory(err), Error: err.Error()}
+	switch e.Category {
+	case "locked":
+		e.Hint = "File is used by another application, close the layer in QGIS and try again"
+	case "conflict":
+		e.Hint = "File was modified since the deletion was requested"
+	}
+	return e
+}
+
+func (c *Client) handleDeleteFiles(msg message) error {
+	var params DeleteFilesRequest
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	directory, err := c.resolveProjectDirectory(params.Directory)
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	directory = filepath.FromSlash(directory)
+	recycle := c.SoftDelete
+	if params.Recycle != nil {
+		recycle = *params.Recycle
+	}
+	trashID := ""
+	if recycle {
+		trashID = newStoreID()
+	}
+	params.Files = dropNestedPaths(params.Files)
+	if params.Atomic {
+		return c.deleteFilesAtomic(msg, directory, params, trashID)
+	}
+	// files are deleted in parallel, which is much faster on network file systems
+	var failed []deleteError
+	var failedMutex sync.Mutex
+	entries := make([]*deletedEntry, len(params.Files))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < poolSize(c.Concurrency.Delete, len(params.Files)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fpath := params.Files[i]
+				entry, err := c.deletePath(directory, fpath, trashDir, trashID, params.Hashes[fpath])
+				if err != nil {
+					// already absent file is not an error
+					if !os.IsNotExist(err) {
+						failedMutex.Lock()
+						failed = append(failed, newDeleteError(fpath, err))
+						failedMutex.Unlock()
+					}
+					continue
+				}
+				entries[i] = entry
+			}
+		}()
+	}
+	for i := range params.Files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	deleted := []deletedEntry{}
+	for _, entry := range entries {
+		if entry != nil {
+			deleted = append(deleted, *entry)
+		}
+	}
+	if trashID != "" {
+		if err := c.cleanupTrash(directory); err != nil {
+			log.Printf("Failed to clean up trash: %s\n", err)
+		}
+	}
+	if params.PruneEmptyDirs {
+		deleted = append(deleted, pruneEmptyParents(directory, deleted)...)
+	}
+	c.recordDeleted(directory, deleted, params.Version)
+	if len(failed) > 0 {
+		return c.SendErrorResponse(msg, failed)
+	}
+	if err = c.SendDataResponse(msg, deleted); err != nil {
+		log.Println("failed to send ws message:", err)
+		time.Sleep(10 * time.Millisecond)
+		return c.SendDataResponse(msg, deleted)
+	}
+	return nil
+}
+
+// Deletes all given files or none of them. Files are moved into the staging directory and
+// restored back when any file cannot be deleted. On success, staged files are moved into
+// the trash (when trashID is specified) or removed.
+func (c *Client) deleteFilesAtomic(msg message, directory string, params DeleteFilesRequest, trashID string) error {
+	deleted, failed, err := c.deleteAtomic(directory, params, trashID)
+	if err != nil {
+		return c.SendErrorResponse(msg, "Failed to create staging directory: "+err.Error())
+	}
+	if len(failed) > 0 {
+		return c.SendErrorResponse(msg, failed)
+	}
+	return c.SendDataResponse(msg, deleted)
+}
+
+// Performs atomic deletion, returns deleted entries or errors of files which couldn't be
+// deleted (or restored). Every operation uses its own staging directory.
+func (c *Client) deleteAtomic(directory string, params DeleteFilesRequest, trashID string) ([]deletedEntry, []deleteError, error) {
+	internalDir := filepath.Join(directory, ".gisquick")
+	if err := os.MkdirAll(internalDir, 0777); err != nil {
+		return nil, nil, err
+	}
+	stageDir, err := os.MkdirTemp(internalDir, deleteStagingPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	stageID := filepath.Base(stageDir)
+
+	var failed []deleteError
+	deleted := []deletedEntry{}
+	for _, fpath := range params.Files {
+		entry, err := c.deletePath(directory, fpath, ".gisquick", stageID, params.Hashes[fpath])
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			failed = append(failed, newDeleteError(fpath, err))
+			break
+		}
+		deleted = append(deleted, *entry)
+	}
+	if len(failed) > 0 {
+		// rollback, files which couldn't be restored are moved into the trash, so they can
+		// be restored later (and are not swept as stale temporary files)
+		restored := true
+		for i := len(deleted) - 1; i >= 0; i-- {
+			relPath := filepath.FromSlash(deleted[i].relPath)
+			if err := os.Rename(filepath.Join(stageDir, relPath), filepath.Join(directory, relPath)); err != nil {
+				log.Printf("Failed to restore deleted file %s: %s\n", deleted[i].Path, err)
+				failed = append(failed, newDeleteError(deleted[i].Path, fmt.Errorf("restoring file: %w", err)))
+				restored = false
+			}
+		}
+		if restored {
+			os.RemoveAll(stageDir)
+		} else if err := moveStagingToTrash(directory, stageDir); err != nil {
+			log.Printf("Failed to move unrestored files into trash, they are kept in %s: %s\n", stageDir, err)
+		}
+		return nil, failed, nil
+	}
+	if trashID != "" && len(deleted) > 0 {
+		moved := true
+		for _, entry := range deleted {
+			stagedPath := filepath.Join(stageDir, filepath.FromSlash(entry.relPath))
+			trashPath := filepath.Join(directory, trashDir, trashID, filepath.FromSlash(entry.relPath))
+			err := os.MkdirAll(filepath.Dir(trashPath), 0777)
+			if err == nil {
+				err = os.Rename(stagedPath, trashPath)
+			}
+			if err != nil {
+				log.Printf("Failed to move deleted file into trash: %s\n", err)
+				moved = false
+			}
+		}
+		if err := c.cleanupTrash(directory); err != nil {
+			log.Printf("Failed to clean up trash: %s\n", err)
+		}
+		if !moved {
+			// keep remaining staged files, the staging directory is removed later as a stale
+			// temporary file (see sweepTempFiles)
+			c.recordDeleted(directory, deleted, params.Version)
+			return deleted, nil, nil
+		}
+	}
+	os.RemoveAll(stageDir)
+	if params.PruneEmptyDirs {
+		deleted = append(deleted, pruneEmptyParents(directory, deleted)...)
+	}
+	c.recordDeleted(directory, deleted, params.Version)
+	return deleted, nil, nil
+}
+
+// Moves the staging directory of atomic delete into the trash as a new trash entry
+func moveStagingToTrash(directory, stageDir string) error {
+	trashPath := filepath.Join(directory, trashDir, newStoreID())
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0777); err != nil {
+		return err
+	}
+	return os.Rename(stageDir, trashPath)
+}
+
+type RenameEntry struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Accepts also {src, dst} form of the entry
+func (e *RenameEntry) UnmarshalJSON(data []byte) error {
+	var v struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Src  string `json:"src"`
+		Dst  string `json:"dst"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	e.From, e.To = v.From, v.To
+	if v.Src != "" {
+		e.From = v.Src
+	}
+	if v.Dst != "" {
+		e.To = v.Dst
+	}
+	return nil
+}
+
+type RenameFilesRequest struct {
+	Project string        `json:"project"`
+	Files   []RenameEntry `json:"files"`
+	// Allows to replace existing destination files
+	Overwrite bool `json:"overwrite"`
+	// project directory announced by the plugin, saves request for the directory
+	Directory string `json:"directory,omitempty"`
+}
+
+type renameResult struct {
+	RenameEntry
+	Error    string `json:"error,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+func (c *Client) handleRenameFiles(msg message) error {
+	return c.moveFiles(msg, "rename")
+}
+
+func (c *Client) handleMoveFiles(msg message) error {
+	return c.moveFiles(msg, "move")
+}
+
+// Renames/moves single file or directory within the project directory. Overwritten
+// destination file is moved into the backup directory (when given) instead of being
+// replaced, returns its path in the backup directory.
+func (c *Client) renamePath(directory string, entry RenameEntry, overwrite bool, backupDir string) (string, error) {
+	srcPath, err := resolveProjectPath(directory, entry.From)
+	if err != nil {
+		return "", err
+	}
+	destPath, err := resolveProjectPath(directory, entry.To)
+	if err != nil {
+		return "", err
+	}
+	if srcPath == filepath.Clean(directory) || destPath == filepath.Clean(directory) {
+		return "", errors.New("cannot rename project directory")
+	}
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return "", err
+	}
+	backupPath := ""
+	if destInfo, err := os.Lstat(destPath); err == nil {
+		if !overwrite {
+			return "", errors.New("destination already exists")
+		}
+		if destInfo.IsDir() || srcInfo.IsDir() {
+			return "", errors.New("cannot overwrite directory")
+		}
+		if backupDir != "" {
+			backupPath = filepath.Join(backupDir, filepath.FromSlash(entry.To))
+			if err = os.MkdirAll(filepath.Dir(backupPath), 0777); err != nil {
+				return "", err
+			}
+			if err = os.Rename(destPath, backupPath); err != nil {
+				return "", fmt.Errorf("moving original file: %w", err)
+			}
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(destPath), 0777); err == nil {
+		err = moveFile(srcPath, destPath)
+	}
+	if err != nil {
+		if backupPath != "" {
+			if err := os.Rename(backupPath, destPath); err != nil {
+				log.Printf("Failed to restore original file %s: %s\n", destPath, err)
+			}
+		}
+		return "", err
+	}
+	c.moveChecksums(srcPath, destPath)
+	return backupPath, nil
+}
+
+// File or directory renamed by RenameFiles/MoveFiles request
+type appliedRename struct {
+	RenameEntry
+	// original destination file in the backup directory
+	backupPath string
+}
+
+// Reverts renames (in reverse order) and restores overwritten files
+func (c *Client) revertRenames(directory string, renamed []appliedRename) {
+	for i := len(renamed) - 1; i >= 0; i-- {
+		r := renamed[i]
+		if _, err := c.renamePath(directory, RenameEntry{From: r.To, To: r.From}, false, ""); err != nil {
+			log.Printf("Failed to revert rename of %s: %s\n", r.From, err)
+			continue
+		}
+		if r.backupPath != "" {
+			destPath := filepath.Join(directory, filepath.FromSlash(r.To))
+			if err := os.Rename(r.backupPath, destPath); err != nil {
+				log.Printf("Failed to restore original file %s: %s\n", destPath, err)
+			}
+		}
+	}
+}
+
+// Renames/moves files within the project directory and notifies server with given action.
+// Response contains result of every rename entry. Local renames are reverted when the server
+// couldn't be updated.
+func (c *Client) moveFiles(msg message, serverAction string) error {
+	if !c.serverSupports(serverAction + "_files") {
+		return fmt.Errorf("operation is not supported by server (%s)", serverAction)
+	}
+	var params RenameFilesRequest
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	directory, err := c.resolveProjectDirectory(params.Directory)
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	directory = filepath.FromSlash(directory)
+	// overwritten files are kept until the server is updated
+	backupDir := ""
+	if params.Overwrite {
+		internalDir := filepath.Join(directory, ".gisquick")
+		if err := os.MkdirAll(internalDir, 0777); err != nil {
+			return fmt.Errorf("creating backup directory: %w", err)
+		}
+		if backupDir, err = os.MkdirTemp(internalDir, "rename-"); err != nil {
+			return fmt.Errorf("creating backup directory: %w", err)
+		}
+		defer os.RemoveAll(backupDir)
+	}
+	failed := false
+	results := make([]renameResult, len(params.Files))
+	renamed := []appliedRename{}
+	entries := []RenameEntry{}
+	for i, entry := range params.Files {
+		results[i].RenameEntry = entry
+		backupPath, err := c.renamePath(directory, entry, params.Overwrite, backupDir)
+		if err != nil {
+			results[i].Error = err.Error()
+			results[i].Category = errorCategory(err)
+			failed = true
+			continue
+		}
+		renamed = append(renamed, appliedRename{RenameEntry: entry, backupPath: backupPath})
+		entries = append(entries, entry)
+	}
+	if len(renamed) > 0 {
+		if err = c.moveServerFiles(serverAction, params.Project, entries); err != nil {
+			c.revertRenames(directory, renamed)
+			return fmt.Errorf("updating files on server (%s): %w", serverAction, err)
+		}
+	}
+	if failed {
+		return c.SendErrorResponse(msg, results)
+	}
+	return c.SendDataResponse(msg, results)
+}
+
+type createdDirectories struct {
+	Created []string `json:"created"`
+	Existed []string `json:"existed"`
+}
+
+// Directory which couldn't be created, sent in the error response of CreateDirectory request
+type directoryError struct {
+	Path     string `json:"path"`
+	Category string `json:"category"`
+	Error    string `json:"error"`
+}
+
+// Creates directories (with all missing parents) within the project directory
+func (c *Client) handleCreateDirectory(msg message) error {
+	var paths []string
+	if err := json.Unmarshal(msg.Data, &paths); err != nil {
+		return err
+	}
 	directory, err := c.getProjectDirectory()
 	if err != nil {
 		return fmt.Errorf("resolving project directory: %w", err)
 	}
 	directory = filepath.FromSlash(directory)
-	go func() {
-		for _, f := range params.Files {
-			info := map[string]string{
-				"file": f.Path,
-			}
-			if err := c.fetchFile(params.Project, directory, f); err != nil {
-				info["status"] = "error"
-				info["detail"] = err.Error()
+	var failed []directoryError
+	addError := func(relPath string, err error) {
+		failed = append(failed, directoryError{Path: relPath, Category: errorCategory(err), Error: err.Error()})
+	}
+	result := createdDirectories{Created: []string{}, Existed: []string{}}
+	for _, relPath := range paths {
+		absPath, err := resolveProjectPath(directory, relPath)
+		if err != nil {
+			addError(relPath, err)
+			continue
+		}
+		if info, err := os.Stat(absPath); err == nil {
+			if info.IsDir() {
+				result.Existed = append(result.Existed, relPath)
 			} else {
-				info["status"] = "finished"
+				addError(relPath, errors.New("file with the same name already exists"))
 			}
-			c.SendDataMessage("FetchStatus", info)
+			continue
 		}
-		c.SendDataResponse(msg, nil)
-	}()
-	return nil
+		if err := os.MkdirAll(absPath, 0777); err != nil {
+			addError(relPath, err)
+			continue
+		}
+		result.Created = append(result.Created, relPath)
+	}
+	if len(failed) > 0 {
+		return c.SendErrorResponse(msg, failed)
+	}
+	return c.SendDataResponse(msg, result)
 }
 
-type DeleteFilesRequest struct {
-	Project string   `json:"project"`
-	Files   []string `json:"files"`
+// Default size limit of files sent with GetFileContent message
+const maxFileContentSize = 1024 * 1024
+
+type fileContentPayload struct {
+	FileInfo
+	// base64 encoded
+	Content []byte `json:"content"`
 }
 
-func (c *Client) handleDeleteFiles(msg message) error {
-	var params DeleteFilesRequest
+// Sends content of a small text file within the project directory
+func (c *Client) handleGetFileContent(msg message) error {
+	var params struct {
+		Path    string `json:"path"`
+		MaxSize int64  `json:"max_size"`
+	}
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	if params.MaxSize <= 0 {
+		params.MaxSize = maxFileContentSize
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	absPath, err := resolveProjectPath(filepath.FromSlash(directory), params.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("not a file: %s", params.Path)
+	}
+	if info.Size() > params.MaxSize {
+		return fmt.Errorf("%w: %s (%d bytes)", ErrFileTooLarge, params.Path, info.Size())
+	}
+	file, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// file could grow since stat call
+	content, err := io.ReadAll(io.LimitReader(file, params.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > params.MaxSize {
+		return fmt.Errorf("%w: %s", ErrFileTooLarge, params.Path)
+	}
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) != -1 {
+		return fmt.Errorf("%w: %s", ErrBinaryFile, params.Path)
+	}
+	hash, err := c.cachedChecksum(c.connectionContext(), absPath, info.Size(), info.ModTime().Unix())
+	if err != nil {
+		return fmt.Errorf("computing checksum: %w", err)
+	}
+	data := fileContentPayload{
+		FileInfo: FileInfo{Path: params.Path, Hash: hash, Size: info.Size(), Mtime: info.ModTime().Unix()},
+		Content:  content,
+	}
+	return c.SendDataResponse(msg, data)
+}
+
+type writeFileContentParams struct {
+	Path string `json:"path"`
+	// base64 encoded
+	Content []byte `json:"content"`
+	// expected hash of the current local file (write is rejected when the file was modified)
+	Hash  string `json:"hash,omitempty"`
+	Mtime int64  `json:"mtime,omitempty"`
+}
+
+// Writes content of a small file into the project directory (atomically via temporary file)
+func (c *Client) handleWriteFileContent(msg message) error {
+	var params writeFileContentParams
 	if err := json.Unmarshal(msg.Data, &params); err != nil {
 		return err
 	}
+	if int64(len(params.Content)) > c.MaxWriteFileSize {
+		return fmt.Errorf("%w: %s (%d bytes)", ErrFileTooLarge, params.Path, len(params.Content))
+	}
 	directory, err := c.getProjectDirectory()
 	if err != nil {
 		return fmt.Errorf("resolving project directory: %w", err)
 	}
 	directory = filepath.FromSlash(directory)
-	var errPaths []string
-	for _, fpath := range params.Files {
-		absPath := filepath.Join(directory, filepath.FromSlash(fpath))
-		delete(c.checksumCache, absPath)
-		if err = os.Remove(absPath); err != nil {
-			errPaths = append(errPaths, fpath)
+	destPath, err := resolveProjectPath(directory, params.Path)
+	if err != nil {
+		return err
+	}
+	if params.Hash != "" {
+		stat, err := os.Stat(destPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			hash, err := c.cachedChecksum(c.connectionContext(), destPath, stat.Size(), stat.ModTime().Unix())
+			if err != nil {
+				return fmt.Errorf("computing checksum: %w", err)
+			}
+			match, err := c.matchesHash(c.connectionContext(), destPath, hash, params.Hash)
+			if err != nil {
+				return fmt.Errorf("computing checksum: %w", err)
+			}
+			if !match {
+				return fmt.Errorf("%w: %s", ErrFetchConflict, params.Path)
+			}
 		}
 	}
-	if len(errPaths) > 0 {
-		return c.SendErrorResponse(msg, errPaths)
+	if err = os.MkdirAll(filepath.Dir(destPath), 0777); err != nil {
+		return fmt.Errorf("creating file directory: %w", err)
 	}
-	if err = c.SendDataResponse(msg, nil); err != nil {
-		log.Println("failed to send ws message:", err)
-		time.Sleep(10 * time.Millisecond)
-		return c.SendDataResponse(msg, nil)
+	f, err := os.CreateTemp(directory, "tmpfile-")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
 	}
-	return nil
+	_, err = f.Write(params.Content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && params.Mtime > 0 {
+		mtime := time.Unix(params.Mtime, 0)
+		err = os.Chtimes(f.Name(), mtime, mtime)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing to file: %w", err)
+	}
+	c.invalidateChecksums(destPath)
+	if err = replaceFile(f.Name(), destPath); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("renaming temporary file: %w", err)
+	}
+	stat, err := os.Stat(destPath)
+	if err != nil {
+		return err
+	}
+	hash, err := c.cachedChecksum(c.connectionContext(), destPath, stat.Size(), stat.ModTime().Unix())
+	if err != nil {
+		return fmt.Errorf("computing checksum: %w", err)
+	}
+	finfo := FileInfo{Path: params.Path, Hash: hash, Size: stat.Size(), Mtime: stat.ModTime().Unix()}
+	return c.SendDataResponse(msg, finfo)
+}
+
+type fileMetadataEntry struct {
+	FileInfo
+	Missing  bool   `json:"missing,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+// Returns information about given project files without walking the whole directory
+func (c *Client) handleFileMetadata(msg message) error {
+	var paths []string
+	if err := json.Unmarshal(msg.Data, &paths); err != nil {
+		return err
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	directory = filepath.FromSlash(directory)
+	entries := make([]fileMetadataEntry, len(paths))
+	for i, relPath := range paths {
+		entries[i].Path = relPath
+		absPath, err := resolveProjectPath(directory, relPath)
+		if err != nil {
+			entries[i].Error = err.Error()
+			entries[i].Category = errorCategory(err)
+			continue
+		}
+		stat, err := os.Stat(absPath)
+		if err != nil {
+			entries[i].Category = errorCategory(err)
+			if errors.Is(err, os.ErrNotExist) {
+				entries[i].Missing = true
+				entries[i].Error = "not found"
+			} else {
+				entries[i].Error = err.Error()
+			}
+			continue
+		}
+		if stat.IsDir() {
+			entries[i].Error = "not a file"
+			continue
+		}
+		entries[i].Size = stat.Size()
+		entries[i].Mtime = stat.ModTime().Unix()
+		hash, err := c.cachedChecksum(c.connectionContext(), absPath, entries[i].Size, entries[i].Mtime)
+		if err != nil {
+			entries[i].Error = err.Error()
+			continue
+		}
+		entries[i].Hash = hash
+	}
+	return c.SendDataResponse(msg, entries)
+}
+
+type diskUsagePayload struct {
+	Free  uint64 `json:"free"`
+	Total uint64 `json:"total"`
+}
+
+// Reports free and total space on the disk with project directory
+func (c *Client) handleDiskUsage(msg message) error {
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return c.SendErrorResponse(msg, "Failed to get project directory: "+err.Error())
+	}
+	free, total, err := DiskUsage(filepath.FromSlash(directory))
+	if err != nil {
+		return fmt.Errorf("reading disk usage: %w", err)
+	}
+	return c.SendDataResponse(msg, diskUsagePayload{Free: free, Total: total})
 }
 
 /* Normal methods */
 
+// Builds URL of server API endpoint from given path elements. Elements can consist
+// of multiple segments separated by '/' (e.g. relative file paths), every segment
+// is escaped separately.
+func (c *Client) apiURL(elem ...string) string {
+	u, err := url.Parse(c.Server)
+	if err != nil {
+		return c.Server + "/" + path.Join(elem...)
+	}
+	var segments, escaped []string
+	for _, e := range elem {
+		for _, s := range strings.Split(e, "/") {
+			if s != "" {
+				segments = append(segments, s)
+				escaped = append(escaped, url.PathEscape(s))
+			}
+		}
+	}
+	u.RawPath = strings.TrimRight(u.EscapedPath(), "/") + "/" + strings.Join(escaped, "/")
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.Join(segments, "/")
+	return u.String()
+}
+
+// Notifies server about renamed/moved project files
+func (c *Client) moveServerFiles(action, project string, files []RenameEntry) error {
+	data, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	url := c.apiURL("api/project", action, project)
+	resp, err := c.httpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		respData, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("server error %d: %s", resp.StatusCode, respData)
+	}
+	return nil
+}
+
 func (c *Client) login() error {
+	if c.Token != "" {
+		return nil
+	}
 	form := url.Values{"username": {c.User}, "password": {c.Password}}
 	url := fmt.Sprintf("%s/api/auth/login/", c.Server)
 	resp, err := c.httpClient.PostForm(url, form)
@@ -489,6 +2739,9 @@ func (c *Client) login() error {
 }
 
 func (c *Client) logout() error {
+	if c.Token != "" {
+		return nil
+	}
 	url := fmt.Sprintf("%s/api/auth/logout/", c.Server)
 	_, err := c.httpClient.Get(url)
 	if err != nil {
@@ -497,16 +2750,34 @@ func (c *Client) logout() error {
 	return nil
 }
 
-// Starts a websocket connection with server and handles incomming messages
+// Starts a websocket connection with server and handles incomming messages. With enabled
+// AutoReconnect, lost connection is re-established until Stop is called or reconnection
+// attempts are exhausted.
 func (c *Client) Start(OnConnectionEstabilished func()) error {
+	if err := c.configureTLS(); err != nil {
+		return err
+	}
+	c.connMutex.Lock()
+	c.state = StateConnecting
+	c.connMutex.Unlock()
+	established, stopped, err := c.connect(OnConnectionEstabilished)
+	c.recordError(err)
+	if err != nil || stopped || !c.AutoReconnect {
+		c.setState(StateDisconnected)
+		return err
+	}
+	return c.reconnect(OnConnectionEstabilished, established)
+}
+
+// Connects to the server and handles messages until the connection is closed. Returns
+// whether the connection was established and whether it was closed by Stop.
+func (c *Client) connect(OnConnectionEstabilished func()) (bool, bool, error) {
 	err := c.login()
 	if err != nil {
-		return err
+		return false, false, err
 	}
 	defer c.logout()
 
-	c.interrupt = make(chan int, 1)
-
 	u, _ := url.Parse(c.Server)
 	if u.Scheme == "https" {
 		u.Scheme = "wss"
@@ -516,34 +2787,52 @@ func (c *Client) Start(OnConnectionEstabilished func()) error {
 	u.Path = fmt.Sprintf("/ws/plugin")
 
 	dialer := websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: 30 * time.Second,
-		Jar:              c.httpClient.Jar,
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  30 * time.Second,
+		Jar:               c.httpClient.Jar,
+		EnableCompression: c.EnableCompression,
+		TLSClientConfig:   c.tlsConfig,
 	}
-	header := make(http.Header, 1)
+	header := make(http.Header, 2)
 	header.Set("User-Agent", c.ClientInfo)
-	wsConn, _, err := dialer.Dial(u.String(), header)
+	if c.Token != "" {
+		header.Set("Authorization", "Token "+c.Token)
+	}
+	wsConn, resp, err := dialer.Dial(u.String(), header)
 	if err != nil {
-		return err
+		return false, false, err
 	}
+	if c.EnableCompression && strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		wsConn.EnableWriteCompression(true)
+	}
+	c.setState(StateConnected)
 	if OnConnectionEstabilished != nil {
 		OnConnectionEstabilished()
 	}
 
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	c.connMutex.Lock()
 	c.wsConn = wsConn
+	c.connCtx = connCtx
+	c.connMutex.Unlock()
 	defer wsConn.Close()
-
-	// dbhash detection
-	cmdName := "dbhash"
-	if runtime.GOOS == "windows" {
-		cmdName += ".exe"
-	}
-	c.dbhashCmd, err = exec.LookPath(cmdName)
-	if err != nil {
-		localCmd, _ := filepath.Abs(cmdName)
-		c.dbhashCmd, err = exec.LookPath(localCmd)
+	defer cancelConn()
+	if c.MaxMessageSize > 0 {
+		wsConn.SetReadLimit(c.MaxMessageSize)
 	}
+	stopWriter := c.startWriter(wsConn)
+	defer stopWriter()
+	c.setConnected(true)
+	defer c.setConnected(false)
+
+	c.DetectTools()
 	done := make(chan struct{})
+	// limits number of concurrently running message handlers
+	maxHandlers := c.MaxConcurrentHandlers
+	if maxHandlers < 1 {
+		maxHandlers = 1
+	}
+	handlerSlots := make(chan struct{}, maxHandlers)
 
 	go func() {
 		defer close(done)
@@ -553,7 +2842,11 @@ func (c *Client) Start(OnConnectionEstabilished func()) error {
 		for {
 			_, rawMessage, err := wsConn.ReadMessage()
 			if err != nil {
-				log.Println("WS read error:", err)
+				if errors.Is(err, websocket.ErrReadLimit) {
+					log.Printf("WS read error: received message exceeds the limit of %d bytes (MaxMessageSize)\n", c.MaxMessageSize)
+				} else {
+					log.Println("WS read error:", err)
+				}
 				return
 			}
 			var msg message
@@ -561,16 +2854,32 @@ func (c *Client) Start(OnConnectionEstabilished func()) error {
 				log.Printf("Invalid message: %s\n", rawMessage)
 				continue
 			}
-			// log.Println("Msg type: ", msg.Type)
-			// log.Printf("Received: %s\n", message)
+			if c.resolvePendingRequest(msg) {
+				continue
+			}
 			msgHandler, ok := c.messageHandlers[msg.Type]
-			if ok {
+			if ok && inlineMessages[msg.Type] {
+				// cheap control messages are handled by the reader, so they are not blocked
+				// by busy handlers
 				if err := msgHandler(msg); err != nil {
 					log.Println(err)
-					c.SendErrorResponse(msg, err.Error())
+					c.sendHandlerError(msg, err)
 				}
 				continue
 			}
+			// log.Println("Msg type: ", msg.Type)
+			// log.Printf("Received: %s\n", message)
+			if ok {
+				handlerSlots <- struct{}{}
+				go func(msg message) {
+					defer func() { <-handlerSlots }()
+					if err := msgHandler(msg); err != nil {
+						log.Println(err)
+						c.sendHandlerError(msg, err)
+					}
+				}(msg)
+				continue
+			}
 			// possible issue if executed in different thread?
 			resp := c.OnMessageCallback(rawMessage)
 			if resp != "" {
@@ -581,30 +2890,38 @@ func (c *Client) Start(OnConnectionEstabilished func()) error {
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	// running downloads would be useless without connection, cancel them to clean up temporary files
+	defer c.CancelFetch()
+	defer c.cancelPendingRequests()
 
 	for {
 		select {
 		case <-done:
-			return nil
+			return true, false, nil
 		case <-c.interrupt:
 			// Cleanly close the connection by sending a close message and then
 			// waiting (with timeout) for the server to close the connection.
 			err := c.SendRawMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
 				log.Println("WS sending close message:", err)
-				return nil
+				return true, true, nil
 			}
 			select {
 			case <-done:
 			case <-time.After(3 * time.Second):
 				log.Println("stop timeout")
 			}
-			return nil
+			return true, true, nil
 		}
 	}
 }
 
-// Closes websocket connection
+// Closes websocket connection, can be called also while Start is in progress
 func (c *Client) Stop() {
-	c.interrupt <- 1
+	c.releaseProjectLocks()
+	select {
+	case c.interrupt <- 1:
+	default:
+		// stop was already requested
+	}
 }
@@ -0,0 +1,450 @@
+package gisquick
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApiURL(t *testing.T) {
+	tests := []struct {
+		server   string
+		file     string
+		expected string
+	}{
+		{"https://example.com", "plot plan (v2).qgs", "https://example.com/api/project/file/user/project/plot%20plan%20%28v2%29.qgs"},
+		{"https://example.com", "data/50%_sample.csv", "https://example.com/api/project/file/user/project/data/50%25_sample.csv"},
+		{"https://example.com", "a#b?c.gpkg", "https://example.com/api/project/file/user/project/a%23b%3Fc.gpkg"},
+		{"https://example.com", "mapy/kůň.tif", "https://example.com/api/project/file/user/project/mapy/k%C5%AF%C5%88.tif"},
+		{"https://example.com/gisquick/", "plot plan (v2).qgs", "https://example.com/gisquick/api/project/file/user/project/plot%20plan%20%28v2%29.qgs"},
+		{"https://example.com/my%20server", "data/50%_sample.csv", "https://example.com/my%20server/api/project/file/user/project/data/50%25_sample.csv"},
+	}
+	for _, tt := range tests {
+		c := NewClient(tt.server, "user", "")
+		if url := c.apiURL("api/project/file", "user/project", tt.file); url != tt.expected {
+			t.Errorf("apiURL for %q on %s: got %s, expected %s", tt.file, tt.server, url, tt.expected)
+		}
+	}
+}
+
+// Creates files with given content in the directory
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns staging directories of atomic delete left in the project directory
+func stagingDirs(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, ".gisquick", deleteStagingPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestDeleteAtomic(t *testing.T) {
+	c := NewClient("http://localhost", "user", "")
+
+	t.Run("all files are deleted", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"a.csv": "a", "data/b.csv": "b", "keep.csv": "keep"})
+		deleted, failed, err := c.deleteAtomic(dir, DeleteFilesRequest{Files: []string{"a.csv", "data", "missing.csv"}}, "")
+		if err != nil || len(failed) != 0 {
+			t.Fatalf("unexpected errors: %v %v", err, failed)
+		}
+		if len(deleted) != 2 || deleted[0].Path != "a.csv" || deleted[1].Path != "data" || deleted[1].Children != 1 {
+			t.Errorf("unexpected deleted entries: %+v", deleted)
+		}
+		for _, name := range []string{"a.csv", "data"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("%s was not deleted", name)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "keep.csv")); err != nil {
+			t.Error(err)
+		}
+		if dirs := stagingDirs(t, dir); len(dirs) != 0 {
+			t.Errorf("staging directories were not removed: %v", dirs)
+		}
+	})
+
+	t.Run("deleted files are restored on conflict", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"a.csv": "a", "data/b.csv": "b", "c.csv": "c"})
+		params := DeleteFilesRequest{
+			Files:  []string{"a.csv", "data", "c.csv"},
+			Hashes: map[string]string{"c.csv": "0000000000000000000000000000000000000000"},
+		}
+		deleted, failed, err := c.deleteAtomic(dir, params, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 0 || len(failed) != 1 || failed[0].Path != "c.csv" {
+			t.Fatalf("unexpected result: %+v %+v", deleted, failed)
+		}
+		for name, content := range map[string]string{"a.csv": "a", "data/b.csv": "b", "c.csv": "c"} {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil || string(data) != content {
+				t.Errorf("%s was not restored: %v", name, err)
+			}
+		}
+		if dirs := stagingDirs(t, dir); len(dirs) != 0 {
+			t.Errorf("staging directories were not removed: %v", dirs)
+		}
+	})
+
+	t.Run("path outside of the project is forbidden", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"a.csv": "a"})
+		_, failed, err := c.deleteAtomic(dir, DeleteFilesRequest{Files: []string{"a.csv", "../a.csv"}}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failed) != 1 || failed[0].Path != "../a.csv" || failed[0].Category != "forbidden" {
+			t.Fatalf("unexpected errors: %+v", failed)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "a.csv")); err != nil {
+			t.Errorf("deleted file was not restored: %v", err)
+		}
+	})
+
+	t.Run("deleted files are moved into trash", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"data/b.csv": "b"})
+		if _, failed, err := c.deleteAtomic(dir, DeleteFilesRequest{Files: []string{"data/b.csv"}}, "trash-1"); err != nil || len(failed) != 0 {
+			t.Fatalf("unexpected errors: %v %v", err, failed)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, trashDir, "trash-1", "data", "b.csv")); err != nil || string(data) != "b" {
+			t.Errorf("file was not moved into trash: %v", err)
+		}
+		if dirs := stagingDirs(t, dir); len(dirs) != 0 {
+			t.Errorf("staging directories were not removed: %v", dirs)
+		}
+	})
+
+	t.Run("concurrent operations use own staging directories", func(t *testing.T) {
+		dir := t.TempDir()
+		var wg sync.WaitGroup
+		errs := make([]error, 20)
+		for i := range errs {
+			name := fmt.Sprintf("data/%d.csv", i)
+			writeFiles(t, dir, map[string]string{name: name})
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, failed, err := c.deleteAtomic(dir, DeleteFilesRequest{Files: []string{name}}, "")
+				if err == nil && len(failed) > 0 {
+					err = errors.New(failed[0].Error)
+				}
+				errs[i] = err
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("deleting file %d: %v", i, err)
+			}
+		}
+		if entries, _ := os.ReadDir(filepath.Join(dir, "data")); len(entries) != 0 {
+			t.Errorf("%d files were not deleted", len(entries))
+		}
+		if dirs := stagingDirs(t, dir); len(dirs) != 0 {
+			t.Errorf("staging directories were not removed: %v", dirs)
+		}
+	})
+}
+
+// Staging directories kept after failed operations are swept as stale temporary files
+func TestSweepStaleStagingDirs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".gisquick/" + deleteStagingPrefix + "old/a.csv": "a",
+		".gisquick/" + deleteStagingPrefix + "new/b.csv": "b",
+	})
+	stale := time.Now().Add(-2 * staleTempFileAge)
+	if err := os.Chtimes(filepath.Join(dir, ".gisquick", deleteStagingPrefix+"old"), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("http://localhost", "user", "")
+	c.sweepTempFiles(dir)
+	dirs := stagingDirs(t, dir)
+	if len(dirs) != 1 || filepath.Base(dirs[0]) != deleteStagingPrefix+"new" {
+		t.Errorf("unexpected staging directories after sweep: %v", dirs)
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	dir := t.TempDir()
+	_, outsideErr := resolveProjectPath(dir, "../data.csv")
+	_, notFoundErr := os.Stat(filepath.Join(dir, "data.csv"))
+	tests := []struct {
+		err      error
+		category string
+	}{
+		{outsideErr, "forbidden"},
+		{fmt.Errorf("deleting file: %w", outsideErr), "forbidden"},
+		{notFoundErr, "not-found"},
+		{ErrDeleteConflict, "conflict"},
+		{errors.New("disk failure"), "other"},
+	}
+	for _, tt := range tests {
+		if category := errorCategory(tt.err); category != tt.category {
+			t.Errorf("category of %q: got %s, expected %s", tt.err, category, tt.category)
+		}
+	}
+}
+
+func TestPruneEmptyParents(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a/x.csv":       "x",
+		"a/b/y.csv":     "y",
+		"a/b/c/z.csv":   "z",
+		"keep/x.csv":    "x",
+		"keep/.ignored": "ignored",
+	})
+	var deleted []deletedEntry
+	// parent directories are deleted before their subdirectories
+	for _, name := range []string{"a/x.csv", "a/b/y.csv", "a/b/c/z.csv", "keep/x.csv"} {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+		deleted = append(deleted, deletedEntry{Path: name, relPath: name})
+	}
+	pruned := pruneEmptyParents(dir, deleted)
+	var prunedPaths []string
+	for _, entry := range pruned {
+		prunedPaths = append(prunedPaths, entry.Path)
+	}
+	if fmt.Sprint(prunedPaths) != "[a/b/c a/b a]" {
+		t.Errorf("unexpected pruned directories: %v", prunedPaths)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep")); err != nil {
+		t.Errorf("directory with hidden file was removed: %v", err)
+	}
+}
+
+// Redirects messages sent by the client into returned channel instead of the websocket
+func captureMessages(c *Client) <-chan genericResponse {
+	queue := make(chan outgoingMessage, 100)
+	c.connMutex.Lock()
+	c.sendQueue, c.sendStop = queue, make(chan struct{})
+	c.connMutex.Unlock()
+	c.SendNonBlocking = true
+	messages := make(chan genericResponse, 100)
+	go func() {
+		for msg := range queue {
+			var resp genericResponse
+			json.Unmarshal(msg.data, &resp)
+			messages <- resp
+		}
+	}()
+	return messages
+}
+
+func TestAbortUpload(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer srv.Close()
+	defer close(stop)
+	c := NewClient(srv.URL, "user", "")
+	messages := captureMessages(c)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"data.csv": "data"})
+	c.setProjectDirectory(dir)
+
+	data, _ := json.Marshal(FilesParam{Project: "user/project", Directory: dir, Files: []FileInfo{{Path: "data.csv"}}})
+	if err := c.handleUploadFiles(message{Type: "UploadFiles", ID: "upload-1", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleAbortUpload(message{Type: "AbortUpload"}); err != nil {
+		t.Fatal(err)
+	}
+	notified := false
+	for {
+		select {
+		case msg := <-messages:
+			if msg.Type == "UploadAborted" {
+				notified = fmt.Sprint(msg.Data) == "map[project:user/project]"
+			}
+			if msg.ID != "upload-1" {
+				continue
+			}
+			summary, _ := msg.Data.(map[string]interface{})
+			if msg.Status != 200 || summary["aborted"] != true {
+				t.Errorf("unexpected response of aborted upload: %+v", msg)
+			}
+			if !notified {
+				t.Error("server was not notified about aborted upload")
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response of aborted upload")
+		}
+	}
+}
+
+// Quota errors of the upload are sent with the status code of the server response
+func TestUploadQuotaError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte(`{"detail": "Storage quota exceeded", "limit": 1000, "used": 900, "needed": 200}`))
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "user", "")
+	messages := captureMessages(c)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"data.csv": "data"})
+	c.setProjectDirectory(dir)
+
+	data, _ := json.Marshal(FilesParam{Project: "user/project", Directory: dir, Files: []FileInfo{{Path: "data.csv"}}})
+	if err := c.handleUploadFiles(message{Type: "UploadFiles", ID: "upload-1", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case msg := <-messages:
+			if msg.ID != "upload-1" {
+				continue
+			}
+			quota, _ := msg.Data.(map[string]interface{})
+			if msg.Status != http.StatusInsufficientStorage || quota["code"] != "quota_exceeded" || quota["needed"] != 200.0 {
+				t.Errorf("unexpected response: %+v", msg)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response of failed upload")
+		}
+	}
+}
+
+// Other upload errors are sent in the error response of the request
+func TestUploadServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, "server failure", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "user", "")
+	messages := captureMessages(c)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"data.csv": "data"})
+	c.setProjectDirectory(dir)
+
+	data, _ := json.Marshal(FilesParam{Project: "user/project", Directory: dir, Files: []FileInfo{{Path: "data.csv"}}})
+	if err := c.handleUploadFiles(message{Type: "UploadFiles", ID: "upload-1", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case msg := <-messages:
+			if msg.ID != "upload-1" {
+				continue
+			}
+			if msg.Status != 500 || msg.Type != "UploadFiles" || msg.Data != "server failure\n" {
+				t.Errorf("unexpected response: %+v", msg)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response of failed upload")
+		}
+	}
+}
+
+func TestDropNestedPaths(t *testing.T) {
+	paths := []string{"data/b.csv", "data", "a.csv", "./a.csv", "data/sub/c.csv", "database.csv", "other/x.csv"}
+	if result := fmt.Sprint(dropNestedPaths(paths)); result != "[data a.csv database.csv other/x.csv]" {
+		t.Errorf("unexpected paths: %s", result)
+	}
+}
+
+// Plugin callbacks which don't return are limited, further requests fail immediately
+func TestPropagateMessageBusy(t *testing.T) {
+	c := NewClient("http://localhost", "user", "")
+	c.RequestTimeout = 10 * time.Millisecond
+	release := make(chan struct{})
+	c.OnMessageCallback = func(msg []byte) string {
+		<-release
+		return `{"type": "PluginStatus", "status": 200}`
+	}
+	for i := 0; i < maxPluginCalls; i++ {
+		if _, err := c.propagateMessage("PluginStatus", nil); !errors.Is(err, ErrRequestTimeout) {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+	}
+	if _, err := c.propagateMessage("PluginStatus", nil); !errors.Is(err, ErrPluginBusy) {
+		t.Fatalf("expected busy plugin error, got %v", err)
+	}
+	close(release)
+	c.RequestTimeout = 5 * time.Second
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msg, err := c.propagateMessage("PluginStatus", nil)
+		if err == nil {
+			if msg.Status != 200 {
+				t.Errorf("unexpected response: %+v", msg)
+			}
+			break
+		}
+		if !errors.Is(err, ErrPluginBusy) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Local renames are reverted when the server rejects them
+func TestMoveFilesServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rename failed", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "user", "")
+	c.ServerCapabilities.Features = []string{"rename_files"}
+	dir := t.TempDir()
+	c.setProjectDirectory(dir)
+	writeFiles(t, dir, map[string]string{"a.csv": "a", "b.csv": "b", "data/c.csv": "c"})
+
+	data, _ := json.Marshal(RenameFilesRequest{
+		Project:   "user/project",
+		Directory: dir,
+		Overwrite: true,
+		Files:     []RenameEntry{{From: "a.csv", To: "b.csv"}, {From: "data", To: "moved/data"}},
+	})
+	if err := c.moveFiles(message{Type: "RenameFiles", ID: "1", Data: data}, "rename"); err == nil {
+		t.Fatal("expected server error")
+	}
+	expected := map[string]string{"a.csv": "a", "b.csv": "b", "data/c.csv": "c"}
+	for name, content := range expected {
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || string(data) != content {
+			t.Errorf("%s: got %q (%v), expected %q", name, data, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved", "data")); !os.IsNotExist(err) {
+		t.Error("renamed directory was not reverted")
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, ".gisquick", "rename-*")); len(staged) != 0 {
+		t.Errorf("backup directory was not removed: %v", staged)
+	}
+}
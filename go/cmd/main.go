@@ -18,21 +18,42 @@ static inline void call_success_callback(success_callback ptr) {
 */
 import "C"
 import (
+	"encoding/json"
 	"log"
 	"runtime"
+	"sync"
 	"unsafe"
 
 	gisquick "github.com/gisquick/gisquick-qgis-plugin/go"
-	"github.com/gorilla/websocket"
 )
 
-var c *gisquick.Client
+// Exported functions can be called from any thread, access to the client is guarded by mutex
+var (
+	c           *gisquick.Client
+	dbhashPath  string
+	clientMutex sync.Mutex
+	// last started client, kept after Stop to report its final status
+	lastClient *gisquick.Client
+)
+
+// Returns running client or nil
+func runningClient() *gisquick.Client {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	return c
+}
 
 //export Start
 func Start(url, user, password, clientInfo string, fn C.message_callback, success C.success_callback) int {
-	c = gisquick.NewClient(url, user, password)
-	c.ClientInfo = clientInfo
-	c.OnMessageCallback = func(message []byte) string {
+	// copy, memory of the string arguments is owned by the caller
+	client := gisquick.NewClient(string([]byte(url)), string([]byte(user)), string([]byte(password)))
+	client.ClientInfo = string([]byte(clientInfo))
+	clientMutex.Lock()
+	client.DbhashPath = dbhashPath
+	c = client
+	lastClient = client
+	clientMutex.Unlock()
+	client.OnMessageCallback = func(message []byte) string {
 		cmsg := C.CString(string(message))
 		defer C.free(unsafe.Pointer(cmsg))
 		resp := C.call_message_callback(fn, cmsg)
@@ -44,30 +65,96 @@ func Start(url, user, password, clientInfo string, fn C.message_callback, succes
 	onConnectionEstabilished := func() {
 		C.call_success_callback(success)
 	}
-	if err := c.Start(onConnectionEstabilished); err != nil {
-		log.Println(err.Error())
+	err := client.Start(onConnectionEstabilished)
+	clientMutex.Lock()
+	if c == client {
 		c = nil
-		runtime.GC()
-		return 1
 	}
+	clientMutex.Unlock()
 	runtime.GC()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
 	return 0
 }
 
 //export Stop
 func Stop() {
-	if c != nil {
-		c.Stop()
-		c = nil
+	clientMutex.Lock()
+	client := c
+	c = nil
+	clientMutex.Unlock()
+	if client != nil {
+		client.Stop()
+	}
+}
+
+//export SetDbhashPath
+func SetDbhashPath(path string) int {
+	// copy, memory of the string argument is owned by the caller
+	clientMutex.Lock()
+	dbhashPath = string([]byte(path))
+	client := c
+	clientMutex.Unlock()
+	if client != nil {
+		if err := client.SetDbhashPath(dbhashPath); err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+	}
+	return 0
+}
+
+//export IsConnected
+func IsConnected() int {
+	if client := runningClient(); client != nil && client.IsConnected() {
+		return 1
+	}
+	return 0
+}
+
+// Returns JSON encoded status of the client (connection state, server, user, uptime,
+// last error and counts of running operations). The string must be released with FreeString.
+//
+//export GetStatus
+func GetStatus() *C.char {
+	clientMutex.Lock()
+	client := lastClient
+	clientMutex.Unlock()
+	status := gisquick.ClientStatus{State: gisquick.StateDisconnected}
+	if client != nil {
+		status = client.Status()
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Failed to encode status: %s\n", err)
+		data = []byte("{}")
+	}
+	return C.CString(string(data))
+}
+
+// Releases string returned from GetStatus
+//
+//export FreeString
+func FreeString(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+//export CancelFetch
+func CancelFetch() {
+	if client := runningClient(); client != nil {
+		client.CancelFetch()
 	}
 }
 
 //export SendMessage
 func SendMessage(msg string) {
-	if c == nil {
+	client := runningClient()
+	if client == nil {
 		return
 	}
-	if err := c.SendRawMessage(websocket.TextMessage, []byte(msg)); err != nil {
+	if err := client.SendPluginMessage([]byte(msg)); err != nil {
 		log.Printf("Failed to send WS message: %s\n", err)
 		return
 	}
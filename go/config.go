@@ -0,0 +1,288 @@
+package gisquick
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration which can be specified in configuration file as a string (e.g. "30s", "5m")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type TLSConfig struct {
+	// Disables verification of server certificate (only for testing)
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// PEM file with additional trusted CA certificates
+	CAFile string `json:"ca_file"`
+	// PEM files with client certificate and private key (mutual TLS)
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// SHA-256 fingerprint of the server certificate, only this certificate is accepted
+	PinnedCertSHA256 string `json:"pinned_cert_sha256"`
+}
+
+// Sizes of worker pools, unset values fall back to defaults (see Concurrency)
+type ConcurrencyConfig struct {
+	Hash   int `json:"hash"`
+	Upload int `json:"upload"`
+	Fetch  int `json:"fetch"`
+	Delete int `json:"delete"`
+}
+
+// Client configuration, unset values fall back to defaults
+type Config struct {
+	Server     string `json:"server"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	Token      string `json:"token"`
+	ClientInfo string `json:"client_info"`
+
+	// Deprecated: use concurrency.hash
+	ChecksumWorkers       int      `json:"checksum_workers"`
+	MaxConcurrentHandlers int      `json:"max_concurrent_handlers"`
+	MaxMessageSize        int64    `json:"max_message_size"`
+	FetchIdleTimeout      Duration `json:"fetch_idle_timeout"`
+	FetchTimeout          Duration `json:"fetch_timeout"`
+	RequestTimeout        Duration `json:"request_timeout"`
+	EnableCompression     *bool    `json:"enable_compression"`
+	SoftDelete            *bool    `json:"soft_delete"`
+	HashAlgorithm         string   `json:"hash_algorithm"`
+	SymlinkPolicy         string   `json:"symlink_policy"`
+	DbhashPath            string   `json:"dbhash_path"`
+	// Permissions of created directories as octal string (e.g. "0755")
+	DirMode string `json:"dir_mode"`
+	// Patterns of temporary files (gitignore syntax), replace the default patterns
+	TemporaryPatterns []string `json:"temporary_patterns"`
+	// Regular expression of temporary files, replaces the temporary file patterns
+	ExcludePattern string `json:"exclude_pattern"`
+	// Size limit of hashed files in bytes (zero means no limit)
+	MaxHashSize *int64 `json:"max_hash_size"`
+	// Limits of the project directory scan of ProjectFiles request (zero means no limit)
+	MaxScanFiles *int   `json:"max_scan_files"`
+	MaxScanSize  *int64 `json:"max_scan_size"`
+
+	AutoReconnect        *bool    `json:"auto_reconnect"`
+	MaxReconnectAttempts int      `json:"max_reconnect_attempts"`
+	ReconnectBaseDelay   Duration `json:"reconnect_base_delay"`
+	MaxReconnectDelay    Duration `json:"max_reconnect_delay"`
+	// Random variation of reconnection delays as a fraction of the delay (0-1)
+	ReconnectJitter *float64 `json:"reconnect_jitter"`
+	// Additional ignore rules (.gitignore syntax) applied together with .gisquickignore file
+	IgnorePatterns []string          `json:"ignore"`
+	Concurrency    ConcurrencyConfig `json:"concurrency"`
+	TLS            TLSConfig         `json:"tls"`
+}
+
+// Reads client configuration from JSON file
+func LoadConfig(path string) (*Config, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		return nil, errors.New("YAML configuration is not supported, use JSON file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing configuration file: %w", err)
+	}
+	if cfg.Server == "" {
+		return nil, errors.New("server URL is not configured")
+	}
+	return &cfg, nil
+}
+
+// Creates TLS configuration for connections to the server
+func (t TLSConfig) build() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file: %s", t.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// Creates a new Gisquick plugin client with given configuration
+func NewClientFromConfig(cfg *Config) (*Client, error) {
+	c := NewClient(cfg.Server, cfg.User, cfg.Password)
+	c.Token = cfg.Token
+	if cfg.ClientInfo != "" {
+		c.ClientInfo = cfg.ClientInfo
+	}
+	if cfg.ChecksumWorkers > 0 {
+		c.Concurrency.Hash = cfg.ChecksumWorkers
+	}
+	if cfg.Concurrency.Hash != 0 {
+		c.Concurrency.Hash = cfg.Concurrency.Hash
+	}
+	if cfg.Concurrency.Upload != 0 {
+		c.Concurrency.Upload = cfg.Concurrency.Upload
+	}
+	if cfg.Concurrency.Fetch != 0 {
+		c.Concurrency.Fetch = cfg.Concurrency.Fetch
+	}
+	if cfg.Concurrency.Delete != 0 {
+		c.Concurrency.Delete = cfg.Concurrency.Delete
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxConcurrentHandlers > 0 {
+		c.MaxConcurrentHandlers = cfg.MaxConcurrentHandlers
+	}
+	if cfg.MaxMessageSize > 0 {
+		c.MaxMessageSize = cfg.MaxMessageSize
+	}
+	if cfg.FetchIdleTimeout > 0 {
+		c.FetchIdleTimeout = time.Duration(cfg.FetchIdleTimeout)
+	}
+	if cfg.FetchTimeout > 0 {
+		c.FetchTimeout = time.Duration(cfg.FetchTimeout)
+	}
+	if cfg.RequestTimeout > 0 {
+		c.RequestTimeout = time.Duration(cfg.RequestTimeout)
+	}
+	if cfg.EnableCompression != nil {
+		c.EnableCompression = *cfg.EnableCompression
+	}
+	if cfg.SoftDelete != nil {
+		c.SoftDelete = *cfg.SoftDelete
+	}
+	if cfg.HashAlgorithm != "" {
+		if cfg.HashAlgorithm != HashSHA1 && cfg.HashAlgorithm != HashSHA256 {
+			return nil, fmt.Errorf("unsupported hash algorithm: %s", cfg.HashAlgorithm)
+		}
+		c.HashAlgorithm = cfg.HashAlgorithm
+	}
+	if cfg.SymlinkPolicy != "" {
+		switch cfg.SymlinkPolicy {
+		case SymlinkSkip, SymlinkFollow, SymlinkError:
+			c.SymlinkPolicy = cfg.SymlinkPolicy
+		default:
+			return nil, fmt.Errorf("invalid symlink policy: %s", cfg.SymlinkPolicy)
+		}
+	}
+	if cfg.DirMode != "" {
+		mode, err := strconv.ParseUint(cfg.DirMode, 8, 32)
+		if err != nil || mode&^uint64(os.ModePerm) != 0 {
+			return nil, fmt.Errorf("invalid dir_mode: %s", cfg.DirMode)
+		}
+		c.DirMode = os.FileMode(mode)
+	}
+	c.IgnorePatterns = cfg.IgnorePatterns
+	c.DbhashPath = cfg.DbhashPath
+	if cfg.TemporaryPatterns != nil {
+		if _, err := compileTemporaryPatterns(cfg.TemporaryPatterns); err != nil {
+			return nil, fmt.Errorf("invalid temporary_patterns: %w", err)
+		}
+		c.TemporaryPatterns = cfg.TemporaryPatterns
+	}
+	if cfg.ExcludePattern != "" {
+		pattern, err := regexp.Compile(cfg.ExcludePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+		}
+		c.ExcludePattern = pattern
+	}
+	if cfg.MaxHashSize != nil {
+		if *cfg.MaxHashSize < 0 {
+			return nil, fmt.Errorf("invalid max_hash_size: %d", *cfg.MaxHashSize)
+		}
+		c.MaxHashSize = *cfg.MaxHashSize
+	}
+	if cfg.MaxScanFiles != nil {
+		c.MaxScanFiles = *cfg.MaxScanFiles
+	}
+	if cfg.MaxScanSize != nil {
+		c.MaxScanSize = *cfg.MaxScanSize
+	}
+	if cfg.AutoReconnect != nil {
+		c.AutoReconnect = *cfg.AutoReconnect
+	}
+	if cfg.MaxReconnectAttempts > 0 {
+		c.MaxReconnectAttempts = cfg.MaxReconnectAttempts
+	}
+	if cfg.ReconnectBaseDelay > 0 {
+		c.ReconnectBaseDelay = time.Duration(cfg.ReconnectBaseDelay)
+	}
+	if cfg.MaxReconnectDelay > 0 {
+		c.MaxReconnectDelay = time.Duration(cfg.MaxReconnectDelay)
+	}
+	if cfg.ReconnectJitter != nil {
+		if *cfg.ReconnectJitter < 0 || *cfg.ReconnectJitter > 1 {
+			return nil, fmt.Errorf("invalid reconnect_jitter: %v", *cfg.ReconnectJitter)
+		}
+		c.ReconnectJitter = *cfg.ReconnectJitter
+	}
+	if cfg.TLS.InsecureSkipVerify || cfg.TLS.CAFile != "" {
+		tlsConfig, err := cfg.TLS.build()
+		if err != nil {
+			return nil, err
+		}
+		c.setTLSConfig(tlsConfig)
+	}
+	c.ClientCertFile = cfg.TLS.CertFile
+	c.ClientKeyFile = cfg.TLS.KeyFile
+	c.PinnedCertSHA256 = cfg.TLS.PinnedCertSHA256
+	return c, nil
+}
+
+// Adds token authorization header to requests when the client is configured with token
+// and logs requests in debug mode. The header is sent only to the configured server,
+// so it doesn't leak when a request is redirected to another host.
+type authTransport struct {
+	base   http.RoundTripper
+	client *Client
+}
+
+// Reports whether the request targets the configured server
+func (t *authTransport) isServerRequest(req *http.Request) bool {
+	server, err := url.Parse(t.client.Server)
+	return err == nil && strings.EqualFold(req.URL.Host, server.Host)
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.client.Token != "" && t.isServerRequest(req) {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Token "+t.client.Token)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if t.client.Debug {
+		logHTTP(req, resp, err)
+	}
+	return resp, err
+}
@@ -0,0 +1,541 @@
+package gisquick
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Pure Go implementation of the SQLite dbhash tool (hash of the database content and schema,
+// independent on the physical layout of the database file). Only a subset of the SQLite file
+// format needed for GeoPackage files is supported, an error is returned for unsupported
+// databases (e.g. with uncommitted WAL file or WITHOUT ROWID tables).
+
+var errDbhashUnsupported = errors.New("unsupported database for built-in dbhash")
+
+type sqliteFile struct {
+	file       *os.File
+	pageSize   int
+	usableSize int
+	ctx        context.Context
+	// number of read bytes is reported to progress function when specified
+	read     int64
+	progress func(read int64)
+}
+
+// Reads SQLite variable-length integer, returns value and number of bytes read
+func readVarint(buf []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 8 && i < len(buf); i++ {
+		v = (v << 7) | uint64(buf[i]&0x7f)
+		if buf[i] < 0x80 {
+			return int64(v), i + 1
+		}
+	}
+	if len(buf) < 9 {
+		return int64(v), len(buf)
+	}
+	return int64((v << 8) | uint64(buf[8])), 9
+}
+
+func openSqliteFile(path string) (*sqliteFile, error) {
+	if info, err := os.Stat(path + "-wal"); err == nil && info.Size() > 0 {
+		return nil, fmt.Errorf("%w: database has WAL file", errDbhashUnsupported)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(file, header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading database header: %w", err)
+	}
+	if string(header[:16]) != "SQLite format 3\x00" {
+		file.Close()
+		return nil, errors.New("not a SQLite database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	encoding := binary.BigEndian.Uint32(header[56:60])
+	if encoding != 1 {
+		file.Close()
+		return nil, fmt.Errorf("%w: text encoding is not UTF-8", errDbhashUnsupported)
+	}
+	return &sqliteFile{file: file, pageSize: pageSize, usableSize: pageSize - int(header[20]), ctx: context.Background()}, nil
+}
+
+func (db *sqliteFile) Close() error {
+	return db.file.Close()
+}
+
+func (db *sqliteFile) readPage(n uint32) ([]byte, error) {
+	if n == 0 {
+		return nil, errors.New("invalid page number")
+	}
+	if err := db.ctx.Err(); err != nil {
+		return nil, err
+	}
+	page := make([]byte, db.pageSize)
+	if _, err := db.file.ReadAt(page, int64(n-1)*int64(db.pageSize)); err != nil {
+		return nil, fmt.Errorf("reading page %d: %w", n, err)
+	}
+	db.read += int64(db.pageSize)
+	if db.progress != nil {
+		db.progress(db.read)
+	}
+	return page, nil
+}
+
+// Reads cell payload including content stored in overflow pages
+func (db *sqliteFile) readPayload(page []byte, offset int, size int64) ([]byte, error) {
+	u := int64(db.usableSize)
+	x := u - 35
+	local := size
+	if size > x {
+		m := ((u-12)*32/255 - 23)
+		k := m + ((size - m) % (u - 4))
+		if k <= x {
+			local = k
+		} else {
+			local = m
+		}
+	}
+	if offset+int(local) > len(page) {
+		return nil, errors.New("corrupted cell")
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, page[offset:offset+int(local)]...)
+	if local == size {
+		return payload, nil
+	}
+	next := binary.BigEndian.Uint32(page[offset+int(local):])
+	for int64(len(payload)) < size {
+		overflow, err := db.readPage(next)
+		if err != nil {
+			return nil, err
+		}
+		next = binary.BigEndian.Uint32(overflow[:4])
+		n := size - int64(len(payload))
+		if n > u-4 {
+			n = u - 4
+		}
+		payload = append(payload, overflow[4:4+n]...)
+	}
+	return payload, nil
+}
+
+// Traverses table b-tree and calls fn for every row in rowid order
+func (db *sqliteFile) walkTable(root uint32, fn func(rowid int64, payload []byte) error) error {
+	page, err := db.readPage(root)
+	if err != nil {
+		return err
+	}
+	hdr := 0
+	if root == 1 {
+		hdr = 100
+	}
+	pageType := page[hdr]
+	numCells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	switch pageType {
+	case 0x05: // interior table page
+		for i := 0; i < numCells; i++ {
+			cell := int(binary.BigEndian.Uint16(page[hdr+12+2*i:]))
+			if err := db.walkTable(binary.BigEndian.Uint32(page[cell:]), fn); err != nil {
+				return err
+			}
+		}
+		return db.walkTable(binary.BigEndian.Uint32(page[hdr+8:]), fn)
+	case 0x0d: // leaf table page
+		for i := 0; i < numCells; i++ {
+			cell := int(binary.BigEndian.Uint16(page[hdr+8+2*i:]))
+			size, n1 := readVarint(page[cell:])
+			rowid, n2 := readVarint(page[cell+n1:])
+			payload, err := db.readPayload(page, cell+n1+n2, size)
+			if err != nil {
+				return err
+			}
+			if err := fn(rowid, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unexpected b-tree page type %d", errDbhashUnsupported, pageType)
+}
+
+// Decodes record into values (nil, int64, float64, string or []byte)
+func decodeRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := readVarint(payload)
+	if headerSize > int64(len(payload)) {
+		return nil, errors.New("corrupted record")
+	}
+	var values []interface{}
+	pos := int(headerSize)
+	for i := n; i < int(headerSize); {
+		serialType, n := readVarint(payload[i:])
+		i += n
+		var size int
+		switch {
+		case serialType >= 1 && serialType <= 4:
+			size = int(serialType)
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		case serialType >= 12:
+			size = int((serialType - 12) / 2)
+		}
+		if pos+size > len(payload) {
+			return nil, errors.New("corrupted record")
+		}
+		data := payload[pos : pos+size]
+		pos += size
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType >= 1 && serialType <= 6:
+			v := int64(int8(data[0]))
+			for _, b := range data[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serialType == 8:
+			values = append(values, int64(0))
+		case serialType == 9:
+			values = append(values, int64(1))
+		case serialType >= 12 && serialType%2 == 0:
+			values = append(values, data)
+		case serialType >= 13:
+			values = append(values, string(data))
+		default:
+			return nil, fmt.Errorf("invalid serial type %d", serialType)
+		}
+	}
+	return values, nil
+}
+
+// Hashes single value in the same way as dbhash tool
+func hashValue(h hash.Hash, value interface{}) {
+	var buf [9]byte
+	switch v := value.(type) {
+	case nil:
+		h.Write([]byte("0"))
+	case int64:
+		buf[0] = '1'
+		binary.BigEndian.PutUint64(buf[1:], uint64(v))
+		h.Write(buf[:])
+	case float64:
+		buf[0] = '2'
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+		h.Write(buf[:])
+	case string:
+		h.Write([]byte("3"))
+		h.Write([]byte(v))
+	case []byte:
+		h.Write([]byte("4"))
+		h.Write(v)
+	}
+}
+
+type schemaEntry struct {
+	Type    string
+	Name    string
+	TblName string
+	Root    int64
+	Sql     interface{}
+}
+
+type tableColumn struct {
+	Name       string
+	Real       bool // REAL affinity
+	Rowid      bool // alias of rowid (INTEGER PRIMARY KEY)
+	HasDefault bool
+}
+
+// Splits SQL text by top-level commas (outside of parentheses and quotes)
+func splitSQLList(sql string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; c {
+		case '\'', '"', '`', '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			for i++; i < len(sql) && sql[i] != end; i++ {
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, sql[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, sql[start:])
+}
+
+// Splits column definition into tokens (identifiers, quoted names and parenthesized groups)
+func sqlTokens(def string) []string {
+	var tokens []string
+	for i := 0; i < len(def); {
+		c := def[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := i + 1
+			for j < len(def) && def[j] != end {
+				j++
+			}
+			tokens = append(tokens, def[i:minInt(j+1, len(def))])
+			i = j + 1
+		case c == '(':
+			depth, j := 0, i
+			for ; j < len(def); j++ {
+				if def[j] == '(' {
+					depth++
+				} else if def[j] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			tokens = append(tokens, def[i:minInt(j+1, len(def))])
+			i = j + 1
+		default:
+			j := i
+			for j < len(def) && !strings.ContainsRune(" \t\n\r'\"`[(", rune(def[j])) {
+				j++
+			}
+			tokens = append(tokens, def[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func unquoteIdent(name string) string {
+	if len(name) >= 2 {
+		switch name[0] {
+		case '"', '\'', '`':
+			return strings.ReplaceAll(name[1:len(name)-1], string(name[0])+string(name[0]), string(name[0]))
+		case '[':
+			return name[1 : len(name)-1]
+		}
+	}
+	return name
+}
+
+var columnConstraints = map[string]bool{
+	"CONSTRAINT": true, "PRIMARY": true, "NOT": true, "NULL": true, "UNIQUE": true, "CHECK": true,
+	"DEFAULT": true, "COLLATE": true, "REFERENCES": true, "GENERATED": true, "AS": true,
+}
+
+// Parses columns from CREATE TABLE statement
+func parseTableColumns(sql string) ([]tableColumn, error) {
+	open := strings.Index(sql, "(")
+	close := strings.LastIndex(sql, ")")
+	if open == -1 || close < open {
+		return nil, fmt.Errorf("%w: cannot parse table definition", errDbhashUnsupported)
+	}
+	if strings.Contains(strings.ToUpper(sql[close:]), "WITHOUT") {
+		return nil, fmt.Errorf("%w: WITHOUT ROWID table", errDbhashUnsupported)
+	}
+	var columns []tableColumn
+	var tablePK []string
+	for _, def := range splitSQLList(sql[open+1 : close]) {
+		tokens := sqlTokens(def)
+		if len(tokens) == 0 {
+			continue
+		}
+		switch strings.ToUpper(tokens[0]) {
+		case "PRIMARY":
+			if len(tokens) >= 3 && strings.HasPrefix(tokens[2], "(") {
+				tablePK = splitSQLList(tokens[2][1 : len(tokens[2])-1])
+			}
+			continue
+		case "CONSTRAINT", "UNIQUE", "CHECK", "FOREIGN":
+			continue
+		}
+		col := tableColumn{Name: unquoteIdent(tokens[0])}
+		var typeTokens []string
+		i := 1
+		for ; i < len(tokens) && !columnConstraints[strings.ToUpper(tokens[i])]; i++ {
+			typeTokens = append(typeTokens, tokens[i])
+		}
+		declType := strings.ToUpper(strings.Join(typeTokens, " "))
+		for ; i < len(tokens); i++ {
+			switch strings.ToUpper(tokens[i]) {
+			case "GENERATED", "AS":
+				return nil, fmt.Errorf("%w: generated column", errDbhashUnsupported)
+			case "DEFAULT":
+				col.HasDefault = true
+			case "PRIMARY":
+				desc := i+2 < len(tokens) && strings.ToUpper(tokens[i+2]) == "DESC"
+				col.Rowid = declType == "INTEGER" && !desc
+			}
+		}
+		col.Real = columnRealAffinity(declType)
+		columns = append(columns, col)
+	}
+	if len(tablePK) == 1 {
+		name := unquoteIdent(strings.Fields(strings.TrimSpace(tablePK[0]))[0])
+		for i, col := range columns {
+			if strings.EqualFold(col.Name, name) {
+				columns[i].Rowid = declaredInteger(sql, col.Name)
+			}
+		}
+	}
+	return columns, nil
+}
+
+// Reports whether the column is declared with INTEGER type (used for table PRIMARY KEY constraint)
+func declaredInteger(sql, column string) bool {
+	open := strings.Index(sql, "(")
+	for _, def := range splitSQLList(sql[open+1 : strings.LastIndex(sql, ")")]) {
+		tokens := sqlTokens(def)
+		if len(tokens) >= 2 && strings.EqualFold(unquoteIdent(tokens[0]), column) {
+			return strings.ToUpper(tokens[1]) == "INTEGER" && (len(tokens) == 2 || columnConstraints[strings.ToUpper(tokens[2])])
+		}
+	}
+	return false
+}
+
+// Reports whether declared column type has REAL affinity (SQLite affinity rules)
+func columnRealAffinity(declType string) bool {
+	switch {
+	case strings.Contains(declType, "INT"):
+		return false
+	case strings.Contains(declType, "CHAR"), strings.Contains(declType, "CLOB"), strings.Contains(declType, "TEXT"):
+		return false
+	case strings.Contains(declType, "BLOB"), declType == "":
+		return false
+	}
+	return strings.Contains(declType, "REAL") || strings.Contains(declType, "FLOA") || strings.Contains(declType, "DOUB")
+}
+
+// Hashes all rows of the table as "SELECT * FROM table" query does
+func (db *sqliteFile) hashTable(h hash.Hash, entry schemaEntry) error {
+	sql, _ := entry.Sql.(string)
+	columns, err := parseTableColumns(sql)
+	if err != nil {
+		return err
+	}
+	return db.walkTable(uint32(entry.Root), func(rowid int64, payload []byte) error {
+		values, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+		for i, col := range columns {
+			var value interface{}
+			if i < len(values) {
+				value = values[i]
+			} else if col.HasDefault {
+				return fmt.Errorf("%w: column with default value added by ALTER TABLE", errDbhashUnsupported)
+			}
+			if col.Rowid {
+				value = rowid
+			} else if v, ok := value.(int64); ok && col.Real {
+				value = float64(v)
+			}
+			hashValue(h, value)
+		}
+		return nil
+	})
+}
+
+// Computes hash of the SQLite database content and schema, compatible with the SQLite
+// dbhash tool
+func DBHash(path string) (string, error) {
+	return dbHash(context.Background(), path, nil)
+}
+
+// Same as DBHash, computation is stopped when the context is canceled
+func DBHashContext(ctx context.Context, path string) (string, error) {
+	return dbHash(ctx, path, nil)
+}
+
+func dbHash(ctx context.Context, path string, progress func(int64)) (string, error) {
+	db, err := openSqliteFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	db.ctx, db.progress = ctx, progress
+
+	var schema []schemaEntry
+	err = db.walkTable(1, func(rowid int64, payload []byte) error {
+		values, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(values) < 5 {
+			return errors.New("invalid schema table record")
+		}
+		entry := schemaEntry{Sql: values[4]}
+		entry.Type, _ = values[0].(string)
+		entry.Name, _ = values[1].(string)
+		entry.TblName, _ = values[2].(string)
+		entry.Root, _ = values[3].(int64)
+		schema = append(schema, entry)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	// ORDER BY name COLLATE nocase
+	sort.SliceStable(schema, func(i, j int) bool {
+		return strings.ToLower(schema[i].Name) < strings.ToLower(schema[j].Name)
+	})
+
+	h := sha1.New()
+	for _, entry := range schema {
+		sql, isText := entry.Sql.(string)
+		if entry.Type != "table" || !isText || strings.HasPrefix(strings.ToUpper(sql), "CREATE VIRTUAL") {
+			continue
+		}
+		if len(entry.Name) >= 7 && strings.ToLower(entry.Name[:6]) == "sqlite" {
+			continue
+		}
+		if err := db.hashTable(h, entry); err != nil {
+			return "", fmt.Errorf("table %s: %w", entry.Name, err)
+		}
+	}
+	for _, entry := range schema {
+		hashValue(h, entry.Type)
+		hashValue(h, entry.Name)
+		hashValue(h, entry.TblName)
+		hashValue(h, entry.Sql)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,44 @@
+package gisquick
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Hash of testdata/points.gpkg computed with the algorithm of SQLite dbhash tool (tool/dbhash.c)
+// by the SQLite library. The GeoPackage contains a feature table, index, view, rtree index, NULLs,
+// negative and 64-bit integers, UTF-8 text and blobs spanning overflow pages.
+const pointsGpkgDbhash = "46ee14c2d4fd729f3314826c94944bc931de94a1"
+
+func TestDBHash(t *testing.T) {
+	hash, err := DBHash(filepath.Join("testdata", "points.gpkg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != pointsGpkgDbhash {
+		t.Errorf("got %s, expected %s", hash, pointsGpkgDbhash)
+	}
+}
+
+// Compares built-in implementation with the dbhash tool when it's available
+func TestDBHashExternal(t *testing.T) {
+	cmdPath, err := exec.LookPath("dbhash")
+	if err != nil {
+		t.Skip("dbhash tool is not available")
+	}
+	path := filepath.Join("testdata", "points.gpkg")
+	out, err := exec.Command(cmdPath, path).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Split(string(out), " ")[0]
+	hash, err := DBHash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != expected {
+		t.Errorf("got %s, dbhash tool returned %s", hash, expected)
+	}
+}
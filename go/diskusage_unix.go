@@ -0,0 +1,14 @@
+//go:build !windows
+
+package gisquick
+
+import "syscall"
+
+// Returns free (available to the user) and total bytes on the volume holding given path
+func DiskUsage(path string) (free, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,112 @@
+package gisquick
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// Files of these types are gzip compressed in upload requests
+var uploadCompressRegex = regexp.MustCompile("(?i).*\\.(qgs|xml|csv|svg|tif|shp|dbf|json|sqlite|gpkg|geojson)$")
+
+// Reports whether the file is compressed when uploaded
+func compressedUpload(path string) bool {
+	return uploadCompressRegex.MatchString(path)
+}
+
+// Size of the beginning of a file compressed to estimate its compression ratio
+const compressionSampleSize = 4 << 20
+
+// Writer which only counts written bytes
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Estimates size of the file in the upload request by compressing a sample from
+// the beginning of the file
+func estimateUploadSize(path string, size int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if !compressedUpload(path) {
+		return size, nil
+	}
+	counter := &countingWriter{}
+	gz := gzip.NewWriter(counter)
+	sampled, err := copyBuffer(gz, io.LimitReader(f, compressionSampleSize))
+	if err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	if sampled == 0 || sampled >= size {
+		return counter.n, nil
+	}
+	return int64(float64(size) * float64(counter.n) / float64(sampled)), nil
+}
+
+type unreadableFile struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Response of EstimateUpload request
+type uploadEstimate struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// estimated size of the data sent to the server (with compression)
+	WireBytes  int64            `json:"wire_bytes"`
+	Unreadable []unreadableFile `json:"unreadable"`
+}
+
+// Estimates amount of data transferred by upload of given files (same parameters
+// as UploadFiles request)
+func (c *Client) handleEstimateUpload(msg message) error {
+	var params FilesParam
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	directory, err := c.resolveProjectDirectory(params.Directory)
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	go func() {
+		estimate := uploadEstimate{Unreadable: []unreadableFile{}}
+		for _, f := range params.Files {
+			absPath, err := resolveProjectPath(directory, f.Path)
+			if err != nil {
+				estimate.Unreadable = append(estimate.Unreadable, unreadableFile{Path: f.Path, Error: err.Error()})
+				continue
+			}
+			info, err := os.Stat(absPath)
+			if err == nil && !info.Mode().IsRegular() {
+				err = errors.New("not a regular file")
+			}
+			var wireSize int64
+			if err == nil {
+				wireSize, err = estimateUploadSize(absPath, info.Size())
+			}
+			if err != nil {
+				estimate.Unreadable = append(estimate.Unreadable, unreadableFile{Path: f.Path, Error: err.Error()})
+				continue
+			}
+			estimate.Files++
+			estimate.Bytes += info.Size()
+			estimate.WireBytes += wireSize
+		}
+		c.SendDataResponse(msg, estimate)
+	}()
+	return nil
+}
@@ -0,0 +1,121 @@
+package gisquick
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ETags of fetched files, persisted to download only files changed on the server
+// (conditional requests with If-None-Match header)
+var etagsFile = filepath.Join(".gisquick", "etags.json")
+
+// ETag of the fetched file together with size and modification time of the local file,
+// so the ETag is used only while the local file is unchanged
+type etagEntry struct {
+	ETag  string `json:"etag"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+}
+
+// ETags of files in a project directory, keyed by slash separated relative paths
+type etagStore struct {
+	root    string
+	mutex   sync.Mutex
+	entries map[string]etagEntry
+	changed bool
+}
+
+// Returns ETag store of the project directory, loaded from the file when used for the first time
+func (c *Client) etagStore(root string) *etagStore {
+	root, _ = filepath.Abs(root)
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	if s, ok := c.etags[root]; ok {
+		return s
+	}
+	s := &etagStore{root: root, entries: make(map[string]etagEntry)}
+	if err := s.load(); err != nil {
+		log.Printf("Failed to load ETags: %s\n", err)
+	}
+	c.etags[root] = s
+	return s
+}
+
+func (s *etagStore) load() error {
+	data, err := os.ReadFile(filepath.Join(s.root, etagsFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		s.entries = make(map[string]etagEntry)
+		return fmt.Errorf("parsing ETags: %w", err)
+	}
+	return nil
+}
+
+// Returns stored ETag of the file, or empty string when the local file was modified since
+// it was fetched
+func (s *etagStore) lookup(relPath, absPath string) string {
+	s.mutex.Lock()
+	entry, ok := s.entries[filepath.ToSlash(relPath)]
+	s.mutex.Unlock()
+	if !ok {
+		return ""
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || info.Size() != entry.Size || info.ModTime().Unix() != entry.Mtime {
+		return ""
+	}
+	return entry.ETag
+}
+
+// Stores ETag of the fetched file (removes it when empty)
+func (s *etagStore) set(relPath, absPath, etag string) {
+	relPath = filepath.ToSlash(relPath)
+	var entry etagEntry
+	if etag != "" {
+		info, err := os.Stat(absPath)
+		if err != nil {
+			etag = ""
+		} else {
+			entry = etagEntry{ETag: etag, Size: info.Size(), Mtime: info.ModTime().Unix()}
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if etag == "" {
+		if _, ok := s.entries[relPath]; ok {
+			delete(s.entries, relPath)
+			s.changed = true
+		}
+		return
+	}
+	s.entries[relPath] = entry
+	s.changed = true
+}
+
+// Writes ETags into the file when they were changed
+func (s *etagStore) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.changed {
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.root, etagsFile), data); err != nil {
+		return fmt.Errorf("writing ETags: %w", err)
+	}
+	s.changed = false
+	return nil
+}
@@ -0,0 +1,538 @@
+package gisquick
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// File downloaded into the staging directory, waiting to be moved into the project
+type stagedFile struct {
+	finfo      FileInfo
+	tmpPath    string
+	destPath   string
+	backupPath string // original file moved aside, empty if there was none
+	size       int64
+	etag       string
+	applied    bool
+}
+
+// Verifies downloaded file against the metadata provided by server
+func (c *Client) verifyDownloadedFile(ctx context.Context, path string, finfo FileInfo) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if finfo.Size > 0 && stat.Size() != finfo.Size {
+		return fmt.Errorf("size mismatch (expected: %d, downloaded: %d)", finfo.Size, stat.Size())
+	}
+	// only SHA-1/SHA-256 hashes are verified, dbhash of downloaded file may be computed differently
+	alg, _ := splitHash(finfo.Hash)
+	if finfo.Hash != "" && (alg == HashSHA1 || alg == HashSHA256) && !c.skipHash(stat.Size()) {
+		hash, err := FileHashContext(ctx, path, alg)
+		if err != nil {
+			return err
+		}
+		if hash != finfo.Hash {
+			return fmt.Errorf("checksum mismatch (expected: %s, downloaded: %s)", finfo.Hash, hash)
+		}
+	}
+	return nil
+}
+
+// Downloads all files into a staging directory first and moves them into the project
+// directory only when every download succeeded. Already moved files are rolled back
+// when some of the files cannot be moved into place.
+func (c *Client) fetchFilesAtomic(op *fetchOperation, msg message, params *FilesParam, projectDir string) {
+	defer c.finishFetchOperation(msg.ID)
+	result := newFetchResult(len(params.Files))
+	etags := c.etagStore(projectDir)
+	sendStatus := func(file, status string) {
+		c.SendDataMessage("FetchStatus", result.status(file, status))
+	}
+
+	internalDir := filepath.Join(projectDir, ".gisquick")
+	if err := os.MkdirAll(internalDir, 0777); err != nil {
+		c.SendErrorResponse(msg, "Failed to create staging directory: "+err.Error())
+		return
+	}
+	stagingDir, err := os.MkdirTemp(internalDir, "staging-")
+	if err != nil {
+		c.SendErrorResponse(msg, "Failed to create staging directory: "+err.Error())
+		return
+	}
+	defer os.RemoveAll(stagingDir)
+
+	staged := make([]stagedFile, 0, len(params.Files))
+	failed := false
+	for _, f := range params.Files {
+		if op.ctx.Err() != nil {
+			break
+		}
+		destPath, err := resolveProjectPath(projectDir, f.Path)
+		if err != nil {
+			c.SendDataMessage("FetchStatus", result.add(f.Path, 0, err))
+			failed = true
+			continue
+		}
+		if !params.Force {
+			if err := c.checkFetchConflict(op.ctx, projectDir, destPath, f); err != nil {
+				c.SendDataMessage("FetchStatus", result.add(f.Path, 0, err))
+				failed = true
+				continue
+			}
+		}
+		tmpPath, info, err := c.downloadFile(op, params.Project, stagingDir, f, etags.lookup(f.Path, destPath))
+		if errors.Is(err, ErrNotModified) {
+			c.SendDataMessage("FetchStatus", result.add(f.Path, 0, err))
+			continue
+		}
+		if err == nil {
+			if err = c.verifyDownloadedFile(op.ctx, tmpPath, f); err != nil {
+				os.Remove(tmpPath)
+			}
+		}
+		if err != nil {
+			if op.ctx.Err() != nil {
+				break
+			}
+			c.SendDataMessage("FetchStatus", result.add(f.Path, 0, err))
+			failed = true
+			continue
+		}
+		if f.Mtime == 0 {
+			f.Mtime = info.Mtime
+		}
+		staged = append(staged, stagedFile{finfo: f, tmpPath: tmpPath, destPath: destPath, size: info.Size, etag: info.ETag})
+		sendStatus(f.Path, "downloaded")
+	}
+
+	if op.ctx.Err() != nil {
+		result.Aborted = true
+		c.SendDataResponse(msg, result.finish())
+		return
+	}
+	if failed {
+		// 409 when the files were not downloaded only because of conflicts
+		status := 500
+		if len(result.Failed) == 0 {
+			status = 409
+		}
+		c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: status, Data: fetchFailedResponse{
+			Error:       "Not all files were downloaded, no changes were applied",
+			fetchResult: result.finish(),
+		}})
+		return
+	}
+	err = op.commit(func() error {
+		return c.applyStagedFiles(staged, stagingDir, params.KeepOriginal)
+	})
+	if err == nil && params.Backup {
+		for _, f := range staged {
+			if f.backupPath == "" {
+				continue
+			}
+			destPath := filepath.Join(projectDir, backupsDir, op.backupID, filepath.FromSlash(f.finfo.Path))
+			if err := os.MkdirAll(filepath.Dir(destPath), 0777); err == nil {
+				os.Rename(f.backupPath, destPath)
+			}
+		}
+		if err := pruneStore(projectDir, backupsDir, c.BackupRetention); err != nil {
+			log.Printf("Failed to remove old backups: %s\n", err)
+		}
+	}
+	if err != nil {
+		c.SendErrorResponse(msg, "Failed to apply downloaded files, changes were rolled back: "+err.Error())
+		return
+	}
+	for _, f := range staged {
+		etags.set(f.finfo.Path, f.destPath, f.etag)
+		c.recordLocalFile(op.ctx, projectDir, filepath.ToSlash(f.finfo.Path), params.Version)
+		c.SendDataMessage("FetchStatus", result.add(f.finfo.Path, f.size, nil))
+	}
+	c.saveTransferState(projectDir)
+	if result.canPrune() && (params.Prune || params.PruneDryRun) {
+		if result.Pruned, err = c.pruneFiles(projectDir, params.ServerFiles, params.PruneDryRun); err != nil {
+			c.SendErrorResponse(msg, "Failed to prune local files: "+err.Error())
+			return
+		}
+	}
+	c.SendDataResponse(msg, result.finish())
+}
+
+// Error response of atomic fetch, includes summary with failed and conflicting files
+type fetchFailedResponse struct {
+	Error string `json:"error"`
+	*fetchResult
+}
+
+// Moves staged files into the project directory, restoring original files on failure
+func (c *Client) applyStagedFiles(staged []stagedFile, stagingDir string, keepOriginal bool) error {
+	backupDir := filepath.Join(stagingDir, "orig")
+	for i := range staged {
+		f := &staged[i]
+		if err := os.MkdirAll(filepath.Dir(f.destPath), c.DirMode); err != nil {
+			rollbackStagedFiles(staged)
+			return fmt.Errorf("creating file directory: %w", err)
+		}
+		if _, err := os.Lstat(f.destPath); err == nil {
+			backupPath := filepath.Join(backupDir, filepath.FromSlash(f.finfo.Path))
+			if err := os.MkdirAll(filepath.Dir(backupPath), 0777); err != nil {
+				rollbackStagedFiles(staged)
+				return fmt.Errorf("creating backup directory: %w", err)
+			}
+			if err := os.Rename(f.destPath, backupPath); err != nil {
+				rollbackStagedFiles(staged)
+				return fmt.Errorf("moving original file %s: %w", f.finfo.Path, err)
+			}
+			f.backupPath = backupPath
+		}
+		if err := os.Rename(f.tmpPath, f.destPath); err != nil {
+			rollbackStagedFiles(staged)
+			return fmt.Errorf("moving file %s: %w", f.finfo.Path, err)
+		}
+		f.applied = true
+		c.invalidateChecksums(f.destPath)
+	}
+	if keepOriginal {
+		suffix := ".orig-" + time.Now().Format("20060102150405")
+		for _, f := range staged {
+			if f.backupPath != "" {
+				os.Rename(f.backupPath, f.destPath+suffix)
+			}
+		}
+	}
+	return nil
+}
+
+// Reverts already applied staged files (in reverse order)
+func rollbackStagedFiles(staged []stagedFile) {
+	for i := len(staged) - 1; i >= 0; i-- {
+		f := staged[i]
+		if f.applied {
+			os.Remove(f.destPath)
+		}
+		if f.backupPath != "" {
+			if err := os.Rename(f.backupPath, f.destPath); err != nil {
+				log.Printf("Failed to restore original file %s: %s\n", f.destPath, err)
+			}
+		}
+	}
+}
+
+// Downloads whole project as a zip archive and extracts it into the project directory
+func (c *Client) fetchProjectArchive(op *fetchOperation, msg message, params *FilesParam, projectDir string) {
+	defer c.finishFetchOperation(msg.ID)
+	result := newFetchResult(0)
+
+	internalDir := filepath.Join(projectDir, ".gisquick")
+	if err := os.MkdirAll(internalDir, 0777); err != nil {
+		c.SendErrorResponse(msg, "Failed to create temporary directory: "+err.Error())
+		return
+	}
+	archivePath, err := c.downloadProjectArchive(op, params.Project, internalDir)
+	if err != nil {
+		if op.ctx.Err() != nil {
+			result.Aborted = true
+			c.SendDataResponse(msg, result.finish())
+			return
+		}
+		c.SendErrorResponse(msg, "Failed to download project archive: "+err.Error())
+		return
+	}
+	defer os.Remove(archivePath)
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		c.SendErrorResponse(msg, "Failed to open project archive: "+err.Error())
+		return
+	}
+	defer archive.Close()
+
+	// only requested files are extracted when the list of files is given
+	var requested map[string]FileInfo
+	if len(params.Files) > 0 {
+		requested = make(map[string]FileInfo, len(params.Files))
+		for _, f := range params.Files {
+			requested[normalizePath(f.Path)] = f
+		}
+	}
+	for _, entry := range archive.File {
+		if op.ctx.Err() != nil {
+			result.Aborted = true
+			break
+		}
+		name := normalizePath(entry.Name)
+		if strings.HasSuffix(name, "/") || isInternalPath(filepath.FromSlash(name)) {
+			continue
+		}
+		finfo, ok := requested[name]
+		if requested != nil && !ok {
+			continue
+		}
+		if !ok {
+			finfo = FileInfo{Path: name, Size: int64(entry.UncompressedSize64)}
+			if !entry.Modified.IsZero() {
+				finfo.Mtime = entry.Modified.Unix()
+			}
+		}
+		result.Total++
+		err := c.extractArchiveEntry(op, params, entry, projectDir, finfo)
+		if errors.Is(err, ErrFileLocked) {
+			c.SendDataMessage("FileLocked", FileLocked{File: finfo.Path, Pending: finfo.Path + ".new"})
+		}
+		c.SendDataMessage("FetchStatus", result.add(finfo.Path, int64(entry.UncompressedSize64), err))
+	}
+	c.saveTransferState(projectDir)
+	if result.canPrune() && (params.Prune || params.PruneDryRun) {
+		if result.Pruned, err = c.pruneFiles(projectDir, params.ServerFiles, params.PruneDryRun); err != nil {
+			c.SendErrorResponse(msg, "Failed to prune local files: "+err.Error())
+			return
+		}
+	}
+	if params.Backup {
+		if err := pruneStore(projectDir, backupsDir, c.BackupRetention); err != nil {
+			log.Printf("Failed to remove old backups: %s\n", err)
+		}
+	}
+	c.SendDataResponse(msg, result.finish())
+}
+
+// Downloads project archive into a temporary file in given directory and returns its path
+func (c *Client) downloadProjectArchive(op *fetchOperation, project, tmpDir string) (tmpPath string, err error) {
+	f, err := os.CreateTemp(tmpDir, "tmpfile-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = c.download(op.ctx, c.apiURL("api/project/download", project), f, ""); err != nil {
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Reader which postpones the timer every time some data are received
+type idleTimeoutReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Metadata of downloaded content
+type downloadInfo struct {
+	Size int64
+	ETag string
+	// time from Last-Modified header, zero when not provided
+	LastModified time.Time
+	// modification time set to the downloaded file (Unix time, zero when unknown)
+	Mtime int64
+}
+
+// Downloads content of given URL into the writer. Download is aborted when no data
+// are received for FetchIdleTimeout duration or when it takes longer than FetchTimeout.
+// When ETag is given, the request is conditional and ErrNotModified is returned if the content
+// wasn't changed.
+func (c *Client) download(ctx context.Context, url string, dest io.Writer, etag string) (downloadInfo, error) {
+	var info downloadInfo
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.FetchTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, c.FetchTimeout)
+		defer cancelTimeout()
+	}
+	var stalled int32
+	var timer *time.Timer
+	if c.FetchIdleTimeout > 0 {
+		timer = time.AfterFunc(c.FetchIdleTimeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	wrapErr := func(err error) error {
+		if atomic.LoadInt32(&stalled) == 1 {
+			return fmt.Errorf("%w: no data received for %s", ErrDownloadStalled, c.FetchIdleTimeout)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s", ErrDownloadTimeout, c.FetchTimeout)
+		}
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return info, fmt.Errorf("creating request: %w", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return info, wrapErr(fmt.Errorf("requesting file: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return info, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("%w: %s", ErrServerResponse, resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if timer != nil {
+		body = &idleTimeoutReader{reader: resp.Body, timer: timer, timeout: c.FetchIdleTimeout}
+	}
+	info.Size, err = copyBuffer(dest, body)
+	if errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength >= 0 {
+		return info, wrapErr(fmt.Errorf("%w: received %d of %d bytes", ErrDownloadIncomplete, info.Size, resp.ContentLength))
+	}
+	if err != nil {
+		return info, wrapErr(fmt.Errorf("writing to file: %w", err))
+	}
+	// chunked responses have unknown length, only checksum can be verified then
+	if resp.ContentLength >= 0 && info.Size != resp.ContentLength {
+		return info, fmt.Errorf("%w: received %d of %d bytes", ErrDownloadIncomplete, info.Size, resp.ContentLength)
+	}
+	info.ETag = resp.Header.Get("ETag")
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		if t, err := http.ParseTime(lastModified); err == nil {
+			info.LastModified = t
+		}
+	}
+	return info, nil
+}
+
+// Returns category of fetch error, so network problems can be distinguished from server errors
+func fetchErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrDownloadStalled):
+		return "stalled"
+	case errors.Is(err, ErrDownloadTimeout):
+		return "timeout"
+	case errors.Is(err, ErrDownloadIncomplete):
+		return "incomplete"
+	case errors.Is(err, ErrServerResponse):
+		return "server"
+	}
+	return ""
+}
+
+// Host system of zip entries with Unix permissions
+const zipCreatorUnix = 3
+
+// Extracts single archive entry into the project directory, refusing entries which
+// would be written outside of it (zip slip). Local changes are checked and original
+// files are handled in the same way as when the files are fetched one by one.
+func (c *Client) extractArchiveEntry(op *fetchOperation, params *FilesParam, entry *zip.File, projectDir string, finfo FileInfo) (err error) {
+	destPath, err := resolveProjectPath(projectDir, finfo.Path)
+	if err != nil {
+		return err
+	}
+	if !params.Force {
+		if err := c.checkFetchConflict(op.ctx, projectDir, destPath, finfo); err != nil {
+			return err
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(destPath), c.DirMode); err != nil {
+		return fmt.Errorf("creating file directory: %w", err)
+	}
+	src, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.CreateTemp(projectDir, "tmpfile-")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	var mode os.FileMode
+	if entry.CreatorVersion>>8 == zipCreatorUnix {
+		mode = entry.Mode()
+	}
+	if err = f.Chmod(fetchedFileMode(mode)); err != nil {
+		return
+	}
+	if _, err = copyBuffer(f, src); err != nil {
+		return fmt.Errorf("writing to file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	mtime := entry.Modified
+	if !mtime.IsZero() {
+		if err = os.Chtimes(f.Name(), mtime, mtime); err != nil {
+			return fmt.Errorf("updating file's modification time: %w", err)
+		}
+	}
+	c.invalidateChecksums(destPath)
+	err = op.commit(func() error {
+		return c.installFetchedFile(op, params, projectDir, finfo.Path, f.Name(), destPath)
+	})
+	if err != nil {
+		return err
+	}
+	c.recordLocalFile(op.ctx, projectDir, finfo.Path, params.Version)
+	return nil
+}
+
+// Temporary files older than this are considered to be left over from crashed or killed downloads
+const staleTempFileAge = time.Hour
+
+// Removes stale temporary files (left over after crashes) from the project directory.
+// Every directory is swept only once per session.
+func (c *Client) sweepTempFiles(projectDir string) {
+	c.fetchOpsMutex.Lock()
+	swept := c.sweptDirs[projectDir]
+	c.sweptDirs[projectDir] = true
+	c.fetchOpsMutex.Unlock()
+	if swept {
+		return
+	}
+	threshold := time.Now().Add(-staleTempFileAge)
+	remove := func(pattern string) {
+		matches, _ := filepath.Glob(pattern)
+		for _, p := range matches {
+			info, err := os.Stat(p)
+			if err != nil || info.ModTime().After(threshold) {
+				continue
+			}
+			if err := os.RemoveAll(p); err != nil {
+				log.Printf("Failed to remove stale temporary file %s: %s\n", p, err)
+			}
+		}
+	}
+	remove(filepath.Join(projectDir, "tmpfile-*"))
+	remove(filepath.Join(projectDir, ".gisquick", "tmpfile-*"))
+	remove(filepath.Join(projectDir, ".gisquick", "staging-*"))
+}
@@ -0,0 +1,166 @@
+package gisquick
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Serves project archive with given files
+func archiveServer(t *testing.T, files map[string]string) *httptest.Server {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/project/download/user/project" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+}
+
+func TestFetchProjectArchive(t *testing.T) {
+	srv := archiveServer(t, map[string]string{
+		".gisquick/sync.json": "server state",
+		"project.qgs":         "new project",
+		"data/a.csv":          "new a",
+		"data/b.csv":          "new b",
+	})
+	defer srv.Close()
+	c := NewClient(srv.URL, "user", "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"project.qgs": "old project", "data/a.csv": "old a", "old.csv": "old"})
+	// local file modified since it was listed
+	if _, _, err := c.ListDir(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"data/a.csv": "local a"})
+
+	fetch := func(params FilesParam) {
+		params.Project = "user/project"
+		msg := message{Type: "FetchFiles", ID: "1"}
+		c.fetchProjectArchive(c.startFetchOperation(msg.ID), msg, &params, dir)
+	}
+	fetch(FilesParam{
+		Files:  []FileInfo{{Path: "project.qgs"}, {Path: "data/a.csv"}},
+		Backup: true,
+	})
+	expected := map[string]string{"project.qgs": "new project", "data/a.csv": "local a", "old.csv": "old"}
+	for name, content := range expected {
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || string(data) != content {
+			t.Errorf("%s: got %q (%v), expected %q", name, data, err, content)
+		}
+	}
+	for _, name := range []string{"data/b.csv", ".gisquick/sync.json"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s should not be extracted", name)
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, backupsDir, "*", "project.qgs"))
+	if len(backups) != 1 {
+		t.Errorf("original file was not backed up: %v", backups)
+	}
+
+	fetch(FilesParam{Force: true, Prune: true, ServerFiles: []string{"project.qgs", "data/a.csv", "data/b.csv"}})
+	expected = map[string]string{"project.qgs": "new project", "data/a.csv": "new a", "data/b.csv": "new b"}
+	for name, content := range expected {
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || string(data) != content {
+			t.Errorf("%s: got %q (%v), expected %q", name, data, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.csv")); !os.IsNotExist(err) {
+		t.Error("local file missing on the server was not pruned")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gisquick", "sync.json")); !os.IsNotExist(err) {
+		t.Error(".gisquick entries should not be extracted")
+	}
+}
+
+// Local files are not pruned when some of the files failed to download
+func TestFetchFilesPruneAfterFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/project/file/user/project/a.csv" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("a"))
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "user", "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"old.csv": "old"})
+
+	fetch := func(files ...string) {
+		params := FilesParam{Project: "user/project", Prune: true, ServerFiles: files}
+		for _, f := range files {
+			params.Files = append(params.Files, FileInfo{Path: f})
+		}
+		msg := message{Type: "FetchFiles", ID: "1"}
+		c.fetchFiles(c.startFetchOperation(msg.ID), msg, &params, dir)
+	}
+	fetch("a.csv", "missing.csv")
+	if _, err := os.Stat(filepath.Join(dir, "old.csv")); err != nil {
+		t.Errorf("local file was pruned after failed fetch: %v", err)
+	}
+	fetch("a.csv")
+	if _, err := os.Stat(filepath.Join(dir, "old.csv")); !os.IsNotExist(err) {
+		t.Error("local file was not pruned")
+	}
+}
+
+// Local changes are detected also when the file wasn't listed since the client started
+func TestFetchConflictWithoutChecksumCache(t *testing.T) {
+	c := NewClient("http://localhost", "user", "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"synced.csv": "synced", "modified.csv": "synced", "local.csv": "local"})
+	ctx := context.Background()
+	for _, name := range []string{"synced.csv", "modified.csv"} {
+		c.recordLocalFile(ctx, dir, name, "")
+	}
+	c.saveTransferState(dir)
+	// client restarted after the last synchronization
+	c = NewClient("http://localhost", "user", "")
+	later := time.Now().Add(time.Minute)
+	writeFiles(t, dir, map[string]string{"modified.csv": "local change"})
+	os.Chtimes(filepath.Join(dir, "modified.csv"), later, later)
+
+	serverHash, err := c.computeChecksum(ctx, filepath.Join(dir, "local.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		hash     string
+		conflict bool
+	}{
+		{"synced.csv", "", false},
+		{"modified.csv", "", true},
+		{"local.csv", "", true},
+		{"local.csv", serverHash, false},
+		{"missing.csv", "", false},
+	}
+	for _, test := range tests {
+		finfo := FileInfo{Path: test.path, Hash: test.hash}
+		err := c.checkFetchConflict(ctx, dir, filepath.Join(dir, test.path), finfo)
+		if conflict := errors.Is(err, ErrFetchConflict); conflict != test.conflict || (err != nil && !conflict) {
+			t.Errorf("%s (hash %q): got %v, expected conflict %v", test.path, test.hash, err, test.conflict)
+		}
+	}
+}
@@ -1,112 +1,1141 @@
 package gisquick
 
 import (
+	"archive/zip"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
-	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/text/unicode/norm"
 )
 
+// Size of buffers used for copying file contents
+var copyBufferSize = 256 * 1024
+
+var copyBufferPool = newCopyBufferPool(copyBufferSize)
+
+func newCopyBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}
+}
+
+// Sets size of buffers used for copying file contents, should be called before any
+// transfer is started
+func SetCopyBufferSize(size int) {
+	if size > 0 {
+		copyBufferSize = size
+		copyBufferPool = newCopyBufferPool(size)
+	}
+}
+
+// Same as io.Copy, but uses buffer from the shared pool
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+// Wrappers hiding io.WriterTo and io.ReaderFrom implementations (e.g. of *os.File), which
+// would make io.CopyBuffer bypass the pooled buffer
+type readerOnly struct{ io.Reader }
+type writerOnly struct{ io.Writer }
+
 type FileInfo struct {
 	Path  string `json:"path"`
 	Hash  string `json:"hash"`
 	Size  int64  `json:"size"`
 	Mtime int64  `json:"mtime"`
+	// QGIS project file (.qgs or .qgz)
+	ProjectFile bool `json:"project_file,omitempty"`
+	// checksum wasn't computed because of the file size (see Client.MaxHashSize)
+	HashSkipped bool `json:"hash_skipped,omitempty"`
+	// permission bits of the file (e.g. 0755), default permissions are used when zero
+	Mode uint32 `json:"mode,omitempty"`
+	// xxHash of the file content, used only for local change detection in the checksum cache
+	fastHash uint64
+	// checksum was computed during the scan (not reused from the cache)
+	rehashed bool
+}
+
+// Default permissions of fetched files
+const defaultFileMode os.FileMode = 0644
+
+// Returns permissions of the fetched file. Permissions from the server are ignored on
+// Windows, where only the read-only attribute could be set and it would prevent later
+// updates of the file.
+func fetchedFileMode(mode os.FileMode) os.FileMode {
+	if mode&os.ModePerm == 0 || runtime.GOOS == "windows" {
+		return defaultFileMode
+	}
+	return mode & os.ModePerm
+}
+
+// Reports whether the path is the root directory or located inside of it
+func isWithinDir(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Evaluates symlinks in the longest existing part of the path
+func evalExistingSymlinks(path string) (string, error) {
+	current := path
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return path, nil
+		}
+		rest = append([]string{filepath.Base(current)}, rest...)
+		current = parent
+	}
+}
+
+// Resolves path (slash separated) relative to the project directory. Absolute paths and
+// paths which would end up outside of the project directory, including paths leading
+// through symlinks pointing outside, are refused with ErrPathOutsideProject error.
+// All file operations requested by the server must use this function.
+// Paths are not prefixed with \\?\ on Windows, the os package converts absolute paths over
+// MAX_PATH to the extended-length form itself (only paths passed to syscalls directly or to
+// external commands are limited).
+func resolveProjectPath(root, relPath string) (string, error) {
+	reject := func() (string, error) {
+		log.Printf("SECURITY: rejected path outside of the project directory: %q\n", relPath)
+		return "", fmt.Errorf("%w: %s", ErrPathOutsideProject, relPath)
+	}
+	osPath := filepath.FromSlash(relPath)
+	if filepath.IsAbs(osPath) || strings.HasPrefix(relPath, "/") || filepath.VolumeName(osPath) != "" {
+		return reject()
+	}
+	root = filepath.Clean(root)
+	absPath := filepath.Join(root, osPath)
+	if !isWithinDir(root, absPath) {
+		return reject()
+	}
+	absPath = matchNormalizedPath(root, absPath)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		realRoot = root
+	}
+	realPath, err := evalExistingSymlinks(absPath)
+	if err != nil {
+		return "", err
+	}
+	if !isWithinDir(realRoot, realPath) {
+		return reject()
+	}
+	return absPath, nil
+}
+
+// Returns relative path in Unicode normalization form C, used for all paths reported to
+// the server, so the same file names created on different platforms are equal
+func normalizePath(path string) string {
+	return norm.NFC.String(path)
+}
+
+// Reports whether the name can be written in different Unicode normalization forms
+func hasNormalizationForms(name string) bool {
+	return !norm.NFC.IsNormalString(name) || !norm.NFD.IsNormalString(name)
+}
+
+// Returns path of the existing file or directory whose name differs from the given path
+// only in Unicode normalization (e.g. NFD names created on macOS). Not existing parts of
+// the path are kept as they are. Directories are listed only for names which have other
+// normalization forms, so resolving of new (e.g. ASCII) files stays cheap.
+func matchNormalizedPath(root, path string) string {
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !hasNormalizationForms(rel) {
+		return path
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	current := root
+	for i, part := range parts {
+		next := filepath.Join(current, part)
+		if _, err := os.Lstat(next); err == nil {
+			current = next
+			continue
+		}
+		found := ""
+		if hasNormalizationForms(part) {
+			if entries, err := os.ReadDir(current); err == nil {
+				name := normalizePath(part)
+				for _, e := range entries {
+					if normalizePath(e.Name()) == name {
+						found = e.Name()
+						break
+					}
+				}
+			}
+		}
+		if found == "" {
+			return filepath.Join(append([]string{current}, parts[i:]...)...)
+		}
+		current = filepath.Join(current, found)
+	}
+	return current
+}
+
+// Returns groups of paths which differ only in letter case (or Unicode normalization),
+// such files would overwrite each other on case-insensitive file systems
+func findCaseCollisions(paths []string) [][]string {
+	groups := make(map[string][]string)
+	var keys []string
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		p = normalizePath(filepath.ToSlash(p))
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		key := strings.ToLower(p)
+		if _, exists := groups[key]; !exists {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], p)
+	}
+	collisions := [][]string{}
+	for _, key := range keys {
+		if group := groups[key]; len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	return collisions
+}
+
+// Reports whether the file system of the directory is case-insensitive. It's tested by
+// looking up the directory with changed case of its name, when the name has no letters,
+// it's guessed by the platform.
+func isCaseInsensitiveDir(dir string) bool {
+	dir, _ = filepath.Abs(dir)
+	name := filepath.Base(dir)
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, name)
+	info, err := os.Stat(dir)
+	if swapped == name || err != nil {
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+	other, err := os.Stat(filepath.Join(filepath.Dir(dir), swapped))
+	return err == nil && os.SameFile(info, other)
+}
+
+// Supported hash algorithms
+const (
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+)
+
+// Reader of file content, which stops with the context error when the context is canceled
+// and reports number of bytes read so far to the progress function
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	read     int64
+	progress func(read int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.progress != nil && n > 0 {
+		r.progress(r.read)
+	}
+	return n, err
 }
 
 // Computes SHA-1 hash of file
 func Sha1(path string) (string, error) {
+	return FileHash(path, HashSHA1)
+}
+
+// Computes hash of file with given algorithm. SHA-1 hashes are returned without prefix,
+// other algorithms are prefixed with algorithm name (e.g. "sha256:...").
+func FileHash(path, algorithm string) (string, error) {
+	return fileHash(context.Background(), path, algorithm, nil, nil)
+}
+
+// Same as FileHash, computation is stopped when the context is canceled
+func FileHashContext(ctx context.Context, path, algorithm string) (string, error) {
+	return fileHash(ctx, path, algorithm, nil, nil)
+}
+
+// Computes hash of file with given algorithm, fast hash of the content is computed
+// in the same pass when specified
+func fileHash(ctx context.Context, path, algorithm string, fast hash.Hash64, progress func(int64)) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case HashSHA1:
+		h = sha1.New()
+	case HashSHA256:
+		h = sha256.New()
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
-	h := sha1.New()
-	if _, err := io.Copy(h, file); err != nil {
+	var dest io.Writer = h
+	if fast != nil {
+		dest = io.MultiWriter(h, fast)
+	}
+	if _, err := copyBuffer(dest, &progressReader{ctx: ctx, r: file, progress: progress}); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	if algorithm == HashSHA1 {
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	}
+	return fmt.Sprintf("%s:%x", algorithm, h.Sum(nil)), nil
+}
+
+// Computes non-cryptographic hash (xxHash) of file, suitable only for local change detection
+func FastHash(path string) (uint64, error) {
+	return fastHashContext(context.Background(), path, nil)
+}
+
+func fastHashContext(ctx context.Context, path string, progress func(int64)) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	h := xxhash.New()
+	if _, err := copyBuffer(h, &progressReader{ctx: ctx, r: file, progress: progress}); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+// Returns hash algorithm used for checksums of files. SHA-256 is used only when
+// it is supported by server.
+func (c *Client) hashAlgorithm() string {
+	if c.HashAlgorithm == HashSHA256 && c.serverSupports(HashSHA256) {
+		return HashSHA256
+	}
+	return HashSHA1
 }
 
-// Computes hash of the file (SHA-1 or dbhash)
+// Sets size limit of hashed files, larger files are listed without checksum
+func (c *Client) SetMaxHashSize(size int64) {
+	c.configMutex.Lock()
+	c.MaxHashSize = size
+	c.configMutex.Unlock()
+}
+
+func (c *Client) maxHashSize() int64 {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	return c.MaxHashSize
+}
+
+// Reports whether checksum of the file with given size should be skipped
+func (c *Client) skipHash(size int64) bool {
+	maxSize := c.maxHashSize()
+	return maxSize > 0 && size > maxSize
+}
+
+// Reports whether the file matches expected hash. Local hash is used when it was computed
+// with the same algorithm, otherwise the hash is recomputed with the expected algorithm.
+func (c *Client) matchesHash(ctx context.Context, path, localHash, expected string) (bool, error) {
+	if localHash == expected {
+		return true, nil
+	}
+	localAlg, _ := splitHash(localHash)
+	expectedAlg, _ := splitHash(expected)
+	if localAlg == expectedAlg || (expectedAlg != HashSHA1 && expectedAlg != HashSHA256) {
+		return false, nil
+	}
+	hash, err := FileHashContext(ctx, path, expectedAlg)
+	if err != nil {
+		return false, err
+	}
+	return hash == expected, nil
+}
+
+// Computes hash of the file, cached value is used when the file wasn't modified
 func (c *Client) Checksum(path string) (string, error) {
-	if c.dbhashCmd != "" && strings.ToLower(filepath.Ext(path)) == ".gpkg" {
-		cmdOut, err := exec.Command(c.dbhashCmd, path).Output()
+	return c.ChecksumContext(context.Background(), path)
+}
+
+// Same as Checksum, computation is stopped when the context is canceled
+func (c *Client) ChecksumContext(ctx context.Context, path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return c.cachedChecksum(ctx, path, stat.Size(), stat.ModTime().Unix())
+}
+
+// Computes hashes of given files in parallel, returns map of paths to hashes. Number of
+// workers defaults to Concurrency.Hash when concurrency isn't positive.
+func (c *Client) ChecksumFiles(paths []string, concurrency int) (map[string]string, error) {
+	return c.ChecksumFilesContext(context.Background(), paths, concurrency)
+}
+
+// Same as ChecksumFiles, computation is stopped on the first error or when the context
+// is canceled
+func (c *Client) ChecksumFilesContext(ctx context.Context, paths []string, concurrency int) (map[string]string, error) {
+	if concurrency < 1 {
+		concurrency = c.hashWorkers()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hashes := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < poolSize(concurrency, len(paths)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				hashes[i], errs[i] = c.ChecksumContext(ctx, paths[i])
+				if errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	result := make(map[string]string, len(paths))
+	for i, path := range paths {
+		// errors caused by cancellation after the first failure are skipped
+		if errs[i] != nil && (ctx.Err() == nil || !errors.Is(errs[i], context.Canceled)) {
+			return nil, fmt.Errorf("computing checksum of %s: %w", path, errs[i])
+		}
+		result[path] = hashes[i]
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Computes hash of the file (dbhash of GeoPackage files, using the external dbhash tool
+// when available, content hash of .qgz projects, SHA-1/SHA-256 otherwise or for files
+// which can't be read as a database or archive)
+func (c *Client) computeChecksum(ctx context.Context, path string) (string, error) {
+	hash, _, err := c.computeHashes(ctx, path, false, nil)
+	return hash, err
+}
+
+// Returns which dbhash implementation is used for GeoPackage files ("external" or "builtin")
+func (c *Client) dbhashImpl() string {
+	if c.dbhashCommand() != "" {
+		return "external"
+	}
+	return "builtin"
+}
+
+// Computes checksum of the file and optionally also its fast hash (in a single pass
+// when possible). Number of processed bytes is reported to the progress function when
+// specified, the external dbhash process is killed when the context is canceled.
+func (c *Client) computeHashes(ctx context.Context, path string, fast bool, progress func(int64)) (string, uint64, error) {
+	if dbhashCmd := c.dbhashCommand(); dbhashCmd != "" && strings.ToLower(filepath.Ext(path)) == ".gpkg" {
+		cmdOut, err := exec.CommandContext(ctx, dbhashCmd, path).Output()
 		if err != nil { // errors.Is(err, exec.ErrNotFound)
-			return "", fmt.Errorf("executing dbhash command: %w", err)
+			if ctx.Err() != nil {
+				return "", 0, ctx.Err()
+			}
+			return "", 0, fmt.Errorf("executing dbhash command: %w", err)
 		}
 		hash := strings.Split(string(cmdOut), " ")[0]
-		return "dbhash:" + hash, nil
+		var fastHash uint64
+		if fast {
+			if fastHash, err = fastHashContext(ctx, path, progress); err != nil {
+				return "", 0, err
+			}
+		}
+		return "dbhash:" + hash, fastHash, nil
 	}
-	return Sha1(path)
+	if strings.ToLower(filepath.Ext(path)) == ".gpkg" {
+		hash, err := dbHash(ctx, path, progress)
+		if err == nil {
+			var fastHash uint64
+			if fast {
+				if fastHash, err = fastHashContext(ctx, path, nil); err != nil {
+					return "", 0, err
+				}
+			}
+			return "dbhash:" + hash, fastHash, nil
+		}
+		if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+		if c.Debug {
+			log.Printf("Built-in dbhash failed for %s, using file hash: %s\n", path, err)
+		}
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".qgz" {
+		hash, err := qgzHash(ctx, path)
+		if err == nil {
+			var fastHash uint64
+			if fast {
+				if fastHash, err = fastHashContext(ctx, path, progress); err != nil {
+					return "", 0, err
+				}
+			}
+			return "qgz:" + hash, fastHash, nil
+		}
+		if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+		if c.Debug {
+			log.Printf("Reading of qgz archive %s failed, using file hash: %s\n", path, err)
+		}
+	}
+	if !fast {
+		hash, err := fileHash(ctx, path, c.hashAlgorithm(), nil, progress)
+		return hash, 0, err
+	}
+	h := xxhash.New()
+	hash, err := fileHash(ctx, path, c.hashAlgorithm(), h, progress)
+	if err != nil {
+		return "", 0, err
+	}
+	return hash, h.Sum64(), nil
 }
 
-// Collects information about files in given directory
-func (c *Client) ListDir(root string, checksum bool) ([]FileInfo, []FileInfo, error) {
-	var files []FileInfo = []FileInfo{}
-	var tempFiles []FileInfo = []FileInfo{}
-	temporaryFileRegex := regexp.MustCompile(`(?i).*\.(gpkg-wal|gpkg-shm)$`)
-	excludedDir := ".gisquick" + string(filepath.Separator)
-	defaultFileFilter := func(path string) bool {
-		return !strings.HasSuffix(path, "~") && !strings.HasPrefix(path, excludedDir)
+// Computes hash of the file, or returns cached value if the file wasn't modified. When only
+// modification time was changed, the content is compared with fast hash first, so the
+// expensive checksum is not recomputed for files saved without changes.
+func (c *Client) cachedChecksum(ctx context.Context, path string, size, mtime int64) (string, error) {
+	hash, _, err := c.checksumWithCache(ctx, path, size, mtime, nil)
+	return hash, err
+}
+
+// Same as cachedChecksum, additionally reports whether the cached value was used.
+// Progress of the checksum computation is reported when progress function is specified.
+func (c *Client) checksumWithCache(ctx context.Context, path string, size, mtime int64, progress func(int64)) (string, bool, error) {
+	c.cacheMutex.Lock()
+	item, inCache := c.checksumCache[path]
+	c.cacheMutex.Unlock()
+	inCache = inCache && item.Size == size && c.validCachedHash(item.Hash)
+	if inCache && item.Mtime == mtime {
+		atomic.AddUint64(&c.cacheHits, 1)
+		return item.Hash, true, nil
+	}
+	if inCache && item.fastHash != 0 {
+		if fastHash, err := fastHashContext(ctx, path, nil); err == nil && fastHash == item.fastHash {
+			atomic.AddUint64(&c.cacheHits, 1)
+			item.Mtime = mtime
+			c.cacheMutex.Lock()
+			c.checksumCache[path] = item
+			c.cacheMutex.Unlock()
+			return item.Hash, true, nil
+		}
 	}
-	fileFilter := defaultFileFilter
+	atomic.AddUint64(&c.cacheMisses, 1)
+	hash, fastHash, err := c.computeHashes(ctx, path, true, progress)
+	if err != nil {
+		return "", false, err
+	}
+	c.cacheMutex.Lock()
+	c.checksumCache[path] = FileInfo{Hash: hash, Size: size, Mtime: mtime, fastHash: fastHash}
+	c.cacheMutex.Unlock()
+	return hash, false, nil
+}
 
-	matcher, err := ignore.CompileIgnoreFile(filepath.Join(root, ".gisquickignore"))
-	if err == nil {
-		fileFilter = func(path string) bool {
-			return defaultFileFilter(path) && !matcher.MatchesPath(path)
+// Reports whether cached hash was computed with currently used algorithm
+func (c *Client) validCachedHash(hash string) bool {
+	alg, _ := splitHash(hash)
+	return alg == "dbhash" || alg == "qgz" || alg == c.hashAlgorithm()
+}
+
+// Removes all cached checksums
+func (c *Client) ClearCache() {
+	c.cacheMutex.Lock()
+	c.checksumCache = make(map[string]FileInfo)
+	c.projectSources = make(map[string]cachedProjectSources)
+	c.cacheMutex.Unlock()
+	atomic.StoreUint64(&c.cacheHits, 0)
+	atomic.StoreUint64(&c.cacheMisses, 0)
+}
+
+// Removes cached checksums of given files
+func (c *Client) invalidateChecksums(paths ...string) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	for _, path := range paths {
+		delete(c.checksumCache, path)
+	}
+}
+
+// Moves cached checksums of the renamed file or directory content
+func (c *Client) moveChecksums(srcPath, destPath string) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	prefix := srcPath + string(filepath.Separator)
+	delete(c.checksumCache, destPath)
+	for key, item := range c.checksumCache {
+		if key == srcPath {
+			delete(c.checksumCache, key)
+			c.checksumCache[destPath] = item
+		} else if strings.HasPrefix(key, prefix) {
+			delete(c.checksumCache, key)
+			c.checksumCache[filepath.Join(destPath, key[len(prefix):])] = item
 		}
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return files, tempFiles, fmt.Errorf("parsing .gisquickignore file: %w", err)
 	}
+}
 
-	root, _ = filepath.Abs(root)
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+// Reports whether the relative path is within the .gisquick directory used by the plugin
+func isInternalPath(path string) bool {
+	return path == ".gisquick" || strings.HasPrefix(path, ".gisquick"+string(filepath.Separator))
+}
+
+// Returns filter of project files and directories, excluding the .gisquick directory and
+// paths matching rules in .gisquickignore file or additional ignore patterns
+func projectFileFilter(root string, patterns []string) (func(path string, isDir bool) bool, error) {
+	rules, err := loadIgnoreRules(root, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("parsing .gisquickignore file: %w", err)
+	}
+	return func(path string, isDir bool) bool {
+		if isInternalPath(path) {
+			return false
+		}
+		return !rules.Ignored(path, isDir)
+	}, nil
+}
+
+// Lists project files and temporary files (GeoPackage WAL/SHM files, backup files with
+// "~" suffix, e.g. QGIS project autosaves). Checksums are not computed for temporary files.
+func (c *Client) ListDir(root string, checksum bool) ([]FileInfo, []FileInfo, error) {
+	return c.ListDirContext(context.Background(), root, checksum)
+}
+
+// Same as ListDir, checksums are computed in parallel and the computation is stopped when
+// the context is canceled
+func (c *Client) ListDirContext(ctx context.Context, root string, checksum bool) ([]FileInfo, []FileInfo, error) {
+	files, tempFiles, problems, err := c.listDir(ctx, root, checksum, scanLimits{}, nil, nil)
+	for i := range files {
+		files[i].Path = normalizePath(files[i].Path)
+	}
+	for i := range tempFiles {
+		tempFiles[i].Path = normalizePath(tempFiles[i].Path)
+	}
+	for _, p := range problems {
+		log.Printf("WARN: skipping file %s: %s\n", p.Path, p.Reason)
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	for _, group := range findCaseCollisions(paths) {
+		log.Printf("WARN: file paths differ only in case: %s\n", strings.Join(group, ", "))
+	}
+	return files, tempFiles, err
+}
+
+// Policies of handling symbolic links in the project directory
+const (
+	// symbolic links are not listed, they are reported as problems
+	SymlinkSkip = "skip"
+	// symbolic links pointing into the project directory are followed
+	SymlinkFollow = "follow"
+	// listing fails when there is any symbolic link
+	SymlinkError = "error"
+)
+
+// Maximal number of nested symbolic links to directories followed during listing
+const maxSymlinkDepth = 16
+
+// Walks the project directory in lexical order and calls visit function for every regular
+// file accepted by include function, excluded directories are not traversed. Symbolic links
+// are handled according to the policy, links leading outside of the project directory are
+// never followed. Unreadable files are reported with problem function, only errors of the
+// root directory and errors returned from visit function are returned.
+func walkProjectDir(root, policy string, include func(path string, isDir bool) bool, visit func(path string, info os.FileInfo) error, problem func(path, reason string)) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	visited := map[string]bool{realRoot: true}
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := os.ReadDir(dir)
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				fmt.Printf("WARN: file does not exists, skipping: %s\n", path)
-				return nil
+			if dir == root {
+				return err
 			}
-			return err
+			problem(dir, err.Error())
+			return nil
 		}
-		if !info.IsDir() {
-			relPath := path[len(root)+1:]
-			if fileFilter(relPath) {
-				size := info.Size()
-				mtime := info.ModTime().Unix()
-				if temporaryFileRegex.Match([]byte(relPath)) {
-					tempFiles = append(tempFiles, FileInfo{relPath, "", size, mtime})
-				} else {
-					hash := ""
-					if checksum {
-						item, inCache := c.checksumCache[path]
-						if inCache && item.Mtime == mtime && item.Size == size {
-							hash = item.Hash
-						} else {
-							if hash, err = c.Checksum(path); err != nil {
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			// type of the entry is known from reading of the directory, file info is
+			// loaded only for included regular files
+			if e.Type()&os.ModeSymlink != 0 {
+				switch policy {
+				case SymlinkError:
+					return fmt.Errorf("symbolic link in project directory: %s", path)
+				case SymlinkFollow:
+					target, err := filepath.EvalSymlinks(path)
+					if err != nil {
+						problem(path, "broken symbolic link")
+						continue
+					}
+					if !isWithinDir(realRoot, target) {
+						problem(path, "symbolic link points outside of the project directory")
+						continue
+					}
+					targetInfo, err := os.Stat(target)
+					if err != nil {
+						problem(path, err.Error())
+						continue
+					}
+					if !targetInfo.IsDir() {
+						if targetInfo.Mode().IsRegular() && include(path, false) {
+							if err := visit(path, targetInfo); err != nil {
 								return err
 							}
-							c.checksumCache[path] = FileInfo{Hash: hash, Size: size, Mtime: mtime}
 						}
+						continue
+					}
+					if !include(path, true) {
+						continue
 					}
-					files = append(files, FileInfo{relPath, hash, size, mtime})
+					if visited[target] || depth >= maxSymlinkDepth {
+						problem(path, "symbolic link loop")
+						continue
+					}
+					visited[target] = true
+					if err := walk(path, depth+1); err != nil {
+						return err
+					}
+				default:
+					problem(path, "symbolic link (skipped)")
+				}
+				continue
+			}
+			if e.IsDir() {
+				if !include(path, true) {
+					continue
+				}
+				if err := walk(path, depth); err != nil {
+					return err
+				}
+				continue
+			}
+			if !e.Type().IsRegular() || !include(path, false) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					problem(path, err.Error())
+				}
+				continue
+			}
+			if err := visit(path, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root, 0)
+}
+
+// File which couldn't be read during directory listing
+type fileProblem struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// Default patterns of temporary files (gitignore syntax, matched case-insensitively), which
+// are listed separately from project files: SQLite journals, lock files of GIS formats and
+// applications, backup copies and editor swap files. QGIS auxiliary storage (*.qgd) is not
+// included, it holds project data (e.g. label positions).
+var DefaultTemporaryPatterns = []string{
+	"*.gpkg-wal",
+	"*.gpkg-shm",
+	"*.gpkg-journal",
+	"*.sqlite-wal",
+	"*.sqlite-shm",
+	"*.sqlite-journal",
+	"*.db-wal",
+	"*.db-shm",
+	"*.db-journal",
+	"*.shp.lock",
+	".gislock",
+	"*_attachments.zip",
+	"*.tmp",
+	"*.swp",
+	"*.swo",
+	"*~",
+	".~lock.*#",
+	"\\#*#",
+}
+
+// Classification of temporary files
+type temporaryFileMatcher struct {
+	rules   *ignoreRules
+	pattern *regexp.Regexp
+}
+
+// Reports whether the file (slash separated path relative to the project directory)
+// is a temporary file
+func (m *temporaryFileMatcher) Match(path string) bool {
+	if m.pattern != nil && m.pattern.MatchString(path) {
+		return true
+	}
+	return m.rules.matches(strings.ToLower(path), false)
+}
+
+func compileTemporaryPatterns(patterns []string) (*ignoreRules, error) {
+	lines := make([]string, len(patterns))
+	for i, p := range patterns {
+		lines[i] = strings.ToLower(p)
+	}
+	return compileIgnoreRules(lines)
+}
+
+// Returns matcher of temporary files. ExcludePattern replaces the configured patterns when
+// set, patterns received from the server are always added.
+func (c *Client) temporaryFiles() (*temporaryFileMatcher, error) {
+	c.configMutex.Lock()
+	patterns := append([]string{}, c.serverTempPatterns...)
+	c.configMutex.Unlock()
+	if c.ExcludePattern == nil {
+		patterns = append(patterns, c.TemporaryPatterns...)
+	}
+	rules, err := compileTemporaryPatterns(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid temporary file pattern: %w", err)
+	}
+	return &temporaryFileMatcher{rules: rules, pattern: c.ExcludePattern}, nil
+}
+
+// Progress of the project directory scan
+type scanProgress struct {
+	Discovered  int    `json:"discovered"`
+	Hashed      int    `json:"hashed"`
+	BytesHashed int64  `json:"bytes_hashed"`
+	File        string `json:"file,omitempty"`
+	// progress of hashing of a large file (hashed bytes and size of the file)
+	FileHashed int64 `json:"file_hashed,omitempty"`
+	FileSize   int64 `json:"file_size,omitempty"`
+}
+
+// Limits of the project directory scan, protecting from scanning of a wrong directory
+// (e.g. user's home directory). Zero value means no limit.
+type scanLimits struct {
+	MaxFiles int
+	MaxSize  int64
+}
+
+// Number of example paths reported when scan limit is exceeded
+const scanLimitExamples = 5
+
+// Error returned when the project directory exceeds scan limits
+type ScanLimitError struct {
+	// exceeded limit ("files" or "size") and its value
+	Limit string `json:"limit"`
+	Max   int64  `json:"max"`
+	// number of files and their total size when the scan was aborted
+	Files    int      `json:"files"`
+	Size     int64    `json:"size"`
+	Examples []string `json:"examples"`
+}
+
+func (e *ScanLimitError) Error() string {
+	if e.Limit == "size" {
+		return fmt.Sprintf("project directory exceeds size limit of %d bytes", e.Max)
+	}
+	return fmt.Sprintf("project directory exceeds limit of %d files", e.Max)
+}
+
+type scanLimitCounter struct {
+	limits   scanLimits
+	files    int
+	size     int64
+	examples []string
+}
+
+// Counts listed file, returns error when any limit is exceeded
+func (s *scanLimitCounter) add(path string, size int64) error {
+	s.files++
+	s.size += size
+	if len(s.examples) < scanLimitExamples {
+		s.examples = append(s.examples, normalizePath(filepath.ToSlash(path)))
+	}
+	exceeded := func(limit string, max int64) error {
+		return &ScanLimitError{Limit: limit, Max: max, Files: s.files, Size: s.size, Examples: s.examples}
+	}
+	if s.limits.MaxFiles > 0 && s.files > s.limits.MaxFiles {
+		return exceeded("files", int64(s.limits.MaxFiles))
+	}
+	if s.limits.MaxSize > 0 && s.size > s.limits.MaxSize {
+		return exceeded("size", s.limits.MaxSize)
+	}
+	return nil
+}
+
+func (c *Client) scanLimits() scanLimits {
+	return scanLimits{MaxFiles: c.MaxScanFiles, MaxSize: c.MaxScanSize}
+}
+
+// Minimal interval between progress reports of the directory scan
+const scanProgressInterval = 500 * time.Millisecond
+
+// Lists project files, unreadable files are skipped and returned as problems. Only errors
+// of the root directory are fatal. Listing is aborted with *ScanLimitError when the limits
+// are exceeded.
+// Paths excluded by ignore rules are passed to the ignored function when specified
+// (directories with trailing separator, their content is not listed).
+func (c *Client) listDir(ctx context.Context, root string, checksum bool, limits scanLimits, progress func(scanProgress), ignored func(path string)) ([]FileInfo, []FileInfo, []fileProblem, error) {
+	// number of files found by the previous scan of the directory is used as an estimate
+	c.cacheMutex.Lock()
+	capacity := 0
+	if snapshot := c.scanSnapshots[root]; snapshot != nil {
+		capacity = len(snapshot.Files)
+	}
+	c.cacheMutex.Unlock()
+	var files []FileInfo = make([]FileInfo, 0, capacity)
+	var tempFiles []FileInfo = []FileInfo{}
+	problems := []fileProblem{}
+	tempPattern, err := c.temporaryFiles()
+	if err != nil {
+		return files, tempFiles, problems, err
+	}
+	fileFilter, err := projectFileFilter(root, c.IgnorePatterns)
+	if err != nil {
+		return files, tempFiles, problems, err
+	}
+
+	root, _ = filepath.Abs(root)
+	reportProblem := func(path, reason string) {
+		relPath := path[len(root)+1:]
+		if fileFilter(relPath, false) {
+			problems = append(problems, fileProblem{Path: relPath, Reason: reason})
+		}
+	}
+	include := func(path string, isDir bool) bool {
+		relPath := path[len(root)+1:]
+		if fileFilter(relPath, isDir) {
+			return true
+		}
+		if ignored != nil && !isInternalPath(relPath) {
+			if isDir {
+				relPath += string(filepath.Separator)
+			}
+			ignored(relPath)
+		}
+		return false
+	}
+	limit := scanLimitCounter{limits: limits}
+	err = walkProjectDir(root, c.SymlinkPolicy, include, func(path string, info os.FileInfo) error {
+		relPath := path[len(root)+1:]
+		size := info.Size()
+		mtime := info.ModTime().Unix()
+		if err := limit.add(relPath, size); err != nil {
+			return err
+		}
+		if tempPattern.Match(filepath.ToSlash(relPath)) {
+			tempFiles = append(tempFiles, FileInfo{Path: relPath, Size: size, Mtime: mtime})
+		} else {
+			files = append(files, FileInfo{Path: relPath, Size: size, Mtime: mtime, ProjectFile: isProjectFile(relPath)})
+		}
+		return nil
+	}, reportProblem)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if checksum {
+		hits, misses := atomic.LoadUint64(&c.cacheHits), atomic.LoadUint64(&c.cacheMisses)
+		hashProblems, err := c.computeChecksums(ctx, root, files, progress)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(hashProblems) > 0 {
+			problems = append(problems, hashProblems...)
+			// skip files without checksum
+			valid := files[:0]
+			for _, f := range files {
+				if f.Hash != "" || f.HashSkipped {
+					valid = append(valid, f)
+				}
+			}
+			files = valid
+		}
+		if c.Debug {
+			log.Printf("Checksum cache: %d hits, %d misses\n", atomic.LoadUint64(&c.cacheHits)-hits, atomic.LoadUint64(&c.cacheMisses)-misses)
+		}
+	}
+	return files, tempFiles, problems, nil
+}
+
+// Computes checksums of files with a pool of workers. Files which cannot be hashed are
+// left without checksum and returned as problems. Progress is reported periodically when
+// progress function is specified.
+func (c *Client) computeChecksums(ctx context.Context, root string, files []FileInfo, progress func(scanProgress)) ([]fileProblem, error) {
+	var problems []fileProblem
+	workers := poolSize(c.hashWorkers(), len(files))
+	var progressMutex sync.Mutex
+	status := scanProgress{Discovered: len(files)}
+	lastReport := time.Now()
+	if progress != nil {
+		progress(status)
+	}
+	reportFile := func(f *FileInfo) {
+		if progress == nil {
+			return
+		}
+		progressMutex.Lock()
+		defer progressMutex.Unlock()
+		status.Hashed++
+		status.BytesHashed += f.Size
+		status.File = f.Path
+		if time.Since(lastReport) >= scanProgressInterval || status.Hashed == status.Discovered {
+			lastReport = time.Now()
+			progress(status)
+		}
+	}
+	// reports progress of hashing of the file, so progress messages are sent also while
+	// hashing a single large file
+	hashProgress := func(f *FileInfo) func(int64) {
+		if progress == nil {
+			return nil
+		}
+		return func(read int64) {
+			progressMutex.Lock()
+			defer progressMutex.Unlock()
+			if time.Since(lastReport) >= scanProgressInterval {
+				lastReport = time.Now()
+				current := status
+				current.File, current.FileHashed, current.FileSize = f.Path, read, f.Size
+				progress(current)
+			}
+		}
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f := &files[i]
+				if c.skipHash(f.Size) {
+					f.HashSkipped = true
+					reportFile(f)
+					continue
 				}
+				hash, reused, err := c.checksumWithCache(ctx, filepath.Join(root, f.Path), f.Size, f.Mtime, hashProgress(f))
+				if ctx.Err() != nil {
+					continue
+				}
+				reportFile(f)
+				if err != nil {
+					progressMutex.Lock()
+					problems = append(problems, fileProblem{Path: f.Path, Reason: err.Error()})
+					progressMutex.Unlock()
+					continue
+				}
+				f.Hash = hash
+				f.rehashed = !reused
+			}
+		}()
+	}
+	var err error
+loop:
+	for i := range files {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		// files being hashed while the context was canceled are left without checksum
+		err = ctx.Err()
+	}
+	return problems, err
+}
+
+// Returns relative paths of empty directories within the project directory
+func ListEmptyDirs(root string, ignorePatterns ...string) ([]string, error) {
+	dirs := []string{}
+	fileFilter, err := projectFileFilter(root, ignorePatterns)
+	if err != nil {
+		return dirs, err
+	}
+	root, _ = filepath.Abs(root)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
 			}
+			return err
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		relPath := path[len(root)+1:]
+		if !fileFilter(relPath, true) {
+			return filepath.SkipDir
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			dirs = append(dirs, relPath)
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return files, tempFiles, nil
+	return dirs, nil
 }
 
 // Saves content from given reader into the file
@@ -127,7 +1156,7 @@ func SaveToFile(src io.Reader, filename string) (err error) {
 		}
 	}()
 
-	if _, err := io.Copy(file, src); err != nil {
+	if _, err := copyBuffer(file, src); err != nil {
 		return err
 	}
 	return nil
@@ -140,6 +1169,93 @@ func CopyFile(dest io.Writer, path string) error {
 		return err
 	}
 	defer file.Close()
-	_, err = io.Copy(dest, file)
+	_, err = copyBuffer(dest, file)
 	return err
 }
+
+// Renames file, falls back to copy and delete when the destination is on another device
+func moveFile(srcPath, destPath string) error {
+	err := os.Rename(srcPath, destPath)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("moving directory across devices: %w", syscall.EXDEV)
+	}
+	return copyReplaceFile(srcPath, destPath)
+}
+
+// Replaces destination file with a copy of the source file and removes the source, used when
+// the files are on different devices and cannot be renamed. The copy is written into
+// a temporary file next to the destination and synced to disk before it's renamed over
+// the destination, so the destination is either the original or the complete new file.
+func copyReplaceFile(srcPath, destPath string) (err error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), "tmpfile-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = tmp.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = CopyFile(tmp, srcPath); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("syncing file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err = replaceFile(tmp.Name(), destPath); err != nil {
+		return err
+	}
+	return os.Remove(srcPath)
+}
+
+// Reports whether the file is a QGIS project file (plain .qgs or zipped .qgz)
+func isProjectFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".qgs" || ext == ".qgz"
+}
+
+// Reads content of the project file, .qgs file embedded in .qgz archive is read
+// without extracting it to disk
+func ReadProjectFile(path string) ([]byte, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".qgz" {
+		return os.ReadFile(path)
+	}
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening qgz project: %w", err)
+	}
+	defer archive.Close()
+	for _, f := range archive.File {
+		if strings.ToLower(filepath.Ext(f.Name)) != ".qgs" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("qgz project does not contain .qgs file: %s", path)
+}
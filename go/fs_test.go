@@ -0,0 +1,262 @@
+package gisquick
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Paths longer than MAX_PATH (260 characters) must work on Windows without any prefixing
+func TestLongPaths(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("MAX_PATH limit applies only on Windows")
+	}
+	root := t.TempDir()
+	segment := strings.Repeat("tiles", 10)
+	relPath := filepath.Join(segment, segment, segment, segment, segment, segment, "0.png")
+	absPath := filepath.Join(root, relPath)
+	if len(absPath) <= 260 {
+		t.Fatalf("path is not long enough: %d", len(absPath))
+	}
+	if err := SaveToFile(strings.NewReader("tile"), absPath); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("http://localhost", "user", "")
+	files, _, err := c.ListDir(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != filepath.ToSlash(relPath) || files[0].Hash == "" {
+		t.Fatalf("unexpected listing: %+v", files)
+	}
+	movedPath := filepath.Join(filepath.Dir(absPath), "1.png")
+	if err := moveFile(absPath, movedPath); err != nil {
+		t.Fatal(err)
+	}
+	var content strings.Builder
+	if err := CopyFile(&content, movedPath); err != nil {
+		t.Fatal(err)
+	}
+	if content.String() != "tile" {
+		t.Errorf("unexpected content: %q", content.String())
+	}
+}
+
+// Writes file of given size with pseudo-random content
+func writeRandomFile(tb testing.TB, path string, size int64) {
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.New(rand.NewSource(size)), size); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Compares SHA-1 checksum (reported to the server) with xxHash used for local change detection
+// on a directory of large files
+func BenchmarkFileHash(b *testing.B) {
+	const size = 32 << 20
+	dir := b.TempDir()
+	var paths []string
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("raster%d.tif", i))
+		writeRandomFile(b, path, size)
+		paths = append(paths, path)
+	}
+	b.Run("sha1", func(b *testing.B) {
+		b.SetBytes(size * int64(len(paths)))
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				if _, err := FileHash(path, HashSHA1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("xxhash", func(b *testing.B) {
+		b.SetBytes(size * int64(len(paths)))
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				if _, err := FastHash(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// Creates synthetic tile tree with given number of files (1000 files per directory)
+func createTileTree(tb testing.TB, root string, files int) {
+	for i := 0; i < files; i++ {
+		dir := filepath.Join(root, "tiles", fmt.Sprintf("%d", i/1000))
+		if i%1000 == 0 {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.png", i)), []byte("tile"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// Compares listing of a project with 50k files with plain filepath.Walk, which stats every entry
+func BenchmarkListDir(b *testing.B) {
+	root := b.TempDir()
+	createTileTree(b, root, 50000)
+	b.Run("ListDir", func(b *testing.B) {
+		c := NewClient("http://localhost", "user", "")
+		for i := 0; i < b.N; i++ {
+			files, _, err := c.ListDir(root, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(files) != 50000 {
+				b.Fatalf("listed %d files", len(files))
+			}
+		}
+	})
+	b.Run("filepath.Walk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var files []FileInfo
+			err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				relPath, _ := filepath.Rel(root, path)
+				files = append(files, FileInfo{Path: filepath.ToSlash(relPath), Size: info.Size(), Mtime: info.ModTime().Unix()})
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Names of fixtures in composed (NFC) and decomposed (NFD) forms of "ě" and "ñ"
+const (
+	nfcDir  = "m\u011bsto"
+	nfdDir  = "me\u030csto"
+	nfcFile = "espa\u00f1a.csv"
+	nfdFile = "espan\u0303a.csv"
+)
+
+func TestUnicodeNormalization(t *testing.T) {
+	root := t.TempDir()
+	// files created on macOS have decomposed names
+	writeFiles(t, root, map[string]string{nfdDir + "/" + nfdFile: "data", "ascii.csv": "data"})
+	nfdPath := filepath.Join(root, nfdDir, nfdFile)
+
+	c := NewClient("http://localhost", "user", "")
+	files, _, err := c.ListDir(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, f := range files {
+		listed[f.Path] = true
+	}
+	if !listed[nfcDir+"/"+nfcFile] || len(files) != 2 {
+		t.Errorf("paths are not reported in NFC: %+v", files)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{nfcDir + "/" + nfcFile, nfdPath},
+		{nfdDir + "/" + nfdFile, nfdPath},
+		{nfcDir + "/" + nfdFile, nfdPath},
+		{"ascii.csv", filepath.Join(root, "ascii.csv")},
+		// not existing files are kept as they are
+		{nfcDir + "/new.csv", filepath.Join(root, nfdDir, "new.csv")},
+		{"new/" + nfcFile, filepath.Join(root, "new", nfcFile)},
+	}
+	for _, tt := range tests {
+		path, err := resolveProjectPath(root, tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != tt.expected {
+			t.Errorf("resolved %q to %q, expected %q", tt.path, path, tt.expected)
+		}
+	}
+}
+
+func TestTemporaryFiles(t *testing.T) {
+	tests := []struct {
+		path      string
+		temporary bool
+	}{
+		{"project.qgs", false},
+		{"project.qgs~", true},
+		{"project.qgz~", true},
+		{"project.qgd", false},
+		{"data/points.gpkg", false},
+		{"data/points.gpkg-wal", true},
+		{"data/points.gpkg-shm", true},
+		{"data/points.gpkg-journal", true},
+		{"data/areas.GPKG-WAL", true},
+		{"data/lines.sqlite-wal", true},
+		{"data/lines.sqlite-shm", true},
+		{"data/lines.sqlite-journal", true},
+		{"data/forms.db-wal", true},
+		{"data/forms.db-shm", true},
+		{"data/forms.db-journal", true},
+		{"data/roads.shp", false},
+		{"data/roads.shp.lock", true},
+		{".gislock", true},
+		{"data/photos_attachments.zip", true},
+		{"data/photos.zip", false},
+		{"data/export.tmp", true},
+		{"scripts/.style.py.swp", true},
+		{"scripts/.style.py.swo", true},
+		{"notes.txt~", true},
+		{".~lock.table.ods#", true},
+		{"#notes.txt#", true},
+		{"notes#1.txt", false},
+	}
+	root := t.TempDir()
+	for _, tt := range tests {
+		writeFiles(t, root, map[string]string{tt.path: "data"})
+	}
+	c := NewClient("http://localhost", "user", "")
+	files, tempFiles, err := c.ListDir(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, f := range files {
+		listed[f.Path] = false
+	}
+	for _, f := range tempFiles {
+		listed[f.Path] = true
+	}
+	for _, tt := range tests {
+		temporary, ok := listed[tt.path]
+		if !ok {
+			t.Errorf("%s was not listed", tt.path)
+		} else if temporary != tt.temporary {
+			t.Errorf("%s: got temporary %v, expected %v", tt.path, temporary, tt.temporary)
+		}
+	}
+
+	// ExcludePattern replaces the default patterns
+	c.ExcludePattern = regexp.MustCompile(`\.qgd$`)
+	_, tempFiles, err = c.ListDir(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tempFiles) != 1 || tempFiles[0].Path != "project.qgd" {
+		t.Errorf("unexpected temporary files with ExcludePattern: %+v", tempFiles)
+	}
+}
@@ -3,6 +3,10 @@ module github.com/gisquick/gisquick-qgis-plugin/go
 go 1.18
 
 require (
+	github.com/cespare/xxhash/v2 v2.2.0
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gorilla/websocket v1.4.2
-	github.com/sabhiram/go-gitignore v0.0.0-20210923224102-525f6e181f06
+	golang.org/x/text v0.13.0
 )
+
+require golang.org/x/sys v0.10.0 // indirect
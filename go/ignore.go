@@ -0,0 +1,233 @@
+package gisquick
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ignore rules of the project (.gisquickignore file) follow gitignore semantics:
+//   - blank lines and lines starting with # are skipped, \# and \! escape the first character
+//   - pattern starting with ! re-includes paths excluded by previous patterns, but a file
+//     can't be re-included when its parent directory is excluded
+//   - pattern ending with / matches only directories (and so everything inside of them)
+//   - pattern containing / (other than the trailing one) is relative to the project
+//     directory, otherwise it matches the name at any level
+//   - * and ? match any characters except /, [...] matches a character class, leading
+//     **/ matches in all directories, trailing /** matches everything inside and /**/
+//     matches zero or more directories
+//   - the last matching pattern decides
+// Ignored directories are not traversed at all.
+
+const ignoreFileName = ".gisquickignore"
+
+// Single parsed ignore rule
+type ignoreRule struct {
+	Pattern  string `json:"pattern"`
+	Negate   bool   `json:"negate,omitempty"`
+	DirOnly  bool   `json:"dir_only,omitempty"`
+	Anchored bool   `json:"anchored,omitempty"`
+	regex    *regexp.Regexp
+	// literal suffix of name patterns like *.tmp, matched without the regular expression
+	suffix string
+}
+
+func (rule *ignoreRule) match(path string) bool {
+	if rule.suffix != "" {
+		return strings.HasSuffix(path, rule.suffix)
+	}
+	return rule.regex.MatchString(path)
+}
+
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+// Converts glob pattern into regular expression
+func globToRegex(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern) && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString(".*")
+			i++
+		case ch == '*':
+			b.WriteString("[^/]*")
+		case ch == '?':
+			b.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return b.String()
+}
+
+// Parses single line of ignore file, returns false for empty lines and comments
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	line = strings.TrimRight(line, "\r")
+	// trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+	rule := ignoreRule{Pattern: line}
+	if strings.HasPrefix(line, "!") {
+		rule.Negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false, nil
+	}
+	if strings.Contains(line, "/") {
+		rule.Anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	// pattern without slash is matched against the last path segment (see matches)
+	regex, err := regexp.Compile("^" + globToRegex(line) + "$")
+	if err != nil {
+		return ignoreRule{}, false, fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+	}
+	rule.regex = regex
+	if !rule.Anchored && strings.HasPrefix(line, "*") && !strings.ContainsAny(line[1:], `*?[\`) {
+		rule.suffix = line[1:]
+	}
+	return rule, true, nil
+}
+
+func compileIgnoreRules(lines []string) (*ignoreRules, error) {
+	r := &ignoreRules{}
+	for _, line := range lines {
+		rule, ok, err := parseIgnoreRule(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return r, nil
+}
+
+// Reports whether the path (slash separated, relative to the project directory) is
+// excluded by the rules, not considering its parent directories
+func (r *ignoreRules) matches(path string, isDir bool) bool {
+	name := path[strings.LastIndexByte(path, '/')+1:]
+	excluded := false
+	for _, rule := range r.rules {
+		if rule.DirOnly && !isDir {
+			continue
+		}
+		target := path
+		if !rule.Anchored {
+			target = name
+		}
+		if excluded == rule.Negate && rule.match(target) {
+			excluded = !rule.Negate
+		}
+	}
+	return excluded
+}
+
+// Reports whether the path or any of its parent directories is excluded
+func (r *ignoreRules) Ignored(path string, isDir bool) bool {
+	if r == nil || len(r.rules) == 0 {
+		return false
+	}
+	path = filepath.ToSlash(path)
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && r.matches(path[:i], true) {
+			return true
+		}
+	}
+	return r.matches(path, isDir)
+}
+
+type cachedIgnoreRules struct {
+	mtime    time.Time
+	size     int64
+	patterns string
+	rules    *ignoreRules
+}
+
+// Compiled ignore rules of project directories, recompiled when the ignore file is modified
+var (
+	ignoreRulesCache      = make(map[string]cachedIgnoreRules)
+	ignoreRulesCacheMutex sync.Mutex
+)
+
+// Returns compiled rules from the ignore file of the project directory and additional patterns
+func loadIgnoreRules(root string, patterns []string) (*ignoreRules, error) {
+	path := filepath.Join(root, ignoreFileName)
+	var mtime time.Time
+	var size int64
+	info, err := os.Stat(path)
+	if err == nil {
+		mtime, size = info.ModTime(), info.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key := strings.Join(patterns, "\n")
+	ignoreRulesCacheMutex.Lock()
+	cached, ok := ignoreRulesCache[root]
+	ignoreRulesCacheMutex.Unlock()
+	if ok && cached.mtime.Equal(mtime) && cached.size == size && cached.patterns == key {
+		return cached.rules, nil
+	}
+
+	var lines []string
+	if info != nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	rules, err := compileIgnoreRules(append(lines, patterns...))
+	if err != nil {
+		return nil, err
+	}
+	ignoreRulesCacheMutex.Lock()
+	ignoreRulesCache[root] = cachedIgnoreRules{mtime: mtime, size: size, patterns: key, rules: rules}
+	ignoreRulesCacheMutex.Unlock()
+	return rules, nil
+}
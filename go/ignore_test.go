@@ -0,0 +1,65 @@
+package gisquick
+
+import "testing"
+
+func TestCompileIgnoreRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{name: "comment", rules: []string{"# data.csv"}, path: "data.csv"},
+		{name: "blank line", rules: []string{"", "   "}, path: "data.csv"},
+		{name: "name at any level", rules: []string{"*.tmp"}, path: "data/cache/layer.tmp", ignored: true},
+		{name: "suffix pattern", rules: []string{"*.gpkg-wal"}, path: "data/points.gpkg-wal", ignored: true},
+		{name: "suffix pattern doesn't match longer extension", rules: []string{"*.tmp"}, path: "data.tmpx"},
+		{name: "suffix pattern matches parent directory", rules: []string{"*.tmp"}, path: "cache.tmp/data.csv", ignored: true},
+		{name: "star doesn't match slash", rules: []string{"data*.csv"}, path: "data/points.csv"},
+		{name: "question mark", rules: []string{"layer?.shp"}, path: "layer1.shp", ignored: true},
+		{name: "character class", rules: []string{"layer[0-9].shp"}, path: "layerA.shp"},
+		{name: "negated character class", rules: []string{"layer[!0-9].shp"}, path: "layerA.shp", ignored: true},
+		{name: "negated character class doesn't match slash", rules: []string{"data[!x]csv"}, path: "data/csv"},
+		{name: "anchored with leading slash", rules: []string{"/cache"}, path: "data/cache"},
+		{name: "anchored matches at root", rules: []string{"/cache"}, path: "cache", ignored: true},
+		{name: "anchored with inner slash", rules: []string{"data/*.csv"}, path: "data/points.csv", ignored: true},
+		{name: "inner slash is not matched in subdirectories", rules: []string{"data/*.csv"}, path: "other/data/points.csv"},
+		{name: "dir only matches directory", rules: []string{"cache/"}, path: "data/cache", isDir: true, ignored: true},
+		{name: "dir only doesn't match file", rules: []string{"cache/"}, path: "data/cache"},
+		{name: "dir only excludes content", rules: []string{"cache/"}, path: "cache/tiles/1.png", ignored: true},
+		{name: "leading double star", rules: []string{"**/tiles"}, path: "a/b/tiles", isDir: true, ignored: true},
+		{name: "leading double star at root", rules: []string{"**/tiles"}, path: "tiles", isDir: true, ignored: true},
+		{name: "trailing double star", rules: []string{"cache/**"}, path: "cache/a/b.png", ignored: true},
+		{name: "trailing double star doesn't match directory itself", rules: []string{"cache/**"}, path: "cache", isDir: true},
+		{name: "inner double star", rules: []string{"data/**/raw.tif"}, path: "data/a/b/raw.tif", ignored: true},
+		{name: "inner double star matches zero directories", rules: []string{"data/**/raw.tif"}, path: "data/raw.tif", ignored: true},
+		{name: "negation", rules: []string{"*.csv", "!keep.csv"}, path: "keep.csv"},
+		{name: "negation doesn't affect other files", rules: []string{"*.csv", "!keep.csv"}, path: "drop.csv", ignored: true},
+		{name: "last matching rule decides", rules: []string{"!keep.csv", "*.csv"}, path: "keep.csv", ignored: true},
+		{name: "negation can't re-include file in excluded directory", rules: []string{"cache/", "!cache/keep.csv"}, path: "cache/keep.csv", ignored: true},
+		{name: "escaped hash", rules: []string{`\#notes.txt`}, path: "#notes.txt", ignored: true},
+		{name: "escaped exclamation mark", rules: []string{`\!important.txt`}, path: "!important.txt", ignored: true},
+		{name: "escaped exclamation mark is not negation", rules: []string{"*.txt", `\!important.txt`}, path: "!important.txt", ignored: true},
+		{name: "trailing spaces are trimmed", rules: []string{"data.csv  "}, path: "data.csv", ignored: true},
+		{name: "escaped trailing space", rules: []string{`data\ `}, path: "data ", ignored: true},
+		{name: "windows line ending", rules: []string{"data.csv\r"}, path: "data.csv", ignored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileIgnoreRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ignored := rules.Ignored(tt.path, tt.isDir); ignored != tt.ignored {
+				t.Errorf("Ignored(%q, %v) with rules %q: got %v, expected %v", tt.path, tt.isDir, tt.rules, ignored, tt.ignored)
+			}
+		})
+	}
+}
+
+func TestCompileIgnoreRulesInvalidPattern(t *testing.T) {
+	if _, err := compileIgnoreRules([]string{"data[z-a].csv"}); err == nil {
+		t.Error("expected error of invalid character range")
+	}
+}
@@ -0,0 +1,211 @@
+package gisquick
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Lock duration used when server doesn't announce it, the lock is renewed after a third of it
+const defaultProjectLockTTL = 60 * time.Second
+
+// Maximal duration of the request releasing the lock (also when the client is stopping)
+const lockReleaseTimeout = 5 * time.Second
+
+// Error of the upload rejected because the project is locked by another client
+type ProjectLockedError struct {
+	Message string `json:"error"`
+	Reason  string `json:"reason"`
+	Project string `json:"project"`
+	// holder of the lock and time when it was acquired, when provided by server
+	User  string `json:"user,omitempty"`
+	Since string `json:"since,omitempty"`
+}
+
+func (e *ProjectLockedError) Error() string {
+	return e.Message
+}
+
+func newProjectLockedError(project string, body []byte) *ProjectLockedError {
+	var info struct {
+		User  string `json:"user"`
+		Since string `json:"since"`
+	}
+	json.Unmarshal(body, &info)
+	lockErr := &ProjectLockedError{Reason: "project_locked", Project: project, User: info.User, Since: info.Since}
+	switch {
+	case info.User != "" && info.Since != "":
+		lockErr.Message = fmt.Sprintf("Project is locked by user %s since %s", info.User, info.Since)
+	case info.User != "":
+		lockErr.Message = fmt.Sprintf("Project is locked by user %s", info.User)
+	default:
+		lockErr.Message = "Project is locked by another user"
+	}
+	return lockErr
+}
+
+// Server lock of the project, held during upload so other clients can't publish the same
+// project at the same time. The lock is renewed periodically until it's released.
+type projectLock struct {
+	client  *Client
+	project string
+	token   string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	once    sync.Once
+	// error of the renewal when the lock was lost
+	mutex   sync.Mutex
+	lostErr error
+}
+
+// Acquires server lock of the project, an existing (stale) lock of another client is taken
+// over when force is set. Returns nil lock when the server doesn't support locking.
+// Returned lock's context is cancelled when the lock is lost.
+func (c *Client) lockProject(ctx context.Context, project string, force bool) (*projectLock, error) {
+	if !c.serverSupports("project_lock") {
+		return nil, nil
+	}
+	data, _ := json.Marshal(map[string]bool{"force": force})
+	resp, body, err := c.lockRequest(ctx, "POST", project, data)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring project lock: %w", err)
+	}
+	if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusLocked {
+		return nil, newProjectLockedError(project, body)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("acquiring project lock: %w: %s", ErrServerResponse, resp.Status)
+	}
+	var info struct {
+		Token string  `json:"token"`
+		TTL   float64 `json:"ttl"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("parsing project lock: %w", err)
+	}
+	ttl := defaultProjectLockTTL
+	if info.TTL > 0 {
+		ttl = time.Duration(info.TTL * float64(time.Second))
+	}
+	lock := &projectLock{client: c, project: project, token: info.Token}
+	lock.ctx, lock.cancel = context.WithCancel(ctx)
+	c.locksMutex.Lock()
+	c.projectLocks[lock] = struct{}{}
+	c.locksMutex.Unlock()
+	go lock.keepAlive(ttl / 3)
+	return lock, nil
+}
+
+// Sends request to the project lock endpoint, returns response with read body
+func (c *Client) lockRequest(ctx context.Context, method, project string, data []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL("api/project/lock", project), bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// Renews the lock until it's released, the lock's context is cancelled when the lock was taken
+// over by another client
+func (l *projectLock) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	data, _ := json.Marshal(map[string]string{"token": l.token})
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		resp, body, err := l.client.lockRequest(l.ctx, "PUT", l.project, data)
+		if err != nil {
+			// keep trying, the lock is valid until it expires
+			if l.ctx.Err() == nil {
+				log.Printf("Failed to renew project lock: %s\n", err)
+			}
+			continue
+		}
+		if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusLocked || resp.StatusCode == http.StatusNotFound {
+			l.mutex.Lock()
+			l.lostErr = newProjectLockedError(l.project, body)
+			l.mutex.Unlock()
+			log.Printf("Project lock was lost: %s\n", l.lostErr)
+			l.cancel()
+			return
+		}
+		if resp.StatusCode >= 400 {
+			log.Printf("Failed to renew project lock: %s\n", resp.Status)
+		}
+	}
+}
+
+// Returns context of the locked operation (the given context when there is no lock)
+func (l *projectLock) context(ctx context.Context) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return l.ctx
+}
+
+// Returns error describing why the lock was lost, nil while it's held
+func (l *projectLock) lost() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lostErr
+}
+
+// Stops renewal and releases the lock on the server, can be called repeatedly
+func (l *projectLock) release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		l.cancel()
+		c := l.client
+		c.locksMutex.Lock()
+		delete(c.projectLocks, l)
+		c.locksMutex.Unlock()
+		if l.lost() != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+		defer cancel()
+		data, _ := json.Marshal(map[string]string{"token": l.token})
+		resp, _, err := c.lockRequest(ctx, "DELETE", l.project, data)
+		if err == nil && resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+			err = fmt.Errorf("%w: %s", ErrServerResponse, resp.Status)
+		}
+		if err != nil {
+			log.Printf("Failed to release project lock: %s\n", err)
+		}
+	})
+}
+
+// Releases all held project locks
+func (c *Client) releaseProjectLocks() {
+	c.locksMutex.Lock()
+	locks := make([]*projectLock, 0, len(c.projectLocks))
+	for l := range c.projectLocks {
+		locks = append(locks, l)
+	}
+	c.locksMutex.Unlock()
+	for _, l := range locks {
+		l.release()
+	}
+}
@@ -0,0 +1,182 @@
+package gisquick
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Manifest of the last project scan, persisted to reuse computed checksums of unchanged
+// files after restart of the plugin
+var manifestFile = filepath.Join(".gisquick", "manifest.json")
+
+const manifestVersion = 1
+
+type manifestEntry struct {
+	Path     string `json:"path"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Mtime    int64  `json:"mtime"`
+	FastHash uint64 `json:"fast_hash,omitempty"`
+}
+
+type projectManifest struct {
+	Version int             `json:"version"`
+	Files   []manifestEntry `json:"files"`
+}
+
+// Loads checksums from the stored manifest of the project directory into the checksum cache
+// (only once per directory, cached values have precedence). Returns number of loaded entries.
+func (c *Client) loadManifest(root string) (int, error) {
+	root, _ = filepath.Abs(root)
+	c.cacheMutex.Lock()
+	loaded := c.loadedManifests[root]
+	c.loadedManifests[root] = true
+	c.cacheMutex.Unlock()
+	if loaded {
+		return 0, nil
+	}
+	data, err := os.ReadFile(filepath.Join(root, manifestFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var manifest projectManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if manifest.Version != manifestVersion {
+		return 0, nil
+	}
+	count := 0
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	for _, e := range manifest.Files {
+		path := filepath.Join(root, filepath.FromSlash(e.Path))
+		if !isWithinDir(root, path) {
+			continue
+		}
+		if _, exists := c.checksumCache[path]; !exists {
+			c.checksumCache[path] = FileInfo{Hash: e.Hash, Size: e.Size, Mtime: e.Mtime, fastHash: e.FastHash}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Stores checksums of the scanned project files into the manifest
+func (c *Client) saveManifest(root string, files []FileInfo) error {
+	root, _ = filepath.Abs(root)
+	manifest := projectManifest{Version: manifestVersion, Files: make([]manifestEntry, 0, len(files))}
+	c.cacheMutex.Lock()
+	for _, f := range files {
+		item, ok := c.checksumCache[filepath.Join(root, filepath.FromSlash(f.Path))]
+		if !ok || item.Hash != f.Hash {
+			continue
+		}
+		manifest.Files = append(manifest.Files, manifestEntry{
+			Path:     filepath.ToSlash(f.Path),
+			Hash:     item.Hash,
+			Size:     item.Size,
+			Mtime:    item.Mtime,
+			FastHash: item.fastHash,
+		})
+	}
+	c.cacheMutex.Unlock()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(root, manifestFile), data); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return nil
+}
+
+// Writes data into a temporary file which then replaces the file, so the file is never
+// left partially written
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "tmpfile-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Result of the last ProjectFiles scan of the directory, used as a baseline for incremental
+// responses
+type scanSnapshot struct {
+	Token string
+	Files map[string]FileInfo
+}
+
+// Difference of the project files against the previous scan
+type scanDiff struct {
+	Changed []FileInfo
+	Removed []string
+}
+
+// Stores the scan result of the directory and returns token identifying it
+func (c *Client) storeSnapshot(directory string, files []FileInfo) string {
+	snapshot := &scanSnapshot{
+		Token: fmt.Sprintf("%x-%d", time.Now().UnixNano(), atomic.AddUint64(&c.requestCounter, 1)),
+		Files: make(map[string]FileInfo, len(files)),
+	}
+	for _, f := range files {
+		snapshot.Files[f.Path] = f
+	}
+	c.cacheMutex.Lock()
+	c.scanSnapshots[directory] = snapshot
+	c.cacheMutex.Unlock()
+	return snapshot.Token
+}
+
+// Compares files with the snapshot of the directory identified by token, returns false
+// when the token doesn't match the last scan of the directory
+func (c *Client) diffSnapshot(directory, token string, files []FileInfo) (scanDiff, bool) {
+	c.cacheMutex.Lock()
+	snapshot := c.scanSnapshots[directory]
+	c.cacheMutex.Unlock()
+	diff := scanDiff{Changed: []FileInfo{}, Removed: []string{}}
+	if snapshot == nil || token == "" || snapshot.Token != token {
+		return diff, false
+	}
+	current := make(map[string]bool, len(files))
+	for _, f := range files {
+		current[f.Path] = true
+		prev, exists := snapshot.Files[f.Path]
+		if !exists || prev.Hash != f.Hash || prev.Size != f.Size || prev.Mtime != f.Mtime {
+			diff.Changed = append(diff.Changed, f)
+		}
+	}
+	for path := range snapshot.Files {
+		if !current[path] {
+			diff.Removed = append(diff.Removed, path)
+		}
+	}
+	sort.Strings(diff.Removed)
+	return diff, true
+}
@@ -0,0 +1,69 @@
+package gisquick
+
+import "time"
+
+// Data of FetchStatus message, sent when a file was processed during fetch
+type FetchStatus struct {
+	File string `json:"file"`
+	// "finished", "downloaded" (atomic fetch), "skipped" (not modified on the server), "aborted",
+	// "conflict", "locked" or "error"
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// size of the downloaded file
+	Bytes int64 `json:"bytes"`
+	// number of processed files, total number of files and percentage of processed files
+	FilesDone  int     `json:"files_done"`
+	FilesTotal int     `json:"files_total"`
+	Percent    float64 `json:"percent"`
+}
+
+// Data of UploadProgress message, sent when a file was written into the upload request
+type UploadProgress struct {
+	File       string  `json:"file"`
+	Bytes      int64   `json:"bytes"`
+	BytesTotal int64   `json:"bytes_total"`
+	FilesDone  int     `json:"files_done"`
+	FilesTotal int     `json:"files_total"`
+	Percent    float64 `json:"percent"`
+}
+
+// Summary of finished transfer of files
+type TransferSummary struct {
+	Total int `json:"total"`
+	// number of processed files (including failed ones)
+	Done    int     `json:"done"`
+	Bytes   int64   `json:"bytes"`
+	Elapsed float64 `json:"elapsed"`
+	Aborted bool    `json:"aborted,omitempty"`
+	started time.Time
+}
+
+func newTransferSummary(total int) TransferSummary {
+	return TransferSummary{Total: total, started: time.Now()}
+}
+
+func (s *TransferSummary) finish() {
+	s.Elapsed = time.Since(s.started).Seconds()
+}
+
+// Data of UploadAborted message, sent to the server when a running upload was cancelled,
+// so it can clean up partially received data
+type UploadAborted struct {
+	Project string `json:"project"`
+}
+
+// Data of FileLocked message, sent when a fetched file couldn't replace a locked file
+type FileLocked struct {
+	File string `json:"file"`
+	// path of the downloaded file waiting for replacement of the locked file
+	Pending string `json:"pending"`
+}
+
+// Returns percentage of done items
+func percent(done, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(total)
+}
@@ -0,0 +1,341 @@
+package gisquick
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Providers of file based data sources
+var fileProviders = map[string]bool{
+	"ogr":           true,
+	"gdal":          true,
+	"delimitedtext": true,
+	"spatialite":    true,
+}
+
+var spatialiteDbnameRegex = regexp.MustCompile(`dbname='((?:[^'\\]|\\.)*)'`)
+
+// Extracts file path from the datasource string of given provider
+func datasourcePath(provider, datasource string) string {
+	switch provider {
+	case "ogr", "gdal":
+		path := strings.SplitN(datasource, "|", 2)[0]
+		// GDAL subdataset syntax, e.g. GPKG:/data/file.gpkg:table
+		if strings.HasPrefix(path, "GPKG:") {
+			path = strings.TrimPrefix(path, "GPKG:")
+			if i := strings.LastIndex(path, ":"); i > 1 {
+				path = path[:i]
+			}
+		}
+		if strings.HasPrefix(path, "/vsizip/") {
+			path = strings.TrimPrefix(path, "/vsizip")
+			if i := strings.Index(strings.ToLower(path), ".zip"); i != -1 {
+				path = path[:i+4]
+			}
+		} else if strings.HasPrefix(path, "/vsi") {
+			// remote sources
+			return ""
+		}
+		return path
+	case "delimitedtext":
+		u, err := url.Parse(datasource)
+		if err != nil || u.Scheme != "file" {
+			return ""
+		}
+		if u.Path != "" {
+			path := u.Path
+			// Windows paths are stored as file:///C:/...
+			if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+				path = path[1:]
+			}
+			return path
+		}
+		return u.Opaque
+	case "spatialite":
+		m := spatialiteDbnameRegex.FindStringSubmatch(datasource)
+		if m == nil {
+			return ""
+		}
+		return strings.ReplaceAll(m[1], `\'`, `'`)
+	}
+	return ""
+}
+
+// Kinds of data source paths
+const (
+	SourceRelativeInProject      = "relative"
+	SourceRelativeOutsideProject = "relative_outside"
+	SourceAbsolute               = "absolute"
+)
+
+// Data source of the layer in QGIS project
+type ProjectSource struct {
+	// path as stored in the project file
+	Path string `json:"path"`
+	// absolute path (resolved against the directory of the project file)
+	Resolved string `json:"resolved"`
+	Provider string `json:"provider"`
+	Kind     string `json:"kind"`
+}
+
+var windowsAbsPathRegex = regexp.MustCompile(`^([A-Za-z]:)?[\\/]`)
+
+// Reports whether the path is absolute in either POSIX or Windows style, independently
+// of the host OS
+func isAbsPathAnyOS(path string) bool {
+	return windowsAbsPathRegex.MatchString(path)
+}
+
+// Returns file based data sources of layers in the QGIS project (.qgs or .qgz)
+func ParseProjectSourcesDetailed(qgsPath string) ([]ProjectSource, error) {
+	content, err := ReadProjectFile(qgsPath)
+	if err != nil {
+		return nil, err
+	}
+	baseDir := filepath.Dir(qgsPath)
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	sources := []ProjectSource{}
+	found := make(map[string]bool)
+
+	var layerDepth int
+	var datasource, provider string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("parsing project file: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "maplayer" {
+				layerDepth++
+				datasource, provider = "", ""
+			}
+			text.Reset()
+		case xml.CharData:
+			if layerDepth > 0 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if layerDepth == 0 {
+				continue
+			}
+			switch t.Name.Local {
+			case "datasource":
+				datasource = strings.TrimSpace(text.String())
+			case "provider":
+				provider = strings.TrimSpace(text.String())
+			case "maplayer":
+				layerDepth--
+				if !fileProviders[provider] {
+					continue
+				}
+				path := datasourcePath(provider, datasource)
+				if path == "" || found[path] {
+					continue
+				}
+				found[path] = true
+				src := ProjectSource{Path: path, Provider: provider, Kind: SourceRelativeInProject}
+				if isAbsPathAnyOS(path) {
+					src.Kind = SourceAbsolute
+					src.Resolved = filepath.Clean(filepath.FromSlash(path))
+				} else {
+					src.Resolved = filepath.Join(baseDir, filepath.FromSlash(strings.ReplaceAll(path, "\\", "/")))
+				}
+				sources = append(sources, src)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// Returns absolute paths of file based data sources of layers in the QGIS project (.qgs or .qgz).
+// Relative paths are resolved against the directory of the project file.
+func ParseProjectSources(qgsPath string) ([]string, error) {
+	sources, err := ParseProjectSourcesDetailed(qgsPath)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(sources))
+	for i, src := range sources {
+		paths[i] = src.Resolved
+	}
+	return paths, nil
+}
+
+type sourceWarning struct {
+	Project string `json:"project"`
+	ProjectSource
+}
+
+type projectSourcesCheck struct {
+	// data sources located outside of the project directory
+	External []string
+	// data sources which don't exist on disk (broken layers)
+	Missing []string
+	// data sources stored with absolute paths or relative paths leading outside of the project
+	Warnings []sourceWarning
+}
+
+// Data sources parsed from the project file of given size and modification time
+type cachedProjectSources struct {
+	size    int64
+	mtime   int64
+	sources []ProjectSource
+}
+
+// Returns data sources of the project file, parsed sources are reused until the file
+// is modified
+func (c *Client) cachedProjectSources(path string, size, mtime int64) ([]ProjectSource, error) {
+	c.cacheMutex.Lock()
+	cached, ok := c.projectSources[path]
+	c.cacheMutex.Unlock()
+	if ok && cached.size == size && cached.mtime == mtime {
+		return cached.sources, nil
+	}
+	sources, err := ParseProjectSourcesDetailed(path)
+	if err != nil {
+		return nil, err
+	}
+	c.cacheMutex.Lock()
+	c.projectSources[path] = cachedProjectSources{size: size, mtime: mtime, sources: sources}
+	c.cacheMutex.Unlock()
+	return sources, nil
+}
+
+// Checks data sources of all project files in the project directory
+func (c *Client) checkProjectSources(directory string, files []FileInfo) projectSourcesCheck {
+	check := projectSourcesCheck{External: []string{}, Missing: []string{}, Warnings: []sourceWarning{}}
+	for _, f := range files {
+		if !f.ProjectFile {
+			continue
+		}
+		sources, err := c.cachedProjectSources(filepath.Join(directory, filepath.FromSlash(f.Path)), f.Size, f.Mtime)
+		if err != nil {
+			log.Printf("Failed to parse project file %s: %s\n", f.Path, err)
+			continue
+		}
+		for _, src := range sources {
+			inProject := isWithinDir(directory, src.Resolved)
+			if !inProject {
+				check.External = append(check.External, src.Resolved)
+				if src.Kind == SourceRelativeInProject {
+					src.Kind = SourceRelativeOutsideProject
+				}
+			}
+			if src.Kind != SourceRelativeInProject {
+				check.Warnings = append(check.Warnings, sourceWarning{Project: f.Path, ProjectSource: src})
+			}
+			if _, err := os.Stat(src.Resolved); errors.Is(err, os.ErrNotExist) {
+				missing := src.Resolved
+				if inProject {
+					relPath, _ := filepath.Rel(directory, missing)
+					missing = filepath.ToSlash(relPath)
+				}
+				check.Missing = append(check.Missing, missing)
+			}
+		}
+	}
+	return check
+}
+
+type ProjectExtent struct {
+	Xmin float64 `json:"xmin" xml:"xmin"`
+	Ymin float64 `json:"ymin" xml:"ymin"`
+	Xmax float64 `json:"xmax" xml:"xmax"`
+	Ymax float64 `json:"ymax" xml:"ymax"`
+}
+
+// Basic metadata of QGIS project
+type ProjectInfo struct {
+	Crs    string        `json:"crs"`
+	Extent ProjectExtent `json:"extent"`
+}
+
+// Reads project CRS and saved map canvas extent from the QGIS project (.qgs or .qgz).
+// Missing or malformed metadata are returned as zero values.
+func ProjectMetadata(qgsPath string) (ProjectInfo, error) {
+	var info ProjectInfo
+	content, err := ReadProjectFile(qgsPath)
+	if err != nil {
+		return info, err
+	}
+	var doc struct {
+		Crs      string `xml:"projectCrs>spatialrefsys>authid"`
+		Canvases []struct {
+			Name   string        `xml:"name,attr"`
+			Extent ProjectExtent `xml:"extent"`
+		} `xml:"mapcanvas"`
+	}
+	if err := xml.Unmarshal(content, &doc); err != nil {
+		log.Printf("Failed to parse project metadata: %s\n", err)
+		return info, nil
+	}
+	info.Crs = strings.TrimSpace(doc.Crs)
+	for _, canvas := range doc.Canvases {
+		if canvas.Name == "theMapCanvas" || len(doc.Canvases) == 1 {
+			info.Extent = canvas.Extent
+			break
+		}
+	}
+	return info, nil
+}
+
+// Returns relative path of the project file in the root of the project directory
+func findProjectFile(directory string) (string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && isProjectFile(e.Name()) {
+			return e.Name(), nil
+		}
+	}
+	return "", errors.New("project file not found")
+}
+
+// Sends metadata of the project file (the project file in the root of the project directory
+// is used when the path is not specified)
+func (c *Client) handleProjectMetadata(msg message) error {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &params); err != nil {
+			return err
+		}
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	directory = filepath.FromSlash(directory)
+	if params.Path == "" {
+		if params.Path, err = findProjectFile(directory); err != nil {
+			return err
+		}
+	}
+	qgsPath, err := resolveProjectPath(directory, params.Path)
+	if err != nil {
+		return err
+	}
+	info, err := ProjectMetadata(qgsPath)
+	if err != nil {
+		return fmt.Errorf("reading project metadata: %w", err)
+	}
+	return c.SendDataResponse(msg, info)
+}
@@ -0,0 +1,32 @@
+package gisquick
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Data sources are parsed only when the project file changes
+func TestCheckProjectSourcesCached(t *testing.T) {
+	dir := t.TempDir()
+	project := func(source string) string {
+		return `<qgis><projectlayers><maplayer><provider>ogr</provider><datasource>` + source + `</datasource></maplayer></projectlayers></qgis>`
+	}
+	writeFiles(t, dir, map[string]string{"project.qgs": project("../external.gpkg")})
+	c := NewClient("http://localhost", "user", "")
+	files := []FileInfo{{Path: "project.qgs", ProjectFile: true, Size: 100, Mtime: 1000}}
+
+	check := c.checkProjectSources(dir, files)
+	external := filepath.Join(filepath.Dir(dir), "external.gpkg")
+	if len(check.External) != 1 || check.External[0] != external {
+		t.Fatalf("unexpected external sources: %v", check.External)
+	}
+	// project file with unchanged size and modification time is not parsed again
+	writeFiles(t, dir, map[string]string{"project.qgs": project("points.gpkg")})
+	if check := c.checkProjectSources(dir, files); len(check.External) != 1 {
+		t.Errorf("cached sources were not used: %v", check.External)
+	}
+	files[0].Mtime++
+	if check := c.checkProjectSources(dir, files); len(check.External) != 0 || len(check.Missing) != 1 || check.Missing[0] != "points.gpkg" {
+		t.Errorf("sources of modified project: %+v", check)
+	}
+}
@@ -0,0 +1,50 @@
+package gisquick
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Computes hash of the content of zipped QGIS project (.qgz). QGIS writes new timestamps
+// into the archive on every save, so only names and uncompressed content of entries are
+// hashed (in order of their names).
+func QgzHash(path string) (string, error) {
+	return qgzHash(context.Background(), path)
+}
+
+func qgzHash(ctx context.Context, path string) (string, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	entries := make([]*zip.File, 0, len(archive.File))
+	for _, entry := range archive.File {
+		if !strings.HasSuffix(entry.Name, "/") {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	h := sha1.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%s\x00%d\x00", entry.Name, entry.UncompressedSize64)
+		src, err := entry.Open()
+		if err != nil {
+			return "", fmt.Errorf("reading %s: %w", entry.Name, err)
+		}
+		// content is verified against CRC of the entry when reading is finished
+		_, err = copyBuffer(h, &progressReader{ctx: ctx, r: src})
+		src.Close()
+		if err != nil {
+			return "", fmt.Errorf("reading %s: %w", entry.Name, err)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,79 @@
+package gisquick
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type qgzEntry struct {
+	name, content string
+}
+
+var qgzEntries = []qgzEntry{
+	{"project.qgs", `<qgis version="3.28.0"><layer id="points"/></qgis>`},
+	{"project.qgd", "auxiliary storage"},
+}
+
+// Writes .qgz archive with given entries, their modification time and compression level
+func writeQgz(t *testing.T, path string, entries []qgzEntry, mtime time.Time, level int) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	for _, e := range entries {
+		method := zip.Deflate
+		if level == flate.NoCompression {
+			method = zip.Store
+		}
+		entry, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Method: method, Modified: mtime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(entry, e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQgzHash(t *testing.T) {
+	dir := t.TempDir()
+	saved := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	reversed := []qgzEntry{qgzEntries[1], qgzEntries[0]}
+	modified := []qgzEntry{{qgzEntries[0].name, `<qgis version="3.28.0"><layer id="lines"/></qgis>`}, qgzEntries[1]}
+
+	writeQgz(t, filepath.Join(dir, "a.qgz"), qgzEntries, saved, flate.BestSpeed)
+	writeQgz(t, filepath.Join(dir, "b.qgz"), qgzEntries, saved.Add(time.Hour), flate.BestCompression)
+	writeQgz(t, filepath.Join(dir, "c.qgz"), reversed, saved, flate.NoCompression)
+	writeQgz(t, filepath.Join(dir, "d.qgz"), modified, saved, flate.BestSpeed)
+
+	hashes := make(map[string]string)
+	for _, name := range []string{"a.qgz", "b.qgz", "c.qgz", "d.qgz"} {
+		hash, err := QgzHash(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[name] = hash
+	}
+	if hashes["a.qgz"] != hashes["b.qgz"] {
+		t.Errorf("hash depends on timestamps or compression level: %s != %s", hashes["a.qgz"], hashes["b.qgz"])
+	}
+	if hashes["a.qgz"] != hashes["c.qgz"] {
+		t.Errorf("hash depends on order of entries or compression method: %s != %s", hashes["a.qgz"], hashes["c.qgz"])
+	}
+	if hashes["a.qgz"] == hashes["d.qgz"] {
+		t.Error("hash of modified project is not changed")
+	}
+}
@@ -0,0 +1,109 @@
+package gisquick
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Connection states reported to OnStateChange callback
+const (
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateDisconnected = "disconnected"
+)
+
+// Initial connection state reported by Status (not passed to OnStateChange)
+const StateConnecting = "connecting"
+
+func (c *Client) setState(state string) {
+	c.connMutex.Lock()
+	c.state = state
+	c.connMutex.Unlock()
+	if c.Debug {
+		log.Printf("Connection state: %s\n", state)
+	}
+	if c.OnStateChange != nil {
+		c.OnStateChange(state)
+	}
+}
+
+// Error returned when reconnection attempts are exhausted. It matches ErrReconnectFailed
+// and wraps the error of the last attempt.
+type ReconnectError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrReconnectFailed, e.Err)
+}
+
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ReconnectError) Is(target error) bool {
+	return target == ErrReconnectFailed
+}
+
+// Returns delay before the reconnection attempt (numbered from 1), growing exponentially
+// up to MaxReconnectDelay, with random jitter
+func (c *Client) reconnectDelay(attempt int, rnd *rand.Rand) time.Duration {
+	delay := c.ReconnectBaseDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 1; i < attempt && (c.MaxReconnectDelay <= 0 || delay < c.MaxReconnectDelay); i++ {
+		delay *= 2
+	}
+	if c.MaxReconnectDelay > 0 && delay > c.MaxReconnectDelay {
+		delay = c.MaxReconnectDelay
+	}
+	if c.ReconnectJitter > 0 {
+		delay += time.Duration(float64(delay) * c.ReconnectJitter * (2*rnd.Float64() - 1))
+	}
+	return delay
+}
+
+// Reconnects to the server after the connection was lost, until Stop is called or the
+// limit of consecutive failed attempts is reached
+func (c *Client) reconnect(OnConnectionEstabilished func(), established bool) error {
+	// own source, so plugins restarted at the same time don't share the sequence of delays
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	attempt := 0
+	var lastErr error
+	for {
+		if established {
+			attempt = 0
+		}
+		attempt++
+		if c.MaxReconnectAttempts > 0 && attempt > c.MaxReconnectAttempts {
+			c.setState(StateDisconnected)
+			if lastErr != nil {
+				return &ReconnectError{Attempts: c.MaxReconnectAttempts, Err: lastErr}
+			}
+			return ErrReconnectFailed
+		}
+		c.setState(StateReconnecting)
+		delay := c.reconnectDelay(attempt, rnd)
+		log.Printf("Connection lost, reconnecting in %s (attempt %d)\n", delay.Round(time.Millisecond), attempt)
+		select {
+		case <-c.interrupt:
+			c.setState(StateDisconnected)
+			return nil
+		case <-time.After(delay):
+		}
+		var stopped bool
+		established, stopped, lastErr = c.connect(OnConnectionEstabilished)
+		c.recordError(lastErr)
+		if stopped {
+			c.setState(StateDisconnected)
+			return nil
+		}
+		if lastErr != nil {
+			log.Printf("Reconnection failed: %s\n", lastErr)
+		}
+	}
+}
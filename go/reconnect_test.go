@@ -0,0 +1,39 @@
+package gisquick
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var errLoginRejected = errors.New("login rejected")
+
+// Error of exhausted reconnection attempts keeps the error of the last attempt
+func TestReconnectError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, "user", "password")
+	c.MaxReconnectAttempts = 2
+	c.ReconnectBaseDelay = time.Millisecond
+
+	err := c.reconnect(nil, false)
+	if !errors.Is(err, ErrReconnectFailed) {
+		t.Fatalf("expected ErrReconnectFailed, got %v", err)
+	}
+	var reconnectErr *ReconnectError
+	if !errors.As(err, &reconnectErr) || reconnectErr.Attempts != 2 || reconnectErr.Err == nil {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if errors.Unwrap(err) != reconnectErr.Err {
+		t.Error("error of the last attempt is not wrapped")
+	}
+
+	wrapped := &ReconnectError{Attempts: 1, Err: errLoginRejected}
+	if !errors.Is(wrapped, ErrReconnectFailed) || !errors.Is(wrapped, errLoginRejected) {
+		t.Error("both error chains should match")
+	}
+}
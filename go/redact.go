@@ -0,0 +1,67 @@
+package gisquick
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "xxxxx"
+
+// Headers which must never appear in logs
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// Returns server URL with masked password (when specified in URL)
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// Returns copy of headers with masked values of sensitive headers
+func redactHeaders(header http.Header) http.Header {
+	clean := header.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := clean[name]; ok {
+			clean.Set(name, redacted)
+		}
+	}
+	return clean
+}
+
+func formatHeaders(header http.Header) string {
+	var parts []string
+	for name, values := range redactHeaders(header) {
+		parts = append(parts, fmt.Sprintf("%s: %s", name, strings.Join(values, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Logs HTTP request and response (in debug mode), sensitive headers are masked
+func logHTTP(req *http.Request, resp *http.Response, err error) {
+	if err != nil {
+		log.Printf("HTTP %s %s [%s]: %s\n", req.Method, redactURL(req.URL.String()), formatHeaders(req.Header), err)
+		return
+	}
+	log.Printf("HTTP %s %s [%s] -> %s [%s]\n", req.Method, redactURL(req.URL.String()), formatHeaders(req.Header), resp.Status, formatHeaders(resp.Header))
+}
+
+// Returns description of the client with masked credentials
+func (c *Client) String() string {
+	password, token := "", ""
+	if c.Password != "" {
+		password = redacted
+	}
+	if c.Token != "" {
+		token = redacted
+	}
+	return fmt.Sprintf("Client{Server: %s, User: %s, Password: %s, Token: %s}", redactURL(c.Server), c.User, password, token)
+}
+
+func (c *Client) GoString() string {
+	return "&gisquick." + c.String()
+}
@@ -0,0 +1,64 @@
+package gisquick
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Runs the client against a test server (login succeeds, websocket connection is rejected)
+// and checks that the credentials don't appear in the log output
+func TestCredentialsNotLogged(t *testing.T) {
+	const password = "s3cret-Passw0rd"
+	const token = "t0ken-9f8e7d6c"
+	const session = "session-4b3a2910"
+	const urlPassword = "url-Passw0rd"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth/login/" {
+			http.SetCookie(w, &http.Cookie{Name: "sessionid", Value: session, Path: "/"})
+			return
+		}
+		if r.URL.Path == "/api/auth/logout/" {
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(output)
+
+	tokenClient := NewClient(srv.URL, "user", "")
+	tokenClient.Token = token
+	urlClient := NewClient(strings.Replace(srv.URL, "://", "://user:"+urlPassword+"@", 1), "user", password)
+	for _, c := range []*Client{NewClient(srv.URL, "user", password), tokenClient, urlClient} {
+		c.Debug = true
+		if err := c.Start(nil); err == nil {
+			t.Fatal("expected websocket connection to fail")
+		} else {
+			log.Printf("Connection failed: %s\n", err)
+		}
+		log.Printf("%v %+v %#v %s\n", c, c, c, c)
+		status, _ := json.Marshal(c.Status())
+		log.Printf("Status: %s\n", status)
+		log.Println(fmt.Sprint(c))
+	}
+
+	logged := buf.String()
+	if !strings.Contains(logged, "HTTP POST") || !strings.Contains(logged, "Cookie: "+redacted) {
+		t.Fatalf("HTTP requests were not logged:\n%s", logged)
+	}
+	for _, secret := range []string{password, token, session, urlPassword} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("log output contains %q:\n%s", secret, logged)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package gisquick
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Returns list of project files stored on the server. Paginated responses are
+// followed until the last page.
+func (c *Client) RemoteFiles(ctx context.Context, project string) ([]FileInfo, error) {
+	files := []FileInfo{}
+	pageURL := c.apiURL("api/project/files", project)
+	for pageURL != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("requesting project files: %w", err)
+		}
+		var page struct {
+			Files []FileInfo `json:"files"`
+			Next  string     `json:"next"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %s", ErrServerResponse, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing project files: %w", err)
+		}
+		files = append(files, page.Files...)
+		pageURL = ""
+		if page.Next != "" {
+			next, err := req.URL.Parse(page.Next)
+			if err != nil {
+				return nil, fmt.Errorf("parsing next page URL: %w", err)
+			}
+			pageURL = next.String()
+		}
+	}
+	return files, nil
+}
+
+func (c *Client) handleRemoteFiles(msg message) error {
+	var params struct {
+		Project string `json:"project"`
+	}
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	go func() {
+		files, err := c.RemoteFiles(context.Background(), params.Project)
+		if err != nil {
+			c.SendErrorResponse(msg, "Failed to get server files: "+err.Error())
+			return
+		}
+		c.SendDataResponse(msg, files)
+	}()
+	return nil
+}
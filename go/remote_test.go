@@ -0,0 +1,43 @@
+package gisquick
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteFilesPagination(t *testing.T) {
+	pages := map[string]interface{}{
+		"": map[string]interface{}{
+			"files": []FileInfo{{Path: "project.qgs", Hash: "a"}},
+			"next":  "/api/project/files/user/project?page=2",
+		},
+		"2": map[string]interface{}{
+			"files": []FileInfo{{Path: "data/points.gpkg", Hash: "b"}},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Query().Get("page")]
+		if !ok || r.URL.Path != "/api/project/files/user/project" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "user", "")
+	files, err := c.RemoteFiles(context.Background(), "user/project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Path != "project.qgs" || files[1].Path != "data/points.gpkg" {
+		t.Errorf("unexpected files: %+v", files)
+	}
+
+	if _, err := c.RemoteFiles(context.Background(), "user/missing"); err == nil {
+		t.Error("expected error of missing project")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package gisquick
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Replaces destination file with the source file. When the files are on different devices
+// (e.g. overlay or network mounts), the file is copied instead.
+func replaceFile(src, dest string) error {
+	err := os.Rename(src, dest)
+	if err != nil && isCrossDevice(err) {
+		return copyReplaceFile(src, dest)
+	}
+	return err
+}
+
+// Reports whether the rename failed because the destination is on another device
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// Reports whether the operation failed because the file is opened by another process
+// (files are not locked on this platform)
+func isFileLocked(err error) bool {
+	return false
+}
@@ -0,0 +1,55 @@
+package gisquick
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Replaces destination file with the source file. Files opened in other applications
+// (e.g. GeoPackage layers in QGIS) cannot be replaced on Windows, so the rename of a locked
+// file is retried for a short time and then the file is saved next to the destination
+// as <name>.new instead. Other errors are returned immediately. When the files are on
+// different volumes, the file is copied.
+func replaceFile(src, dest string) error {
+	var err error
+	delay := 50 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		if err = os.Rename(src, dest); err == nil {
+			return nil
+		}
+		if isCrossDevice(err) {
+			return copyReplaceFile(src, dest)
+		}
+		if !isFileLocked(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	newPath := dest + ".new"
+	os.Remove(newPath)
+	if rerr := os.Rename(src, newPath); rerr != nil {
+		return err
+	}
+	return fmt.Errorf("%w, saved as %s: %s", ErrFileLocked, filepath.Base(newPath), err)
+}
+
+const (
+	errorNotSameDevice    syscall.Errno = 17
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// Reports whether the rename failed because the destination is on another volume
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice) || errors.Is(err, syscall.EXDEV)
+}
+
+// Reports whether the operation failed because the file is opened by another process
+func isFileLocked(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
@@ -0,0 +1,231 @@
+package gisquick
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync state of the project directory - files as they were after the last successful upload
+// or fetch. It's used as a baseline to distinguish local changes from changes on the server.
+var syncStateFile = filepath.Join(".gisquick", "state.json")
+
+const syncStateVersion = 1
+
+// Changed state is written into the file after this number of changes or this time since
+// the last write, so most of the progress survives interrupted synchronization
+const (
+	syncStateSaveChanges  = 20
+	syncStateSaveInterval = 5 * time.Second
+)
+
+type syncStateEntry struct {
+	Hash        string `json:"hash,omitempty"`
+	Size        int64  `json:"size"`
+	Mtime       int64  `json:"mtime"`
+	HashSkipped bool   `json:"hash_skipped,omitempty"`
+}
+
+type syncState struct {
+	Version int `json:"version"`
+	// version of the server project at the last synchronization (as provided by the server)
+	ServerVersion string `json:"server_version,omitempty"`
+	// files keyed by slash separated relative paths
+	Files map[string]syncStateEntry `json:"files"`
+}
+
+// Sync state of a project directory. Entries are recorded for every transferred file and
+// written in small batches, so the state stays valid also after a partially finished
+// (or interrupted) synchronization.
+type syncStateStore struct {
+	root    string
+	mutex   sync.Mutex
+	state   syncState
+	changed bool
+	// number of changes since the last write
+	unsaved  int
+	lastSave time.Time
+}
+
+// Returns sync state of the project directory, loaded from the file when used for the first time
+func (c *Client) syncState(root string) *syncStateStore {
+	root, _ = filepath.Abs(root)
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	if s, ok := c.syncStates[root]; ok {
+		return s
+	}
+	s := &syncStateStore{root: root}
+	if err := s.load(); err != nil {
+		log.Printf("Failed to load sync state: %s\n", err)
+	}
+	c.syncStates[root] = s
+	return s
+}
+
+func (s *syncStateStore) load() error {
+	s.state = syncState{Version: syncStateVersion, Files: make(map[string]syncStateEntry)}
+	data, err := os.ReadFile(filepath.Join(s.root, syncStateFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parsing sync state: %w", err)
+	}
+	if state.Version == syncStateVersion && state.Files != nil {
+		s.state = state
+	}
+	return nil
+}
+
+// Writes the state when enough changes were made since the last write, expects locked mutex
+func (s *syncStateStore) saveBatch() {
+	s.unsaved++
+	if s.unsaved < syncStateSaveChanges && time.Since(s.lastSave) < syncStateSaveInterval {
+		return
+	}
+	if err := s.write(); err != nil {
+		log.Printf("Failed to save sync state: %s\n", err)
+	}
+}
+
+// Records synchronized files, server version is updated when not empty
+func (s *syncStateStore) record(files []FileInfo, serverVersion string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, f := range files {
+		s.state.Files[filepath.ToSlash(f.Path)] = syncStateEntry{
+			Hash:        f.Hash,
+			Size:        f.Size,
+			Mtime:       f.Mtime,
+			HashSkipped: f.HashSkipped,
+		}
+	}
+	if serverVersion != "" {
+		s.state.ServerVersion = serverVersion
+	}
+	s.changed = true
+	s.saveBatch()
+}
+
+// Removes files which no longer exist on both sides, a directory path removes all files
+// within it
+func (s *syncStateStore) remove(paths ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range paths {
+		p = filepath.ToSlash(p)
+		delete(s.state.Files, p)
+		for f := range s.state.Files {
+			if strings.HasPrefix(f, p+"/") {
+				delete(s.state.Files, f)
+			}
+		}
+	}
+	s.changed = true
+	s.saveBatch()
+}
+
+// Returns entry of the file (slash separated relative path) from the last synchronization
+func (s *syncStateStore) entry(path string) (syncStateEntry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.state.Files[filepath.ToSlash(path)]
+	return e, ok
+}
+
+// Returns files of the last synchronized version sorted by path
+func (s *syncStateStore) baseline() []FileInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files := make([]FileInfo, 0, len(s.state.Files))
+	for path, e := range s.state.Files {
+		files = append(files, FileInfo{Path: path, Hash: e.Hash, Size: e.Size, Mtime: e.Mtime, HashSkipped: e.HashSkipped})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// Writes the state into the file when it was changed
+func (s *syncStateStore) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write()
+}
+
+func (s *syncStateStore) write() error {
+	if !s.changed {
+		return nil
+	}
+	s.unsaved = 0
+	s.lastSave = time.Now()
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.root, syncStateFile), data); err != nil {
+		return fmt.Errorf("writing sync state: %w", err)
+	}
+	s.changed = false
+	return nil
+}
+
+// Records the local file (slash separated relative path) after transfer. Hash is computed
+// the same way as when listing project files, so the entry matches the next scan. The entry
+// is removed when the file can't be read.
+func (c *Client) recordLocalFile(ctx context.Context, root, relPath, serverVersion string) {
+	state := c.syncState(root)
+	absPath := filepath.Join(root, filepath.FromSlash(relPath))
+	info, err := os.Stat(absPath)
+	if err != nil {
+		log.Printf("Failed to record sync state of %s: %s\n", relPath, err)
+		state.remove(relPath)
+		return
+	}
+	f := FileInfo{Path: relPath, Size: info.Size(), Mtime: info.ModTime().Unix()}
+	if c.skipHash(f.Size) {
+		f.HashSkipped = true
+	} else if f.Hash, err = c.cachedChecksum(ctx, absPath, f.Size, f.Mtime); err != nil {
+		log.Printf("Failed to record sync state of %s: %s\n", relPath, err)
+		state.remove(relPath)
+		return
+	}
+	state.record([]FileInfo{f}, serverVersion)
+}
+
+// Removes deleted files from the sync state and saves it
+func (c *Client) recordDeleted(root string, deleted []deletedEntry, serverVersion string) {
+	if len(deleted) == 0 {
+		return
+	}
+	state := c.syncState(root)
+	for _, entry := range deleted {
+		state.remove(entry.Path)
+	}
+	state.record(nil, serverVersion)
+	if err := state.save(); err != nil {
+		log.Printf("Failed to save sync state: %s\n", err)
+	}
+}
+
+// Stores ETags and sync state of the project directory after transfer of files
+func (c *Client) saveTransferState(root string) {
+	if err := c.etagStore(root).save(); err != nil {
+		log.Printf("Failed to save ETags: %s\n", err)
+	}
+	if err := c.syncState(root).save(); err != nil {
+		log.Printf("Failed to save sync state: %s\n", err)
+	}
+}
@@ -0,0 +1,70 @@
+package gisquick
+
+import "time"
+
+// Snapshot of the client state, it can be requested from any goroutine
+type ClientStatus struct {
+	// connection state (StateConnecting, StateConnected, StateReconnecting or StateDisconnected)
+	State     string `json:"state"`
+	Connected bool   `json:"connected"`
+	// server URL, password is masked when the URL contains it
+	Server string `json:"server"`
+	User   string `json:"user"`
+	// duration of the current connection in seconds (zero when not connected)
+	Uptime float64 `json:"uptime"`
+	// last connection error
+	LastError string        `json:"last_error,omitempty"`
+	Pending   pendingCounts `json:"pending"`
+}
+
+// Numbers of running operations
+type pendingCounts struct {
+	Uploads  int `json:"uploads"`
+	Fetches  int `json:"fetches"`
+	Scans    int `json:"scans"`
+	Requests int `json:"requests"`
+	Locks    int `json:"locks"`
+}
+
+// Stores error of the connection attempt (nil errors are ignored)
+func (c *Client) recordError(err error) {
+	if err == nil {
+		return
+	}
+	c.connMutex.Lock()
+	c.lastError = err.Error()
+	c.connMutex.Unlock()
+}
+
+// Returns current state of the connection and counts of running operations
+func (c *Client) Status() ClientStatus {
+	status := ClientStatus{Server: redactURL(c.Server), User: c.User}
+	c.connMutex.Lock()
+	status.State = c.state
+	status.Connected = c.connected
+	status.LastError = c.lastError
+	if c.connected {
+		status.Uptime = time.Since(c.connectedAt).Seconds()
+	}
+	c.connMutex.Unlock()
+	if status.State == "" {
+		status.State = StateDisconnected
+	}
+
+	c.uploadMutex.Lock()
+	if c.upload != nil {
+		status.Pending.Uploads = 1
+	}
+	c.uploadMutex.Unlock()
+	c.fetchOpsMutex.Lock()
+	status.Pending.Fetches = len(c.fetchOps)
+	status.Pending.Scans = len(c.scans)
+	c.fetchOpsMutex.Unlock()
+	c.pendingMutex.Lock()
+	status.Pending.Requests = len(c.pendingRequests)
+	c.pendingMutex.Unlock()
+	c.locksMutex.Lock()
+	status.Pending.Locks = len(c.projectLocks)
+	c.locksMutex.Unlock()
+	return status
+}
@@ -0,0 +1,804 @@
+package gisquick
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type SyncMode string
+
+const (
+	// uploads new and locally modified files
+	SyncPush SyncMode = "push"
+	// fetches new and remotely modified files
+	SyncPull SyncMode = "pull"
+	// makes local project identical to the server version (local files which are not on the
+	// server are deleted only when enabled by SyncOptions.DeleteExtraneous)
+	SyncMirror SyncMode = "mirror"
+	// transfers files changed on either side since the baseline, stops on conflicts
+	// (SyncProject only)
+	SyncTwoWay SyncMode = "two-way"
+)
+
+type SyncOptions struct {
+	// Deletes local files which don't exist on the server in mirror mode (similar to
+	// rsync --delete). Files ignored by .gisquickignore are never deleted.
+	DeleteExtraneous bool
+	// ID of the operation for AbortFetch message, generated when empty
+	ID string
+}
+
+// Files to be transferred or deleted by the sync operation
+type SyncPlan struct {
+	Upload []FileInfo `json:"upload"`
+	Fetch  []FileInfo `json:"fetch"`
+	Delete []FileInfo `json:"delete"`
+	// renames performed instead of transfer of files (on the server in push mode, locally
+	// in pull mode)
+	Rename []RenameEntry `json:"rename,omitempty"`
+	// detected renames which are transferred anyway (e.g. not supported by server)
+	DetectedRenames []RenameEntry `json:"detected_renames,omitempty"`
+}
+
+type syncProgress struct {
+	Phase string `json:"phase"`
+	File  string `json:"file,omitempty"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+}
+
+// Splits hash value into algorithm name and the hash itself. Hashes without prefix are SHA-1.
+func splitHash(hash string) (string, string) {
+	if i := strings.Index(hash, ":"); i != -1 {
+		return hash[:i], hash[i+1:]
+	}
+	return "sha1", hash
+}
+
+// Compares files by hash when both hashes were computed with the same algorithm,
+// otherwise (e.g. large files without checksum) by size and modification time
+func sameContent(a, b FileInfo) bool {
+	if a.Hash != "" && b.Hash != "" && !a.HashSkipped && !b.HashSkipped {
+		algA, hashA := splitHash(a.Hash)
+		algB, hashB := splitHash(b.Hash)
+		if algA == algB {
+			return hashA == hashB
+		}
+	}
+	return a.Size == b.Size && a.Mtime == b.Mtime
+}
+
+// Combines hashes of files into a single tree hash. Files are sorted by path, so the result
+// doesn't depend on the order of files. Paths are included, so moved files change the hash.
+func TreeHash(files []FileInfo) string {
+	entries := make([]string, len(files))
+	for i, f := range files {
+		if f.HashSkipped {
+			// large files without checksum are identified by size and modification time
+			entries[i] = fmt.Sprintf("%s\x00size:%d:%d", filepath.ToSlash(f.Path), f.Size, f.Mtime)
+			continue
+		}
+		entries[i] = filepath.ToSlash(f.Path) + "\x00" + f.Hash
+	}
+	sort.Strings(entries)
+	h := sha256.New()
+	for _, e := range entries {
+		h.Write([]byte(e))
+		h.Write([]byte("\n"))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Computes tree hash of all files in the project directory
+func (c *Client) ProjectHash(ctx context.Context, root string) (string, error) {
+	files, _, err := c.ListDirContext(ctx, root, true)
+	if err != nil {
+		return "", err
+	}
+	return TreeHash(files), nil
+}
+
+func (c *Client) handleProjectHash(msg message) error {
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	hash, err := c.ProjectHash(c.connectionContext(), filepath.FromSlash(directory))
+	if err != nil {
+		return fmt.Errorf("computing project hash: %w", err)
+	}
+	return c.SendDataResponse(msg, map[string]string{"hash": hash})
+}
+
+// Compares local and remote files and computes plan of the sync operation for given mode,
+// see ComputeSyncPlanWithBase. All paths are expected in slash separated form.
+func ComputeSyncPlan(local, remote []FileInfo, mode SyncMode, opts SyncOptions) SyncPlan {
+	return ComputeSyncPlanWithBase(local, remote, nil, mode, opts)
+}
+
+// Computes plan of the sync operation from the comparison of local and remote files with
+// the base (files after the last synchronization, optional), see DiffManifestsWithBase.
+// Push mode uploads files changed locally and pull mode fetches files changed on the server,
+// files changed on both sides (or without known base) are resolved in favour of the local
+// or server version. Mirror mode fetches all server files which differ.
+func ComputeSyncPlanWithBase(local, remote, base []FileInfo, mode SyncMode, opts SyncOptions) SyncPlan {
+	plan, _ := planProjectSync(diffManifests(local, remote, base), mode, opts.DeleteExtraneous, false)
+	plan.DetectedRenames = nil
+	return plan
+}
+
+// File with different content in the local directory and on the server
+type fileDiff struct {
+	Path   string   `json:"path"`
+	Local  FileInfo `json:"local"`
+	Server FileInfo `json:"server"`
+	// side changed since the baseline ("local" or "server"), empty when unknown
+	Changed string `json:"changed,omitempty"`
+}
+
+// Differences between local project files and the server version of the project
+type ProjectDiff struct {
+	// local files which are not on the server
+	New []FileInfo `json:"new"`
+	// files changed only locally or only on the server (or both without known baseline)
+	Modified []fileDiff `json:"modified"`
+	// server files which don't exist locally
+	Missing []FileInfo `json:"missing"`
+	// files with the same content
+	Identical []FileInfo `json:"identical"`
+	// files changed both locally and on the server since the baseline
+	Conflicting []fileDiff `json:"conflicting"`
+	// new local files with the same content as missing server files (probably renamed), the
+	// files are listed also in New and Missing lists
+	Renamed []fileRename `json:"renamed"`
+}
+
+// Local file and server file at different paths with the same content
+type fileRename struct {
+	Local  string `json:"local"`
+	Server string `json:"server"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+// Matches local files with server files of the same content (hash and size). When there are
+// more candidates, files with the same name are paired first and then the rest in order
+// of paths, so the result is deterministic. Expects files sorted by path.
+func detectRenames(local, server []FileInfo) []fileRename {
+	key := func(f FileInfo) string {
+		if f.Hash == "" || f.HashSkipped || f.Size == 0 {
+			return ""
+		}
+		alg, hash := splitHash(f.Hash)
+		return fmt.Sprintf("%s:%s:%d", alg, hash, f.Size)
+	}
+	candidates := make(map[string][]FileInfo)
+	for _, f := range server {
+		if k := key(f); k != "" {
+			candidates[k] = append(candidates[k], f)
+		}
+	}
+	groups := make(map[string][]FileInfo)
+	for _, f := range local {
+		if k := key(f); k != "" && len(candidates[k]) > 0 {
+			groups[k] = append(groups[k], f)
+		}
+	}
+	renames := []fileRename{}
+	for k, files := range groups {
+		used := make([]bool, len(candidates[k]))
+		paired := make([]bool, len(files))
+		pair := func(i, j int) {
+			used[j], paired[i] = true, true
+			renames = append(renames, fileRename{Local: files[i].Path, Server: candidates[k][j].Path, Size: files[i].Size, Hash: files[i].Hash})
+		}
+		for i, f := range files {
+			for j, sf := range candidates[k] {
+				if !used[j] && path.Base(sf.Path) == path.Base(f.Path) {
+					pair(i, j)
+					break
+				}
+			}
+		}
+		for i := range files {
+			if paired[i] {
+				continue
+			}
+			for j := range candidates[k] {
+				if !used[j] {
+					pair(i, j)
+					break
+				}
+			}
+		}
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].Local < renames[j].Local })
+	return renames
+}
+
+// Compares local and server files. Baseline (files of the project version which was last
+// synchronized) is used to detect conflicting changes, it's optional. All paths are expected
+// in slash separated form.
+func ComputeProjectDiff(local, server, baseline []FileInfo) ProjectDiff {
+	diff := ProjectDiff{
+		New:         []FileInfo{},
+		Modified:    []fileDiff{},
+		Missing:     []FileInfo{},
+		Identical:   []FileInfo{},
+		Conflicting: []fileDiff{},
+	}
+	serverFiles := make(map[string]FileInfo, len(server))
+	for _, f := range server {
+		serverFiles[f.Path] = f
+	}
+	baseFiles := make(map[string]FileInfo, len(baseline))
+	for _, f := range baseline {
+		baseFiles[f.Path] = f
+	}
+	localFiles := make(map[string]bool, len(local))
+	for _, f := range local {
+		localFiles[f.Path] = true
+		sf, onServer := serverFiles[f.Path]
+		if !onServer {
+			diff.New = append(diff.New, f)
+			continue
+		}
+		if sameContent(f, sf) {
+			diff.Identical = append(diff.Identical, f)
+			continue
+		}
+		entry := fileDiff{Path: f.Path, Local: f, Server: sf}
+		base, ok := baseFiles[f.Path]
+		switch {
+		case !ok:
+			diff.Modified = append(diff.Modified, entry)
+		case sameContent(f, base):
+			entry.Changed = "server"
+			diff.Modified = append(diff.Modified, entry)
+		case sameContent(sf, base):
+			entry.Changed = "local"
+			diff.Modified = append(diff.Modified, entry)
+		default:
+			diff.Conflicting = append(diff.Conflicting, entry)
+		}
+	}
+	for _, f := range server {
+		if !localFiles[f.Path] {
+			diff.Missing = append(diff.Missing, f)
+		}
+	}
+	for _, list := range [][]FileInfo{diff.New, diff.Missing, diff.Identical} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	for _, list := range [][]fileDiff{diff.Modified, diff.Conflicting} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	diff.Renamed = detectRenames(diff.New, diff.Missing)
+	return diff
+}
+
+// Compares local and remote files without a baseline, see DiffManifestsWithBase
+func DiffManifests(local, remote []FileInfo) (toUpload, toFetch, toDelete, conflicts []FileInfo) {
+	return DiffManifestsWithBase(local, remote, nil)
+}
+
+// Result of the comparison of local and remote files with the base
+type manifestDiff struct {
+	ProjectDiff
+	// files changed only locally or only on the server since the base
+	upload, fetch, delete []FileInfo
+	// Local or Server is empty for files which exist only on one side
+	conflicts []fileDiff
+}
+
+// Compares local and remote files (slash separated paths) by content, hashes with different
+// prefixes are compared by size and modification time. Base is the version of files after
+// the last synchronization. Rules:
+//   - file only on one side is transferred to the other one, unless it's in the base, then
+//     it was deleted on the other side: unchanged local file is deleted (toDelete), unchanged
+//     remote file is skipped (deletions aren't propagated to the server) and changed file
+//     is a conflict
+//   - file different on both sides is uploaded when only the local file changed since
+//     the base, fetched when only the remote file changed, otherwise (both changed or not
+//     in the base) it's a conflict
+//
+// Local version of the file is returned in conflicts, or remote version when it doesn't
+// exist locally. No I/O is performed.
+func DiffManifestsWithBase(local, remote, base []FileInfo) (toUpload, toFetch, toDelete, conflicts []FileInfo) {
+	d := diffManifests(local, remote, base)
+	conflicts = make([]FileInfo, len(d.conflicts))
+	for i, c := range d.conflicts {
+		if c.Local.Path != "" {
+			conflicts[i] = c.Local
+		} else {
+			conflicts[i] = c.Server
+		}
+	}
+	return d.upload, d.fetch, d.delete, conflicts
+}
+
+// Implements rules of DiffManifestsWithBase, shared by all sync operations
+func diffManifests(local, remote, base []FileInfo) manifestDiff {
+	d := manifestDiff{
+		ProjectDiff: ComputeProjectDiff(local, remote, base),
+		upload:      []FileInfo{},
+		fetch:       []FileInfo{},
+		delete:      []FileInfo{},
+		conflicts:   []fileDiff{},
+	}
+	baseFiles := make(map[string]FileInfo, len(base))
+	for _, f := range base {
+		baseFiles[f.Path] = f
+	}
+	for _, f := range d.New {
+		b, inBase := baseFiles[f.Path]
+		switch {
+		case !inBase:
+			d.upload = append(d.upload, f)
+		case sameContent(f, b):
+			d.delete = append(d.delete, f)
+		default:
+			d.conflicts = append(d.conflicts, fileDiff{Path: f.Path, Local: f, Changed: "local"})
+		}
+	}
+	for _, f := range d.Missing {
+		b, inBase := baseFiles[f.Path]
+		switch {
+		case !inBase:
+			d.fetch = append(d.fetch, f)
+		case !sameContent(f, b):
+			d.conflicts = append(d.conflicts, fileDiff{Path: f.Path, Server: f, Changed: "server"})
+		}
+	}
+	for _, m := range d.Modified {
+		switch m.Changed {
+		case "local":
+			d.upload = append(d.upload, m.Local)
+		case "server":
+			d.fetch = append(d.fetch, m.Server)
+		default:
+			d.conflicts = append(d.conflicts, m)
+		}
+	}
+	d.conflicts = append(d.conflicts, d.Conflicting...)
+	for _, list := range [][]FileInfo{d.upload, d.fetch, d.delete} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	sort.Slice(d.conflicts, func(i, j int) bool { return d.conflicts[i].Path < d.conflicts[j].Path })
+	return d
+}
+
+func (c *Client) handleProjectDiff(msg message) error {
+	var params struct {
+		Directory string     `json:"directory"`
+		Files     []FileInfo `json:"files"`
+		Baseline  []FileInfo `json:"baseline"`
+	}
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	directory, err := c.resolveProjectDirectory(params.Directory)
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	go func() {
+		local, _, err := c.ListDirContext(c.connectionContext(), filepath.FromSlash(directory), true)
+		if err != nil {
+			c.SendErrorResponse(msg, "Failed to list project files: "+err.Error())
+			return
+		}
+		for i, f := range local {
+			local[i].Path = filepath.ToSlash(f.Path)
+		}
+		baseline := params.Baseline
+		if baseline == nil {
+			baseline = c.syncState(directory).baseline()
+		}
+		c.SendDataResponse(msg, ComputeProjectDiff(local, params.Files, baseline))
+	}()
+	return nil
+}
+
+// Synchronizes local project directory with the server version of the project in the same
+// way as SyncProject request. Progress of every phase is reported with SyncProgress messages,
+// the operation is registered as a fetch operation, so it can be stopped with CancelFetch or
+// AbortFetch message with SyncOptions.ID.
+func (c *Client) Sync(ctx context.Context, project string, mode SyncMode, opts SyncOptions) (*SyncPlan, error) {
+	if mode != SyncPush && mode != SyncPull && mode != SyncMirror {
+		return nil, fmt.Errorf("invalid sync mode: %s", mode)
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return nil, fmt.Errorf("resolving project directory: %w", err)
+	}
+	id := opts.ID
+	if id == "" {
+		id = "sync-" + newStoreID()
+	}
+	op := c.startFetchOperation(id)
+	defer c.finishFetchOperation(id)
+	go func() {
+		select {
+		case <-ctx.Done():
+			op.abort()
+		case <-op.ctx.Done():
+		}
+	}()
+	params := &syncProjectParams{Project: project, Direction: mode, DeleteExtraneous: opts.DeleteExtraneous}
+	summary, err := c.syncProject(op, message{Type: "SyncProject", ID: id}, params, filepath.FromSlash(directory))
+	if summary == nil {
+		return nil, err
+	}
+	if err == nil && len(summary.Failed) > 0 {
+		f := summary.Failed[0]
+		err = fmt.Errorf("synchronization of %d files failed (%s: %s)", len(summary.Failed), f.Path, f.Error)
+	}
+	return summary.plan, err
+}
+
+// Computes plan of the sync operation from the comparison with the base. Two-way mode
+// transfers files changed on one side and deletes local files deleted on the server, files
+// changed on both sides (or without known base) are returned as conflicts. Push and pull modes
+// resolve conflicts in favour of local or server files, mirror mode fetches all server files
+// which differ. Deletions are not propagated to the server, local files which are not on
+// the server are deleted only in pull and mirror mode when enabled.
+// Detected renames replace upload when the server supports renaming of files (and the old
+// file was deleted locally in two-way mode), and fetch with deletion in pull mode, otherwise
+// they are only reported.
+func planProjectSync(d manifestDiff, mode SyncMode, deleteExtraneous, serverRename bool) (SyncPlan, []fileDiff) {
+	plan := SyncPlan{Upload: []FileInfo{}, Fetch: []FileInfo{}, Delete: []FileInfo{}}
+	conflicts := []fileDiff{}
+	switch mode {
+	case SyncPush:
+		plan.Upload = append(plan.Upload, d.upload...)
+		for _, c := range d.conflicts {
+			if c.Local.Path != "" {
+				plan.Upload = append(plan.Upload, c.Local)
+			}
+		}
+	case SyncPull:
+		plan.Fetch = append(plan.Fetch, d.fetch...)
+		for _, c := range d.conflicts {
+			if c.Server.Path != "" {
+				plan.Fetch = append(plan.Fetch, c.Server)
+			}
+		}
+		if deleteExtraneous {
+			plan.Delete = append(plan.Delete, d.New...)
+		}
+	case SyncMirror:
+		plan.Fetch = append(plan.Fetch, d.Missing...)
+		for _, m := range append(d.Modified, d.Conflicting...) {
+			plan.Fetch = append(plan.Fetch, m.Server)
+		}
+		if deleteExtraneous {
+			plan.Delete = append(plan.Delete, d.New...)
+		}
+	case SyncTwoWay:
+		plan.Upload = append(plan.Upload, d.upload...)
+		plan.Fetch = append(plan.Fetch, d.fetch...)
+		plan.Delete = append(plan.Delete, d.delete...)
+		conflicts = append(conflicts, d.conflicts...)
+	}
+	for _, r := range d.Renamed {
+		switch {
+		case mode == SyncPush && serverRename:
+			plan.Rename = append(plan.Rename, RenameEntry{From: r.Server, To: r.Local})
+			plan.Upload = withoutFile(plan.Upload, r.Local)
+		case mode == SyncTwoWay && serverRename && containsFile(plan.Upload, r.Local) && d.deletedLocally(r.Server):
+			plan.Rename = append(plan.Rename, RenameEntry{From: r.Server, To: r.Local})
+			plan.Upload = withoutFile(plan.Upload, r.Local)
+		case mode == SyncPull && deleteExtraneous:
+			plan.Rename = append(plan.Rename, RenameEntry{From: r.Local, To: r.Server})
+			plan.Fetch = withoutFile(plan.Fetch, r.Server)
+			plan.Delete = withoutFile(plan.Delete, r.Local)
+		case mode == SyncPull:
+			plan.DetectedRenames = append(plan.DetectedRenames, RenameEntry{From: r.Local, To: r.Server})
+		default:
+			plan.DetectedRenames = append(plan.DetectedRenames, RenameEntry{From: r.Server, To: r.Local})
+		}
+	}
+	for _, list := range [][]FileInfo{plan.Upload, plan.Fetch, plan.Delete} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return plan, conflicts
+}
+
+// Reports whether the file is in the list
+func containsFile(files []FileInfo, relPath string) bool {
+	for _, f := range files {
+		if f.Path == relPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the server file was deleted locally since the base (it's neither fetched
+// nor conflicting)
+func (d *manifestDiff) deletedLocally(relPath string) bool {
+	if !containsFile(d.Missing, relPath) || containsFile(d.fetch, relPath) {
+		return false
+	}
+	for _, c := range d.conflicts {
+		if c.Path == relPath {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns files without the file with given path
+func withoutFile(files []FileInfo, relPath string) []FileInfo {
+	result := files[:0]
+	for _, f := range files {
+		if f.Path != relPath {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+type syncProjectParams struct {
+	Project   string   `json:"project"`
+	Directory string   `json:"directory"`
+	Direction SyncMode `json:"direction"`
+	// server files, requested from the server when not provided
+	Files []FileInfo `json:"files"`
+	// files of the last synchronized version, the recorded sync state is used when not provided
+	Baseline         []FileInfo `json:"baseline"`
+	DeleteExtraneous bool       `json:"delete_extraneous"`
+	// version of the server project, recorded in the sync state
+	Version string `json:"version"`
+	// take over (stale) lock of the project held by another client
+	ForceLock bool `json:"force_lock"`
+}
+
+// Summary of the SyncProject operation, sent in the final response
+type syncSummary struct {
+	TransferSummary
+	Direction SyncMode `json:"direction"`
+	Uploaded  []string `json:"uploaded"`
+	Fetched   []string `json:"fetched"`
+	Deleted   []string `json:"deleted"`
+	// files renamed instead of transfer
+	Renamed []RenameEntry `json:"renamed"`
+	// detected renames of files which were transferred anyway
+	DetectedRenames []RenameEntry `json:"detected_renames,omitempty"`
+	// fetched files which were not modified on the server
+	Skipped []string       `json:"skipped"`
+	Failed  []fetchFailure `json:"failed"`
+
+	// executed plan, returned by Client.Sync
+	plan *SyncPlan
+}
+
+// Error response of SyncProject request in two-way mode with conflicting changes
+type syncConflictError struct {
+	Error     string     `json:"error"`
+	Reason    string     `json:"reason"`
+	Conflicts []fileDiff `json:"conflicts"`
+}
+
+// Makes local project files and the server version identical in a single operation. Progress
+// is reported with SyncProgress messages, the operation can be aborted with AbortSync message
+// with ID of the request.
+func (c *Client) handleSyncProject(msg message) error {
+	var params syncProjectParams
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	if params.Direction != SyncPush && params.Direction != SyncPull && params.Direction != SyncTwoWay {
+		return c.SendErrorResponse(msg, fmt.Sprintf("Invalid sync direction: %s", params.Direction))
+	}
+	directory, err := c.resolveProjectDirectory(params.Directory)
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	op := c.startFetchOperation(msg.ID)
+	go func() {
+		defer c.finishFetchOperation(msg.ID)
+		summary, err := c.syncProject(op, msg, &params, filepath.FromSlash(directory))
+		if err != nil {
+			if op.ctx.Err() != nil {
+				summary.Aborted = true
+				c.SendDataResponse(msg, summary)
+				return
+			}
+			var lockErr *ProjectLockedError
+			if errors.As(err, &lockErr) {
+				c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: 409, Data: lockErr})
+				return
+			}
+			c.SendErrorResponse(msg, "Failed to sync project: "+err.Error())
+			return
+		}
+		if summary != nil {
+			c.SendDataResponse(msg, summary)
+		}
+	}()
+	return nil
+}
+
+// Executes the SyncProject operation, returns nil summary when the response was already sent
+func (c *Client) syncProject(op *fetchOperation, msg message, params *syncProjectParams, directory string) (*syncSummary, error) {
+	summary := &syncSummary{
+		TransferSummary: newTransferSummary(0),
+		Direction:       params.Direction,
+		Uploaded:        []string{},
+		Fetched:         []string{},
+		Deleted:         []string{},
+		Renamed:         []RenameEntry{},
+		Skipped:         []string{},
+		Failed:          []fetchFailure{},
+	}
+	progress := func(phase, file string, done, total int) {
+		c.SendDataMessage("SyncProgress", syncProgress{Phase: phase, File: file, Done: done, Total: total})
+	}
+	remote := params.Files
+	if remote == nil {
+		var err error
+		if remote, err = c.RemoteFiles(op.ctx, params.Project); err != nil {
+			return summary, err
+		}
+	}
+	progress("scan", "", 0, 0)
+	local, _, err := c.ListDirContext(op.ctx, directory, true)
+	if err != nil {
+		return summary, fmt.Errorf("listing project files: %w", err)
+	}
+	for i, f := range local {
+		local[i].Path = filepath.ToSlash(f.Path)
+	}
+	state := c.syncState(directory)
+	defer c.saveTransferState(directory)
+	baseline := params.Baseline
+	if baseline == nil {
+		baseline = state.baseline()
+	}
+	diff := diffManifests(local, remote, baseline)
+	serverRename := c.serverSupports("rename_files")
+	plan, conflicts := planProjectSync(diff, params.Direction, params.DeleteExtraneous, serverRename)
+	if len(conflicts) > 0 {
+		err := c.SendJsonMessage(genericResponse{Type: msg.Type, ID: msg.ID, Status: 409, Data: syncConflictError{
+			Error:     "Files were modified both locally and on the server",
+			Reason:    "sync_conflict",
+			Conflicts: conflicts,
+		}})
+		if err != nil {
+			log.Printf("Failed to send sync conflicts: %s\n", err)
+		}
+		return nil, nil
+	}
+	summary.plan = &plan
+	// files which are already the same on both sides are synchronized as well
+	state.record(diff.Identical, params.Version)
+	summary.DetectedRenames = plan.DetectedRenames
+	if len(plan.Rename) > 0 {
+		progress("rename", "", 0, len(plan.Rename))
+		c.syncRenames(&plan, diff.ProjectDiff, params, directory, summary)
+	}
+	summary.Total = len(summary.Renamed) + len(plan.Upload) + len(plan.Fetch) + len(plan.Delete)
+	summary.Done = len(summary.Renamed)
+
+	if len(plan.Upload) > 0 {
+		progress("upload", "", 0, len(plan.Upload))
+		uploadProgress := func(p UploadProgress) {
+			progress("upload", p.File, p.FilesDone, p.FilesTotal)
+		}
+		files := FilesParam{Project: params.Project, Files: plan.Upload, Version: params.Version, ForceLock: params.ForceLock}
+		if err := c.uploadFiles(op.ctx, directory, files, nil, uploadProgress); err != nil {
+			return summary, fmt.Errorf("uploading files: %w", err)
+		}
+		for _, f := range plan.Upload {
+			summary.Uploaded = append(summary.Uploaded, f.Path)
+			summary.Bytes += f.Size
+		}
+		summary.Done += len(plan.Upload)
+	}
+
+	if len(plan.Fetch) > 0 {
+		fetchParams := &FilesParam{Project: params.Project, Force: true, Version: params.Version}
+		for i, f := range plan.Fetch {
+			if op.ctx.Err() != nil {
+				return summary, op.ctx.Err()
+			}
+			progress("fetch", f.Path, i, len(plan.Fetch))
+			size, err := c.fetchFile(op, fetchParams, directory, f)
+			summary.Done++
+			switch {
+			case err == nil:
+				summary.Fetched = append(summary.Fetched, f.Path)
+				summary.Bytes += size
+			case errors.Is(err, ErrNotModified):
+				summary.Skipped = append(summary.Skipped, f.Path)
+			case op.ctx.Err() != nil:
+				return summary, op.ctx.Err()
+			default:
+				summary.Failed = append(summary.Failed, fetchFailure{Path: f.Path, Error: err.Error(), Reason: fetchErrorReason(err)})
+			}
+		}
+		progress("fetch", "", len(plan.Fetch), len(plan.Fetch))
+	}
+
+	if len(plan.Delete) > 0 {
+		trashID := ""
+		if c.SoftDelete {
+			trashID = newStoreID()
+		}
+		for i, f := range plan.Delete {
+			if op.ctx.Err() != nil {
+				return summary, op.ctx.Err()
+			}
+			progress("delete", f.Path, i, len(plan.Delete))
+			_, err := c.deletePath(directory, f.Path, trashDir, trashID, f.Hash)
+			summary.Done++
+			if err != nil && !os.IsNotExist(err) {
+				summary.Failed = append(summary.Failed, fetchFailure{Path: f.Path, Error: err.Error(), Reason: newDeleteError(f.Path, err).Category})
+				continue
+			}
+			summary.Deleted = append(summary.Deleted, f.Path)
+			state.remove(f.Path)
+		}
+		if trashID != "" {
+			if err := c.cleanupTrash(directory); err != nil {
+				log.Printf("Failed to clean up trash: %s\n", err)
+			}
+		}
+		progress("delete", "", len(plan.Delete), len(plan.Delete))
+	}
+	summary.finish()
+	return summary, nil
+}
+
+// Renames files according to the plan, on the server in push and two-way mode or locally
+// in pull mode.
+// Files which couldn't be renamed are transferred instead.
+func (c *Client) syncRenames(plan *SyncPlan, diff ProjectDiff, params *syncProjectParams, directory string, summary *syncSummary) {
+	localFiles := make(map[string]FileInfo, len(diff.New))
+	for _, f := range diff.New {
+		localFiles[f.Path] = f
+	}
+	serverFiles := make(map[string]FileInfo, len(diff.Missing))
+	for _, f := range diff.Missing {
+		serverFiles[f.Path] = f
+	}
+	state := c.syncState(directory)
+	if params.Direction != SyncPull {
+		if err := c.moveServerFiles("rename", params.Project, plan.Rename); err != nil {
+			log.Printf("Failed to rename files on server, uploading them: %s\n", err)
+			for _, r := range plan.Rename {
+				plan.Upload = append(plan.Upload, localFiles[r.To])
+			}
+			summary.DetectedRenames = append(summary.DetectedRenames, plan.Rename...)
+			return
+		}
+		for _, r := range plan.Rename {
+			state.remove(r.From)
+			state.record([]FileInfo{localFiles[r.To]}, params.Version)
+		}
+		summary.Renamed = append(summary.Renamed, plan.Rename...)
+		return
+	}
+	for _, r := range plan.Rename {
+		if _, err := c.renamePath(directory, r, false, ""); err != nil {
+			log.Printf("Failed to rename file %s, fetching it: %s\n", r.From, err)
+			plan.Fetch = append(plan.Fetch, serverFiles[r.To])
+			plan.Delete = append(plan.Delete, localFiles[r.From])
+			summary.DetectedRenames = append(summary.DetectedRenames, r)
+			continue
+		}
+		state.remove(r.From)
+		c.recordLocalFile(c.connectionContext(), directory, r.To, params.Version)
+		summary.Renamed = append(summary.Renamed, r)
+	}
+}
@@ -0,0 +1,296 @@
+package gisquick
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func file(path, hash string) FileInfo {
+	return FileInfo{Path: path, Hash: hash, Size: int64(len(hash)), Mtime: 1}
+}
+
+func paths(files []FileInfo) []string {
+	result := []string{}
+	for _, f := range files {
+		result = append(result, f.Path)
+	}
+	return result
+}
+
+func TestDiffManifestsWithBase(t *testing.T) {
+	tests := []struct {
+		name                             string
+		local, remote, base              []FileInfo
+		upload, fetch, delete, conflicts []string
+	}{
+		{
+			name:   "identical",
+			local:  []FileInfo{file("a.gpkg", "aaaa")},
+			remote: []FileInfo{file("a.gpkg", "aaaa")},
+		},
+		{
+			name:   "new local file",
+			local:  []FileInfo{file("a.gpkg", "aaaa")},
+			upload: []string{"a.gpkg"},
+		},
+		{
+			name:   "new remote file",
+			remote: []FileInfo{file("a.gpkg", "aaaa")},
+			fetch:  []string{"a.gpkg"},
+		},
+		{
+			name:   "deleted on server, unchanged locally",
+			local:  []FileInfo{file("a.gpkg", "aaaa")},
+			base:   []FileInfo{file("a.gpkg", "aaaa")},
+			delete: []string{"a.gpkg"},
+		},
+		{
+			name:      "deleted on server, changed locally",
+			local:     []FileInfo{file("a.gpkg", "bbbb")},
+			base:      []FileInfo{file("a.gpkg", "aaaa")},
+			conflicts: []string{"a.gpkg"},
+		},
+		{
+			name:   "deleted locally, unchanged on server",
+			remote: []FileInfo{file("a.gpkg", "aaaa")},
+			base:   []FileInfo{file("a.gpkg", "aaaa")},
+		},
+		{
+			name:      "deleted locally, changed on server",
+			remote:    []FileInfo{file("a.gpkg", "bbbb")},
+			base:      []FileInfo{file("a.gpkg", "aaaa")},
+			conflicts: []string{"a.gpkg"},
+		},
+		{
+			name:   "changed locally",
+			local:  []FileInfo{file("a.gpkg", "bbbb")},
+			remote: []FileInfo{file("a.gpkg", "aaaa")},
+			base:   []FileInfo{file("a.gpkg", "aaaa")},
+			upload: []string{"a.gpkg"},
+		},
+		{
+			name:   "changed on server",
+			local:  []FileInfo{file("a.gpkg", "aaaa")},
+			remote: []FileInfo{file("a.gpkg", "bbbb")},
+			base:   []FileInfo{file("a.gpkg", "aaaa")},
+			fetch:  []string{"a.gpkg"},
+		},
+		{
+			name:      "changed on both sides",
+			local:     []FileInfo{file("a.gpkg", "bbbb")},
+			remote:    []FileInfo{file("a.gpkg", "cccc")},
+			base:      []FileInfo{file("a.gpkg", "aaaa")},
+			conflicts: []string{"a.gpkg"},
+		},
+		{
+			name:      "different without base",
+			local:     []FileInfo{file("a.gpkg", "bbbb")},
+			remote:    []FileInfo{file("a.gpkg", "cccc")},
+			conflicts: []string{"a.gpkg"},
+		},
+		{
+			name:   "different hash algorithms are compared by size and mtime",
+			local:  []FileInfo{file("a.gpkg", "dbhash:1234")},
+			remote: []FileInfo{file("a.gpkg", "sha1:abcd12")},
+		},
+		{
+			name:   "results are sorted",
+			local:  []FileInfo{file("b.qgs", "bbbb"), file("a.qgs", "aaaa")},
+			upload: []string{"a.qgs", "b.qgs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload, fetch, del, conflicts := DiffManifestsWithBase(tt.local, tt.remote, tt.base)
+			for _, r := range []struct {
+				name     string
+				got      []FileInfo
+				expected []string
+			}{
+				{"upload", upload, tt.upload},
+				{"fetch", fetch, tt.fetch},
+				{"delete", del, tt.delete},
+				{"conflicts", conflicts, tt.conflicts},
+			} {
+				expected := r.expected
+				if expected == nil {
+					expected = []string{}
+				}
+				if got := paths(r.got); !reflect.DeepEqual(got, expected) {
+					t.Errorf("%s: got %v, expected %v", r.name, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffManifestsWithoutBase(t *testing.T) {
+	local := []FileInfo{file("a.qgs", "aaaa"), file("b.csv", "bbbb")}
+	remote := []FileInfo{file("b.csv", "cccc"), file("c.tif", "dddd")}
+	upload, fetch, del, conflicts := DiffManifests(local, remote)
+	if !reflect.DeepEqual(paths(upload), []string{"a.qgs"}) || !reflect.DeepEqual(paths(fetch), []string{"c.tif"}) ||
+		len(del) != 0 || !reflect.DeepEqual(paths(conflicts), []string{"b.csv"}) {
+		t.Errorf("unexpected result: %v %v %v %v", paths(upload), paths(fetch), paths(del), paths(conflicts))
+	}
+}
+
+func TestPlanProjectSyncTwoWayRename(t *testing.T) {
+	// a.gpkg was renamed locally to data/a.gpkg
+	local := []FileInfo{file("data/a.gpkg", "aaaa")}
+	remote := []FileInfo{file("a.gpkg", "aaaa")}
+	base := []FileInfo{file("a.gpkg", "aaaa")}
+
+	plan, conflicts := planProjectSync(diffManifests(local, remote, base), SyncTwoWay, false, true)
+	if len(conflicts) != 0 || len(plan.Upload) != 0 || len(plan.Fetch) != 0 || len(plan.Delete) != 0 {
+		t.Fatalf("unexpected plan: %+v, conflicts: %v", plan, conflicts)
+	}
+	if expected := []RenameEntry{{From: "a.gpkg", To: "data/a.gpkg"}}; !reflect.DeepEqual(plan.Rename, expected) {
+		t.Errorf("got renames %v, expected %v", plan.Rename, expected)
+	}
+
+	// without support of the server, the new file is uploaded and the old one is not fetched back
+	plan, _ = planProjectSync(diffManifests(local, remote, base), SyncTwoWay, false, false)
+	if !reflect.DeepEqual(paths(plan.Upload), []string{"data/a.gpkg"}) || len(plan.Fetch) != 0 || len(plan.Rename) != 0 {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if expected := []RenameEntry{{From: "a.gpkg", To: "data/a.gpkg"}}; !reflect.DeepEqual(plan.DetectedRenames, expected) {
+		t.Errorf("got detected renames %v, expected %v", plan.DetectedRenames, expected)
+	}
+}
+
+func TestPlanProjectSyncTwoWayDeletions(t *testing.T) {
+	local := []FileInfo{file("deleted_on_server.csv", "aaaa")}
+	remote := []FileInfo{file("deleted_locally.csv", "bbbb")}
+	base := []FileInfo{file("deleted_on_server.csv", "aaaa"), file("deleted_locally.csv", "bbbb")}
+
+	plan, conflicts := planProjectSync(diffManifests(local, remote, base), SyncTwoWay, false, false)
+	if len(conflicts) != 0 || len(plan.Upload) != 0 || len(plan.Fetch) != 0 {
+		t.Fatalf("unexpected plan: %+v, conflicts: %v", plan, conflicts)
+	}
+	if !reflect.DeepEqual(paths(plan.Delete), []string{"deleted_on_server.csv"}) {
+		t.Errorf("got deleted %v", paths(plan.Delete))
+	}
+}
+
+func TestComputeSyncPlanWithBase(t *testing.T) {
+	local := []FileInfo{file("local.qgs", "bbbb"), file("server.qgs", "aaaa"), file("both.qgs", "bbbb"), file("new.csv", "eeee")}
+	remote := []FileInfo{file("local.qgs", "aaaa"), file("server.qgs", "cccc"), file("both.qgs", "cccc"), file("remote.csv", "ffff")}
+	base := []FileInfo{file("local.qgs", "aaaa"), file("server.qgs", "aaaa"), file("both.qgs", "aaaa")}
+
+	tests := []struct {
+		mode          SyncMode
+		opts          SyncOptions
+		upload, fetch []string
+		delete        []string
+	}{
+		{mode: SyncPush, upload: []string{"both.qgs", "local.qgs", "new.csv"}},
+		{mode: SyncPull, fetch: []string{"both.qgs", "remote.csv", "server.qgs"}},
+		{mode: SyncMirror, fetch: []string{"both.qgs", "local.qgs", "remote.csv", "server.qgs"}},
+		{mode: SyncMirror, opts: SyncOptions{DeleteExtraneous: true}, fetch: []string{"both.qgs", "local.qgs", "remote.csv", "server.qgs"}, delete: []string{"new.csv"}},
+	}
+	for _, tt := range tests {
+		plan := ComputeSyncPlanWithBase(local, remote, base, tt.mode, tt.opts)
+		for _, r := range []struct {
+			name     string
+			got      []FileInfo
+			expected []string
+		}{
+			{"upload", plan.Upload, tt.upload},
+			{"fetch", plan.Fetch, tt.fetch},
+			{"delete", plan.Delete, tt.delete},
+		} {
+			expected := r.expected
+			if expected == nil {
+				expected = []string{}
+			}
+			if got := paths(r.got); !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s (delete extraneous: %v) %s: got %v, expected %v", tt.mode, tt.opts.DeleteExtraneous, r.name, got, expected)
+			}
+		}
+	}
+}
+
+// Client with the plugin callback answering ProjectDirectory requests with given directory
+func syncTestClient(url, dir string) *Client {
+	c := NewClient(url, "user", "")
+	data, _ := json.Marshal(dir)
+	c.OnMessageCallback = func(msg []byte) string {
+		return `{"type": "ProjectDirectory", "status": 200, "data": ` + string(data) + `}`
+	}
+	return c
+}
+
+func TestSyncDeletesIntoTrash(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"files": []}`))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"extra.csv": "extra"})
+	c := syncTestClient(srv.URL, dir)
+	c.SoftDelete = true
+
+	plan, err := c.Sync(context.Background(), "user/project", SyncMirror, SyncOptions{DeleteExtraneous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := paths(plan.Delete); !reflect.DeepEqual(result, []string{"extra.csv"}) {
+		t.Errorf("unexpected deleted files: %v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "extra.csv")); !os.IsNotExist(err) {
+		t.Error("extraneous file was not deleted")
+	}
+	if trashed, _ := filepath.Glob(filepath.Join(dir, trashDir, "*", "extra.csv")); len(trashed) != 1 {
+		t.Errorf("deleted file was not moved into trash: %v", trashed)
+	}
+}
+
+// Sync is registered as a fetch operation and stops when aborted with AbortFetch message
+func TestSyncAbort(t *testing.T) {
+	started := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/project/files/user/project" {
+			w.Write([]byte(`{"files": [{"path": "a.csv", "hash": "x", "size": 1}]}`))
+			return
+		}
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer srv.Close()
+	defer close(stop)
+	c := syncTestClient(srv.URL, t.TempDir())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Sync(context.Background(), "user/project", SyncPull, SyncOptions{ID: "sync1"})
+		done <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("file download was not started")
+	}
+	if err := c.handleAbortFetch(message{Type: "AbortFetch", Data: json.RawMessage(`{"id": "sync1"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected canceled sync, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync was not aborted")
+	}
+}
@@ -0,0 +1,99 @@
+package gisquick
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var ErrCertificatePinMismatch = errors.New("server certificate doesn't match pinned fingerprint")
+
+// Parses SHA-256 fingerprint in hex format, optionally with colon separators
+func parseFingerprint(value string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(value), ":", ""))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint: %s", value)
+	}
+	return fingerprint, nil
+}
+
+// Returns function verifying that the server's leaf certificate has given fingerprint
+func verifyPinnedCertificate(fingerprint []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrCertificatePinMismatch
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if subtle.ConstantTimeCompare(sum[:], fingerprint) != 1 {
+			return fmt.Errorf("%w (received: %s)", ErrCertificatePinMismatch, hex.EncodeToString(sum[:]))
+		}
+		return nil
+	}
+}
+
+// Uses TLS configuration for both HTTP requests and WebSocket connection
+func (c *Client) setTLSConfig(conf *tls.Config) {
+	c.tlsConfig = conf
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = conf
+	c.httpClient.Transport = &authTransport{base: transport, client: c}
+}
+
+// Loads client certificate for mutual TLS authentication
+func (c *Client) loadClientCertificate() (tls.Certificate, error) {
+	if len(c.ClientCertPEM) > 0 || len(c.ClientKeyPEM) > 0 {
+		if len(c.ClientCertPEM) == 0 || len(c.ClientKeyPEM) == 0 {
+			return tls.Certificate{}, errors.New("both client certificate and private key must be set")
+		}
+		cert, err := tls.X509KeyPair(c.ClientCertPEM, c.ClientKeyPEM)
+		if err != nil {
+			return cert, fmt.Errorf("loading client certificate: %w", err)
+		}
+		return cert, nil
+	}
+	if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+		return tls.Certificate{}, errors.New("both client certificate and private key files must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+	if err != nil {
+		return cert, fmt.Errorf("loading client certificate (%s, %s): %w", c.ClientCertFile, c.ClientKeyFile, err)
+	}
+	return cert, nil
+}
+
+// Applies TLS options of the client before connecting to the server
+func (c *Client) configureTLS() error {
+	clientCert := c.ClientCertFile != "" || c.ClientKeyFile != "" || len(c.ClientCertPEM) > 0 || len(c.ClientKeyPEM) > 0
+	if !clientCert && c.PinnedCertSHA256 == "" {
+		return nil
+	}
+	conf := &tls.Config{}
+	if c.tlsConfig != nil {
+		conf = c.tlsConfig.Clone()
+	}
+	if clientCert {
+		cert, err := c.loadClientCertificate()
+		if err != nil {
+			return err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if c.PinnedCertSHA256 != "" {
+		fingerprint, err := parseFingerprint(c.PinnedCertSHA256)
+		if err != nil {
+			return err
+		}
+		// pinned certificate replaces verification against the trust store, so self-signed
+		// certificates can be used as well
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = verifyPinnedCertificate(fingerprint)
+	}
+	c.setTLSConfig(conf)
+	return nil
+}
@@ -0,0 +1,134 @@
+package gisquick
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+)
+
+// Timeout of the probe run of external tools
+const toolProbeTimeout = 10 * time.Second
+
+var dbhashOutputRegex = regexp.MustCompile(`^[0-9a-f]{40}\b`)
+
+type toolsStatus struct {
+	Dbhash     bool   `json:"dbhash"`
+	DbhashImpl string `json:"dbhash_impl"`
+	DbhashPath string `json:"dbhash_path,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Verifies that the binary is a working dbhash tool by hashing an empty database
+func probeDbhash(cmdPath string) error {
+	tmpFile, err := os.CreateTemp("", "gisquick-probe-*.sqlite")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, cmdPath, tmpFile.Name()).Output()
+	if err != nil {
+		return fmt.Errorf("executing %s: %w", cmdPath, err)
+	}
+	if !dbhashOutputRegex.Match(out) {
+		return fmt.Errorf("unexpected output of %s", cmdPath)
+	}
+	return nil
+}
+
+// Changes path of the dbhash tool and detects it again, can be called while connected
+func (c *Client) SetDbhashPath(path string) error {
+	c.toolsMutex.Lock()
+	c.DbhashPath = path
+	c.toolsMutex.Unlock()
+	return c.DetectTools()
+}
+
+func (c *Client) dbhashPath() string {
+	c.toolsMutex.Lock()
+	defer c.toolsMutex.Unlock()
+	return c.DbhashPath
+}
+
+// Finds dbhash tool at configured path, or in PATH and current directory
+func (c *Client) findDbhash() (string, error) {
+	if dbhashPath := c.dbhashPath(); dbhashPath != "" {
+		cmdPath, err := exec.LookPath(dbhashPath)
+		if err != nil {
+			return "", fmt.Errorf("invalid dbhash path: %w", err)
+		}
+		return cmdPath, nil
+	}
+	cmdName := "dbhash"
+	if runtime.GOOS == "windows" {
+		cmdName += ".exe"
+	}
+	cmdPath, err := exec.LookPath(cmdName)
+	if err != nil {
+		localCmd, _ := filepath.Abs(cmdName)
+		cmdPath, err = exec.LookPath(localCmd)
+	}
+	return cmdPath, err
+}
+
+// Detects external tools (dbhash), can be called again after the tool was installed
+// or its path was changed
+func (c *Client) DetectTools() error {
+	cmdPath, err := c.findDbhash()
+	if err == nil {
+		err = probeDbhash(cmdPath)
+	}
+	if err != nil {
+		cmdPath = ""
+		if c.dbhashPath() == "" && (errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist)) {
+			// tool is optional, built-in implementation is used
+			err = nil
+		} else {
+			log.Printf("dbhash tool is not available: %s\n", err)
+		}
+	}
+	c.toolsMutex.Lock()
+	c.dbhashCmd = cmdPath
+	c.toolsMutex.Unlock()
+	return err
+}
+
+// Returns path of the detected dbhash tool (empty when not available)
+func (c *Client) dbhashCommand() string {
+	c.toolsMutex.Lock()
+	defer c.toolsMutex.Unlock()
+	return c.dbhashCmd
+}
+
+func (c *Client) toolsStatus(err error) toolsStatus {
+	status := toolsStatus{
+		Dbhash:     true,
+		DbhashImpl: c.dbhashImpl(),
+		DbhashPath: c.dbhashCommand(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func (c *Client) handleRedetectTools(msg message) error {
+	prevCmd := c.dbhashCommand()
+	err := c.DetectTools()
+	if c.dbhashCommand() != prevCmd {
+		// external and built-in dbhash give the same results, but databases unsupported
+		// by built-in implementation were hashed as plain files
+		c.ClearCache()
+	}
+	return c.SendDataResponse(msg, c.toolsStatus(err))
+}
@@ -0,0 +1,93 @@
+package gisquick
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Removes trash entries older than TrashMaxAge and then the oldest entries until total
+// size of the trash is below TrashMaxSize
+func (c *Client) cleanupTrash(projectDir string) error {
+	entries, err := listStore(projectDir, trashDir)
+	if err != nil {
+		return err
+	}
+	var totalSize int64
+	for _, e := range entries {
+		totalSize += e.Size
+	}
+	// entries are sorted from the newest one
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		created, err := time.ParseInLocation(storeIDTimeFormat, e.ID, time.Local)
+		expired := err == nil && c.TrashMaxAge > 0 && time.Since(created) > c.TrashMaxAge
+		oversized := c.TrashMaxSize > 0 && totalSize > c.TrashMaxSize
+		if !expired && !oversized {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(projectDir, trashDir, e.ID)); err != nil {
+			return err
+		}
+		totalSize -= e.Size
+	}
+	return nil
+}
+
+func (c *Client) handleListTrash(msg message) error {
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	entries, err := listStore(filepath.FromSlash(directory), trashDir)
+	if err != nil {
+		return fmt.Errorf("listing trash: %w", err)
+	}
+	return c.SendDataResponse(msg, entries)
+}
+
+// Removes given trash entry, or the whole trash when no ID is specified
+func (c *Client) handleEmptyTrash(msg message) error {
+	var params restoreParams
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &params); err != nil {
+			return err
+		}
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	trashRoot := filepath.Join(filepath.FromSlash(directory), trashDir)
+	target := trashRoot
+	if params.ID != "" {
+		if target, err = resolveProjectPath(trashRoot, params.ID); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("emptying trash: %w", err)
+	}
+	return c.SendDataResponse(msg, nil)
+}
+
+func (c *Client) handleRestoreFromTrash(msg message) error {
+	var params restoreParams
+	if err := json.Unmarshal(msg.Data, &params); err != nil {
+		return err
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return fmt.Errorf("resolving project directory: %w", err)
+	}
+	errPaths, err := c.restoreFromStore(filepath.FromSlash(directory), trashDir, params)
+	if err != nil {
+		return fmt.Errorf("restoring from trash: %w", err)
+	}
+	if len(errPaths) > 0 {
+		return c.SendErrorResponse(msg, errPaths)
+	}
+	return c.SendDataResponse(msg, nil)
+}
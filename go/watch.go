@@ -0,0 +1,384 @@
+package gisquick
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Changes of files are collected and sent together after no other change was detected
+// for this duration
+const watchDebounceInterval = 500 * time.Millisecond
+
+// Maximal delay of change notification during continuous changes
+const watchMaxDelay = 5 * time.Second
+
+const (
+	changeAdded = iota + 1
+	changeModified
+	changeRemoved
+)
+
+type projectChanges struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+type projectWatcher struct {
+	root       string
+	watcher    *fsnotify.Watcher
+	fileFilter func(path string, isDir bool) bool
+	tempFiles  *temporaryFileMatcher
+	ignorePats []string
+	// known files (relative paths) and watched directories
+	files   map[string]bool
+	dirs    map[string]bool
+	pending map[string]int
+}
+
+// Merges new change of the file with a pending change
+func (w *projectWatcher) addChange(relPath string, change int) {
+	prev, exists := w.pending[relPath]
+	switch {
+	case !exists:
+		w.pending[relPath] = change
+	case prev == changeAdded && change == changeRemoved:
+		delete(w.pending, relPath)
+	case prev == changeAdded:
+		// added file stays added when modified
+	case prev == changeRemoved && change == changeAdded:
+		w.pending[relPath] = changeModified
+	default:
+		w.pending[relPath] = change
+	}
+}
+
+func (w *projectWatcher) relPath(path string) (string, bool) {
+	if path == w.root || !strings.HasPrefix(path, w.root+string(filepath.Separator)) {
+		return "", false
+	}
+	return path[len(w.root)+1:], true
+}
+
+// Adds watches of the directory and its subdirectories, files found in the directory
+// are reported as added when report is true (files created in a new directory before
+// it was watched)
+func (w *projectWatcher) addTree(dir string, report bool) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		relPath, inside := w.relPath(path)
+		if inside && !w.fileFilter(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if err := w.watcher.Add(path); err != nil {
+				log.Printf("Failed to watch directory %s: %s\n", path, err)
+				return nil
+			}
+			w.dirs[path] = true
+			return nil
+		}
+		if d.Type().IsRegular() && !w.tempFiles.Match(filepath.ToSlash(relPath)) {
+			if report && !w.files[relPath] {
+				w.addChange(relPath, changeAdded)
+			}
+			w.files[relPath] = true
+		}
+		return nil
+	})
+}
+
+// Reports removal of the file, or of all known files in removed directory
+func (w *projectWatcher) removePath(path, relPath string) {
+	if w.files[relPath] {
+		delete(w.files, relPath)
+		w.addChange(relPath, changeRemoved)
+		return
+	}
+	if !w.dirs[path] {
+		return
+	}
+	prefix := relPath + string(filepath.Separator)
+	for f := range w.files {
+		if strings.HasPrefix(f, prefix) {
+			delete(w.files, f)
+			w.addChange(f, changeRemoved)
+		}
+	}
+	dirPrefix := path + string(filepath.Separator)
+	for d := range w.dirs {
+		if d == path || strings.HasPrefix(d, dirPrefix) {
+			w.watcher.Remove(d)
+			delete(w.dirs, d)
+		}
+	}
+}
+
+func (w *projectWatcher) handleEvent(event fsnotify.Event) {
+	path := filepath.Clean(event.Name)
+	relPath, inside := w.relPath(path)
+	if !inside {
+		return
+	}
+	if relPath == ".gisquickignore" {
+		// ignore rules are applied to changes detected since then
+		if filter, err := projectFileFilter(w.root, w.ignorePats); err == nil {
+			w.fileFilter = filter
+		} else {
+			log.Printf("Failed to load ignore rules: %s\n", err)
+		}
+	}
+	if !w.fileFilter(relPath, w.dirs[path]) || w.tempFiles.Match(filepath.ToSlash(relPath)) {
+		return
+	}
+	switch {
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		w.removePath(path, relPath)
+	case event.Op&fsnotify.Create != 0:
+		info, err := os.Lstat(path)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err := w.addTree(path, true); err != nil {
+				log.Printf("Failed to watch directory %s: %s\n", path, err)
+			}
+		} else if info.Mode().IsRegular() {
+			if w.files[relPath] {
+				w.addChange(relPath, changeModified)
+			} else {
+				w.files[relPath] = true
+				w.addChange(relPath, changeAdded)
+			}
+		}
+	case event.Op&fsnotify.Write != 0:
+		if w.files[relPath] {
+			w.addChange(relPath, changeModified)
+		}
+	}
+}
+
+// Returns pending changes with slash separated paths and clears them
+func (w *projectWatcher) flush() projectChanges {
+	changes := projectChanges{Added: []string{}, Modified: []string{}, Removed: []string{}}
+	for path, change := range w.pending {
+		path = filepath.ToSlash(path)
+		switch change {
+		case changeAdded:
+			changes.Added = append(changes.Added, path)
+		case changeModified:
+			changes.Modified = append(changes.Modified, path)
+		case changeRemoved:
+			changes.Removed = append(changes.Removed, path)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Modified)
+	sort.Strings(changes.Removed)
+	w.pending = make(map[string]int)
+	return changes
+}
+
+// Watches the project directory and sends ProjectChanged messages with added, modified
+// and removed files until the context is cancelled. Changes are debounced, so a burst
+// of writes (e.g. saving of a layer) results in a single message. Directory watched on
+// request of the web app (WatchProject) reports changes with LocalChanges messages instead.
+func (c *Client) Watch(ctx context.Context, directory string) error {
+	return c.watchDir(ctx, directory, func(changes projectChanges) error {
+		return c.SendDataMessage("ProjectChanged", changes)
+	})
+}
+
+// Watches the directory and calls notify function with debounced changes
+func (c *Client) watchDir(ctx context.Context, directory string, notify func(projectChanges) error) error {
+	root, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+	fileFilter, err := projectFileFilter(root, c.IgnorePatterns)
+	if err != nil {
+		return err
+	}
+	tempFiles, err := c.temporaryFiles()
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	w := &projectWatcher{
+		root:       root,
+		watcher:    watcher,
+		fileFilter: fileFilter,
+		tempFiles:  tempFiles,
+		ignorePats: c.IgnorePatterns,
+		files:      make(map[string]bool),
+		dirs:       make(map[string]bool),
+		pending:    make(map[string]int),
+	}
+	if err := w.addTree(root, false); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(watchDebounceInterval)
+	timer.Stop()
+	var firstChange time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(event)
+			if len(w.pending) == 0 {
+				continue
+			}
+			if firstChange.IsZero() {
+				firstChange = time.Now()
+			}
+			delay := watchDebounceInterval
+			if remaining := watchMaxDelay - time.Since(firstChange); remaining < delay {
+				delay = remaining
+			}
+			timer.Stop()
+			timer.Reset(delay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Watcher error: %s\n", err)
+		case <-timer.C:
+			firstChange = time.Time{}
+			if len(w.pending) == 0 {
+				continue
+			}
+			if err := notify(w.flush()); err != nil {
+				if errors.Is(err, ErrConnectionNotEstablished) {
+					return err
+				}
+				log.Printf("Failed to send project changes: %s\n", err)
+			}
+		}
+	}
+}
+
+// Local changes of the project files, sent in LocalChanges messages
+type localChanges struct {
+	Directory string   `json:"directory"`
+	Created   []string `json:"created"`
+	Modified  []string `json:"modified"`
+	Deleted   []string `json:"deleted"`
+}
+
+// Watches the directory and sends LocalChanges messages until the context is cancelled
+func (c *Client) watchProject(ctx context.Context, directory string) {
+	err := c.watchDir(ctx, filepath.FromSlash(directory), func(changes projectChanges) error {
+		return c.SendDataMessage("LocalChanges", localChanges{
+			Directory: directory,
+			Created:   changes.Added,
+			Modified:  changes.Modified,
+			Deleted:   changes.Removed,
+		})
+	})
+	if err != nil {
+		log.Printf("Watching of project directory failed: %s\n", err)
+	}
+}
+
+// Starts watching of the directory within the connection context of the WatchProject request,
+// watching of the previous directory is stopped. Must be called with watchMutex held.
+func (c *Client) restartWatchingLocked(directory string) {
+	if c.stopWatch != nil {
+		c.stopWatch()
+		c.stopWatch = nil
+	}
+	c.watchedDir = directory
+	if directory == "" || c.watchCtx == nil || c.watchCtx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.watchCtx)
+	c.stopWatch = cancel
+	go c.watchProject(ctx, directory)
+}
+
+// Follows the project directory announced by the plugin in ProjectChanged message, watching
+// is paused while no project is opened
+func (c *Client) projectDirectoryChanged(directory string) {
+	c.watchMutex.Lock()
+	defer c.watchMutex.Unlock()
+	if c.watchCtx == nil || c.watchCtx.Err() != nil {
+		return
+	}
+	if c.watchedDir != "" && directory != "" && sameDirectory(c.watchedDir, directory) {
+		return
+	}
+	if c.Debug && directory != "" {
+		log.Printf("Project directory changed, watching %s\n", directory)
+	}
+	c.restartWatchingLocked(directory)
+}
+
+// Stops watching of the project directory, returns false when it wasn't watched
+func (c *Client) stopWatching() bool {
+	c.watchMutex.Lock()
+	defer c.watchMutex.Unlock()
+	if c.watchCtx == nil {
+		return false
+	}
+	c.restartWatchingLocked("")
+	c.watchCtx = nil
+	return true
+}
+
+// Starts (enabled is true or omitted) or stops watching of the project directory
+func (c *Client) handleWatchProject(msg message) error {
+	params := struct {
+		Enabled bool `json:"enabled"`
+	}{Enabled: true}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &params); err != nil {
+			return err
+		}
+	}
+	if !params.Enabled {
+		c.stopWatching()
+		return c.SendDataResponse(msg, nil)
+	}
+	directory, err := c.getProjectDirectory()
+	if err != nil {
+		return c.SendErrorResponse(msg, "Failed to get project directory: "+err.Error())
+	}
+	c.watchMutex.Lock()
+	c.watchCtx = c.connectionContext()
+	c.restartWatchingLocked(directory)
+	c.watchMutex.Unlock()
+	return c.SendDataResponse(msg, map[string]string{"directory": directory})
+}
+
+func (c *Client) handleUnwatchProject(msg message) error {
+	c.stopWatching()
+	return c.SendDataResponse(msg, nil)
+}
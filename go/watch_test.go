@@ -0,0 +1,105 @@
+package gisquick
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatcherAddChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  []int
+		expected int
+	}{
+		{"added", []int{changeAdded}, changeAdded},
+		{"added and modified", []int{changeAdded, changeModified}, changeAdded},
+		{"added and removed", []int{changeAdded, changeRemoved}, 0},
+		{"modified twice", []int{changeModified, changeModified}, changeModified},
+		{"modified and removed", []int{changeModified, changeRemoved}, changeRemoved},
+		{"removed and added", []int{changeRemoved, changeAdded}, changeModified},
+		{"removed, added and modified", []int{changeRemoved, changeAdded, changeModified}, changeModified},
+	}
+	for _, test := range tests {
+		w := &projectWatcher{pending: make(map[string]int)}
+		for _, change := range test.changes {
+			w.addChange("a.csv", change)
+		}
+		if change := w.pending["a.csv"]; change != test.expected {
+			t.Errorf("%s: got change %d, expected %d", test.name, change, test.expected)
+		}
+	}
+}
+
+// Starts watching of the directory, returns channel with reported changes
+func startWatching(t *testing.T, dir string) <-chan projectChanges {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := NewClient("http://localhost", "user", "")
+	changes := make(chan projectChanges, 10)
+	go c.watchDir(ctx, dir, func(ch projectChanges) error {
+		changes <- ch
+		return nil
+	})
+	// initial scan of the directory tree
+	time.Sleep(100 * time.Millisecond)
+	return changes
+}
+
+func waitChanges(t *testing.T, changes <-chan projectChanges) projectChanges {
+	select {
+	case ch := <-changes:
+		return ch
+	case <-time.After(watchMaxDelay + time.Second):
+		t.Fatal("changes were not reported")
+	}
+	return projectChanges{}
+}
+
+// Files in new (nested) subdirectories are reported and the subdirectories are watched
+func TestWatchNewSubdirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"project.qgs": "project"})
+	changes := startWatching(t, dir)
+
+	writeFiles(t, dir, map[string]string{"data/sub/a.csv": "a"})
+	ch := waitChanges(t, changes)
+	if !reflect.DeepEqual(ch.Added, []string{"data/sub/a.csv"}) {
+		t.Errorf("unexpected added files: %+v", ch)
+	}
+
+	writeFiles(t, dir, map[string]string{"data/sub/b.csv": "b"})
+	if err := os.WriteFile(filepath.Join(dir, "data", "sub", "a.csv"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch = waitChanges(t, changes)
+	if !reflect.DeepEqual(ch.Added, []string{"data/sub/b.csv"}) || !reflect.DeepEqual(ch.Modified, []string{"data/sub/a.csv"}) {
+		t.Errorf("changes in new subdirectory were not reported: %+v", ch)
+	}
+}
+
+// Burst of writes is reported in a single notification
+func TestWatchDebounce(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"layer.csv": "0"})
+	changes := startWatching(t, dir)
+
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "layer.csv"), []byte{byte('0' + i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(watchDebounceInterval / 20)
+	}
+	ch := waitChanges(t, changes)
+	if !reflect.DeepEqual(ch.Modified, []string{"layer.csv"}) || len(ch.Added) != 0 || len(ch.Removed) != 0 {
+		t.Errorf("unexpected changes: %+v", ch)
+	}
+	select {
+	case ch := <-changes:
+		t.Errorf("burst of writes was reported more than once: %+v", ch)
+	case <-time.After(2 * watchDebounceInterval):
+	}
+}
@@ -122,6 +122,29 @@ class GisquickWs():
         if self._lib:
             self._lib.Stop()
 
+    def cancel_fetch(self):
+        if self._lib:
+            self._lib.CancelFetch()
+
+    def is_connected(self):
+        return bool(self._lib and self._lib.IsConnected())
+
+    def get_status(self):
+        """Status of the connection and counts of running operations"""
+        if not self._lib:
+            return {"state": "disconnected", "connected": False}
+        self._lib.GetStatus.restype = ctypes.c_void_p
+        ptr = self._lib.GetStatus()
+        try:
+            return json.loads(ctypes.string_at(ptr).decode("utf-8"))
+        finally:
+            self._lib.FreeString(ctypes.c_void_p(ptr))
+
+    def set_dbhash_path(self, path):
+        """Path of the dbhash tool, can be set before the client is started"""
+        self._load_lib()
+        return self._lib.SetDbhashPath(go_string(path))
+
     def send(self, name, data=None):
         msg = {
             "type": name
@@ -181,6 +204,17 @@ class GisquickWs2():
 
         return p1.join()
 
+    def cancel_fetch(self):
+        if self._lib:
+            self._lib.CancelFetch()
+
+    def is_connected(self):
+        return bool(self._lib and self._lib.IsConnected())
+
+    def set_dbhash_path(self, path):
+        if self._lib:
+            return self._lib.SetDbhashPath(go_string(path))
+
     def send(self, name, data=None):
         msg = "%s:%s" % (name, data) if data else name
         self.parent_conn.send(msg)
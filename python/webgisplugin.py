@@ -561,6 +561,16 @@ class WebGisPlugin(object):
     def get_settings(self):
         return QSettings(QSettings.IniFormat, QSettings.UserScope, "Gisquick", "gisquick")
 
+    def get_dbhash_path(self):
+        """Path of the dbhash tool configured in settings, or the one bundled with the plugin"""
+        path = self.get_settings().value("dbhash_path", "")
+        if not path:
+            name = "dbhash.exe" if platform.system() == "Windows" else "dbhash"
+            bundled = os.path.join(self.plugin_dir, name)
+            if os.path.isfile(bundled):
+                path = bundled
+        return path
+
     def show_settings(self):
         settings = self.get_settings()
         dialog_filename = os.path.join(self.plugin_dir, "ui", "settings.ui")
@@ -578,7 +588,7 @@ class WebGisPlugin(object):
 
 
     def on_project_change(self, *args):
-        gisquick_ws.send("ProjectChanged")
+        gisquick_ws.send("ProjectChanged", {"directory": QgsProject.instance().absolutePath()})
 
     def on_project_closed(self, *args):
         def debounced():
@@ -664,6 +674,8 @@ class WebGisPlugin(object):
                 username = settings.value("username")
                 password = settings.value("password")
 
+            gisquick_ws.set_dbhash_path(self.get_dbhash_path())
+
             plugin_ver = __metadata__["general"].get("version")
             client_info = "GisquickPlugin/%s (%s %s; QGIS %s)" % (plugin_ver, platform.system(), platform.machine(), Qgis.QGIS_VERSION)
 